@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/robertlestak/tdarr_exporter/internal/tdarr"
+	log "github.com/sirupsen/logrus"
+)
+
+// check tests that tdarr can be reached with the configured TLS, proxy and
+// headers, that it accepts them, and which version it runs. It exits
+// exitUnreachable if tdarr can't be reached and exitAuthError if it
+// rejects the exporter.
+func check(args []string) int {
+	l := log.WithFields(log.Fields{
+		"app": "tdarr_exporter",
+		"fn":  "check",
+	})
+	fs := flag.NewFlagSet("check", flag.ExitOnError)
+	registerOptions(fs, logOptions, tdarrOptions)
+	if err := parseFlags(fs, args); err != nil {
+		l.WithError(err).Error("error parsing flags")
+		return exitError
+	}
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+	if log.GetLevel() < log.DebugLevel {
+		// the failed requests are reported below
+		log.SetLevel(log.FatalLevel)
+	}
+	s := tdarr.NewServerFromEnv()
+	w := os.Stdout
+
+	start := time.Now()
+	st, err := s.GetStatus(ctx)
+	var se *tdarr.StatusError
+	switch {
+	case errors.As(err, &se) && (se.Code == http.StatusUnauthorized || se.Code == http.StatusForbidden):
+		fmt.Fprintf(w, "ok    connect  %s\n", s.Host)
+		fmt.Fprintf(w, "FAIL  auth     %s, check the API key in TDARR_HEADERS\n", se.Status)
+		return exitAuthError
+	case err != nil:
+		fmt.Fprintf(w, "FAIL  connect  %s: %s\n", s.Host, err)
+		return exitUnreachable
+	}
+	fmt.Fprintf(w, "ok    connect  %s in %s\n", s.Host, time.Since(start).Round(time.Millisecond))
+	if !strings.HasPrefix(st.Version, "2.") {
+		fmt.Fprintf(w, "WARN  version  %s, the exporter is built for tdarr 2\n", st.Version)
+	} else {
+		fmt.Fprintf(w, "ok    version  %s on %s, status %s\n", st.Version, st.OS, st.Status)
+	}
+
+	// the status endpoint may not require auth, so it's checked against
+	// the DB
+	stats, err := s.GetStats(ctx)
+	switch {
+	case errors.As(err, &se) && (se.Code == http.StatusUnauthorized || se.Code == http.StatusForbidden):
+		fmt.Fprintf(w, "FAIL  auth     %s, check the API key in TDARR_HEADERS\n", se.Status)
+		return exitAuthError
+	case err != nil:
+		fmt.Fprintf(w, "FAIL  cruddb   %s\n", err)
+		return exitError
+	}
+	fmt.Fprintf(w, "ok    auth\n")
+	fmt.Fprintf(w, "ok    cruddb   %d files in %d libraries, DB %s\n", stats.TotalFileCount, len(stats.ParsedPies), stats.DBLoadStatus)
+	return exitOK
+}
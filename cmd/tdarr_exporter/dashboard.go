@@ -0,0 +1,55 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/robertlestak/tdarr_exporter/internal/collector"
+	"github.com/robertlestak/tdarr_exporter/internal/dashboard"
+	log "github.com/sirupsen/logrus"
+)
+
+// generateDashboard prints a grafana dashboard for the exporter's metrics,
+// with rows for the collectors and counters enabled by the same flags and
+// environment as the exporter.
+func generateDashboard(args []string) int {
+	l := log.WithFields(log.Fields{
+		"app": "tdarr_exporter",
+		"fn":  "generateDashboard",
+	})
+	fs := flag.NewFlagSet("dashboard", flag.ExitOnError)
+	title := fs.String("title", "Tdarr", "dashboard title")
+	uid := fs.String("uid", "tdarr-exporter", "dashboard uid")
+	out := fs.String("output", "", "file to write the dashboard to, stdout if empty")
+	registerOptions(fs, logOptions, stateOptions)
+	collector.RegisterFlags(fs)
+	if err := parseFlags(fs, args); err != nil {
+		l.WithError(err).Error("error parsing flags")
+		return exitError
+	}
+	enabled, err := enabledCollectors()
+	if err != nil {
+		l.WithError(err).Error("error reading collector config")
+		return exitError
+	}
+	bd, err := dashboard.Generate(dashboard.Options{
+		Title:      *title,
+		UID:        *uid,
+		Collectors: enabled,
+		Counters:   os.Getenv("STATE_PATH") != "",
+	})
+	if err != nil {
+		l.WithError(err).Error("error generating dashboard")
+		return exitError
+	}
+	if *out == "" {
+		fmt.Println(string(bd))
+		return exitOK
+	}
+	if err := os.WriteFile(*out, bd, 0644); err != nil {
+		l.WithError(err).Error("error writing dashboard")
+		return exitError
+	}
+	return exitOK
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"sort"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/robertlestak/tdarr_exporter/internal/tdarr"
+	log "github.com/sirupsen/logrus"
+)
+
+// dump fetches the stats and nodes once and prints them, for looking at
+// what tdarr returns without a prometheus.
+func dump(args []string) int {
+	l := log.WithFields(log.Fields{
+		"app": "tdarr_exporter",
+		"fn":  "dump",
+	})
+	fs := flag.NewFlagSet("dump", flag.ExitOnError)
+	format := fs.String("format", "table", "output format, table or json")
+	registerOptions(fs, logOptions, tdarrOptions)
+	if err := parseFlags(fs, args); err != nil {
+		l.WithError(err).Error("error parsing flags")
+		return exitError
+	}
+	if *format != "table" && *format != "json" {
+		l.WithField("format", *format).Error("invalid format, must be table or json")
+		return exitError
+	}
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+	s := tdarr.NewServerFromEnv()
+	stats, err := fetch(ctx, &s)
+	if err != nil {
+		return exitUnreachable
+	}
+	if *format == "json" {
+		out := struct {
+			*tdarr.TdarrStatsResponse
+			FetchedAt time.Time             `json:"fetchedAt"`
+			Nodes     map[string]tdarr.Node `json:"nodes,omitempty"`
+		}{stats, stats.FetchedAt, stats.Nodes}
+		e := json.NewEncoder(os.Stdout)
+		e.SetIndent("", "  ")
+		if err := e.Encode(out); err != nil {
+			l.WithError(err).Error("error writing stats")
+			return exitError
+		}
+		return exitOK
+	}
+	writeStats(os.Stdout, s.Host, stats, false)
+	return exitOK
+}
+
+// fetch returns the stats of a server with its nodes attached. The nodes
+// are left nil if they can't be fetched, as they're less important.
+func fetch(ctx context.Context, s *tdarr.Server) (*tdarr.TdarrStatsResponse, error) {
+	stats, err := s.GetStats(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if nodes, err := s.GetNodes(ctx); err == nil {
+		stats.Nodes = nodes
+	}
+	return &stats, nil
+}
+
+// writeStats writes stats as tables: the totals, queues, libraries, and the
+// nodes and their workers. Progress is drawn as bars if bars is set.
+func writeStats(w io.Writer, host string, stats *tdarr.TdarrStatsResponse, bars bool) {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "Tdarr %s, fetched %s\n\n", host, stats.FetchedAt.Format(time.TimeOnly))
+	fmt.Fprintf(tw, "Files\t%d\n", stats.TotalFileCount)
+	fmt.Fprintf(tw, "Transcodes\t%d\n", stats.TotalTranscodeCount)
+	fmt.Fprintf(tw, "Health checks\t%d\n", stats.TotalHealthCheckCount)
+	fmt.Fprintf(tw, "Space saved\t%.2f GB\n", stats.SizeDiff)
+	fmt.Fprintf(tw, "Tdarr score\t%s%%\n", stats.TdarrScore)
+	fmt.Fprintf(tw, "Health check score\t%s%%\n", stats.HealthCheckScore)
+	fmt.Fprintf(tw, "DB\t%s, queue %d, fetched in %s\n", stats.DBLoadStatus, stats.DBQueue, stats.DBFetchTime)
+
+	fmt.Fprintf(tw, "\nQUEUE\tQUEUED\tSUCCESS\tERROR\n")
+	fmt.Fprintf(tw, "Transcode\t%d\t%d\t%d\n", stats.Table0Count, stats.Table1Count, stats.Table2Count)
+	fmt.Fprintf(tw, "Health check\t%d\t%d\t%d\n", stats.Table3Count, stats.Table4Count, stats.Table5Count)
+
+	if len(stats.ParsedPies) > 0 {
+		fmt.Fprintf(tw, "\nLIBRARY\tFILES\tTRANSCODES\tHEALTH CHECKS\tSPACE SAVED\tTRANSCODE STATUS\tHEALTH\n")
+		for _, p := range stats.ParsedPies {
+			fmt.Fprintf(tw, "%s\t%d\t%d\t%d\t%.2f GB\t%s\t%s\n", p.Library, p.TotalFileCount, p.TotalTranscodeCount,
+				p.TotalHealthCheckCount, p.SizeDiff, counts(p.TranscodeStatus), counts(p.Health))
+		}
+	}
+
+	if len(stats.Nodes) > 0 {
+		fmt.Fprintf(tw, "\nNODE\tPAUSED\tWORKER\tTYPE\tPROGRESS\tFPS\tETA\tFILE\n")
+		for _, id := range sortedKeys(stats.Nodes) {
+			n := stats.Nodes[id]
+			fmt.Fprintf(tw, "%s\t%t\t\t\t\t\t\t\n", n.Name(), n.NodePaused)
+			for _, wid := range sortedKeys(n.Workers) {
+				wk := n.Workers[wid]
+				if wk.Idle {
+					continue
+				}
+				progress := fmt.Sprintf("%.1f%%", wk.Percentage)
+				if bars {
+					progress = bar(wk.Percentage, 20) + " " + progress
+				}
+				fmt.Fprintf(tw, "\t\t%s\t%s\t%s\t%.0f\t%s\t%s\n", wid, wk.WorkerType, progress, wk.FPS, wk.ETA, wk.File)
+			}
+		}
+	}
+	tw.Flush()
+}
+
+// counts formats the counts of a pie as name=value pairs.
+func counts(ti []tdarr.TranscodeInfo) string {
+	var s string
+	for i, t := range ti {
+		if i > 0 {
+			s += " "
+		}
+		s += fmt.Sprintf("%s=%d", t.Name, t.Value)
+	}
+	return s
+}
+
+// bar draws a progress bar of width characters.
+func bar(percent float64, width int) string {
+	n := int(percent / 100 * float64(width))
+	n = min(max(n, 0), width)
+	b := make([]rune, width)
+	for i := range b {
+		b[i] = '-'
+		if i < n {
+			b[i] = '#'
+		}
+	}
+	return "[" + string(b) + "]"
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
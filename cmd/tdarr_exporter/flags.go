@@ -0,0 +1,146 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+
+	"github.com/robertlestak/tdarr_exporter/internal/collector"
+	"github.com/robertlestak/tdarr_exporter/internal/envflag"
+	"github.com/robertlestak/tdarr_exporter/internal/logging"
+	"github.com/robertlestak/tdarr_exporter/internal/tdarr"
+)
+
+// option is an environment variable configuring the exporter. Each is also
+// settable with the flag envflag.Name gives it.
+type option struct {
+	env   string
+	usage string
+	bool  bool
+}
+
+var (
+	logOptions = []option{
+		{env: "LOG_LEVEL", usage: "log level, default info"},
+		{env: "LOG_FORMAT", usage: "log format: text, json or logfmt"},
+		{env: "LOG_BODY_LIMIT", usage: "bytes of request and response bodies logged at debug level, 0 for no limit, default 4096"},
+		{env: "LOG_BODY_REDACT", usage: "log the length of bodies rather than their content", bool: true},
+		{env: "LOG_SAMPLE_INTERVAL", usage: "interval at which repeated warnings are logged, 0 to log every warning, default 1m"},
+	}
+	tdarrOptions = []option{
+		{env: "TDARR_HOST", usage: "URL of the tdarr server, default http://tdarr:8265"},
+		{env: "TDARR_VERIFY_SSL", usage: "verify the certificate of the tdarr server, default true", bool: true},
+		{env: "TDARR_INTERVAL", usage: "default interval of the collectors, default 1m"},
+		{env: "TDARR_CONNECT_TIMEOUT", usage: "timeout of connecting to tdarr, default 5s"},
+		{env: "TDARR_RESPONSE_HEADER_TIMEOUT", usage: "timeout of waiting for tdarr's response headers, default none"},
+		{env: "TDARR_TIMEOUT", usage: "default timeout of the collectors, and of the requests of the subcommands, default 10s"},
+		{env: "TDARR_CA_FILE", usage: "PEM bundle of CAs to trust in addition to the system pool"},
+		{env: "TDARR_CERT_FILE", usage: "client certificate presented to tdarr"},
+		{env: "TDARR_KEY_FILE", usage: "key of the client certificate"},
+		{env: "TDARR_SERVER_NAME", usage: "server name used for SNI and certificate verification"},
+		{env: "TDARR_PROXY", usage: "proxy URL, default HTTP_PROXY, HTTPS_PROXY and NO_PROXY"},
+		{env: "TDARR_HEADERS", usage: "comma separated Name=value headers added to every request"},
+		{env: "TDARR_MAX_CONCURRENT_REQUESTS", usage: "maximum requests in flight to tdarr, 0 for no limit, default 2"},
+		{env: "TDARR_RATE_LIMIT", usage: "requests per second allowed to tdarr, unlimited by default"},
+		{env: "TDARR_RATE_BURST", usage: "burst of the rate limit, default 1"},
+		{env: "TDARR_BREAKER_FAILURES", usage: "consecutive failures which open the circuit breaker, 0 to disable it, default 5"},
+		{env: "TDARR_BREAKER_BACKOFF", usage: "time the circuit breaker stays open, default 30s"},
+		{env: "TDARR_BREAKER_MAX_BACKOFF", usage: "maximum time the circuit breaker stays open, default 5m"},
+		{env: "TDARR_DB_LOAD_STATUSES", usage: "comma separated DB load statuses exported in addition to Stable"},
+	}
+	pushOptions = []option{
+		{env: "PUSHGATEWAY_URL", usage: "URL of the pushgateway"},
+		{env: "PUSHGATEWAY_JOB", usage: "job the metrics are pushed as, default tdarr_exporter"},
+		{env: "PUSHGATEWAY_GROUPING", usage: "comma separated key=value grouping labels"},
+		{env: "PUSHGATEWAY_USERNAME", usage: "basic auth username of the pushgateway"},
+		{env: "PUSHGATEWAY_PASSWORD", usage: "basic auth password of the pushgateway"},
+		{env: "PUSHGATEWAY_DELETE_ON_FAILURE", usage: "delete the pushed metrics when tdarr can't be reached", bool: true},
+	}
+	// stateOptions are also taken by the dashboard, whose counter panels
+	// are only populated when the state file is set
+	stateOptions = []option{
+		{env: "STATE_PATH", usage: "state file of the monotonic counters"},
+	}
+	serveOptions = []option{
+		{env: "PORT", usage: "port to listen on, default 9082"},
+		{env: "WEB_CONFIG_FILE", usage: "web config file enabling TLS and basic auth"},
+		{env: "READYZ_MAX_INTERVALS", usage: "intervals after which /readyz fails without a successful fetch, default 3"},
+		{env: "SHUTDOWN_TIMEOUT", usage: "time allowed to drain the http server and flush outputs, default 10s"},
+		{env: "OTEL_EXPORTER_OTLP_ENDPOINT", usage: "OTLP endpoint metrics are pushed to"},
+		{env: "OTEL_EXPORTER_OTLP_METRICS_ENDPOINT", usage: "OTLP endpoint for metrics, overriding the endpoint"},
+		{env: "OTEL_EXPORTER_OTLP_PROTOCOL", usage: "OTLP protocol: grpc or http/protobuf, default grpc"},
+		{env: "OTEL_EXPORTER_OTLP_INSECURE", usage: "push to the OTLP endpoint without TLS", bool: true},
+		{env: "OTEL_EXPORTER_OTLP_HEADERS", usage: "comma separated key=value OTLP headers"},
+		{env: "OTEL_EXPORTER_OTLP_TIMEOUT", usage: "OTLP timeout in milliseconds, default 10000"},
+		{env: "OTEL_RESOURCE_ATTRIBUTES", usage: "comma separated key=value OTLP resource attributes"},
+		{env: "OTLP_BUFFER_SIZE", usage: "failed OTLP batches kept for retry, default 10"},
+		{env: "OTLP_RETRIES", usage: "retries of an OTLP push, default 3"},
+		{env: "INFLUX_URL", usage: "InfluxDB URL line protocol is written to"},
+		{env: "INFLUX_ORG", usage: "InfluxDB organization"},
+		{env: "INFLUX_BUCKET", usage: "InfluxDB bucket"},
+		{env: "INFLUX_TOKEN", usage: "InfluxDB token"},
+		{env: "INFLUX_SERVE", usage: "serve line protocol on /metrics.influx", bool: true},
+		{env: "MQTT_BROKER", usage: "MQTT broker, eg tcp://mqtt:1883"},
+		{env: "MQTT_CLIENT_ID", usage: "MQTT client ID, default tdarr_exporter"},
+		{env: "MQTT_USERNAME", usage: "MQTT username"},
+		{env: "MQTT_PASSWORD", usage: "MQTT password"},
+		{env: "MQTT_TOPIC_PREFIX", usage: "MQTT topic prefix, default tdarr"},
+		{env: "MQTT_CA_FILE", usage: "PEM bundle of CAs trusted for the MQTT broker"},
+		{env: "MQTT_CERT_FILE", usage: "client certificate presented to the MQTT broker"},
+		{env: "MQTT_KEY_FILE", usage: "key of the MQTT client certificate"},
+		{env: "MQTT_INSECURE_SKIP_VERIFY", usage: "skip verifying the certificate of the MQTT broker", bool: true},
+		{env: "MQTT_DISCOVERY", usage: "publish home assistant discovery, default true", bool: true},
+		{env: "MQTT_DISCOVERY_PREFIX", usage: "home assistant discovery prefix, default homeassistant"},
+		{env: "EVENTS_CONFIG", usage: "event webhooks config file"},
+		{env: "SSE_ENABLED", usage: "serve server-sent events on /events", bool: true},
+		{env: "SSE_BUFFER_SIZE", usage: "events kept for resuming clients, default 1000"},
+		{env: "HISTORY_PATH", usage: "path of the history store"},
+		{env: "HISTORY_RESOLUTION", usage: "minimum time between stored snapshots, default 5m"},
+		{env: "HISTORY_RETENTION", usage: "age after which snapshots are deleted, kept forever by default"},
+		{env: "HISTORY_DOWNSAMPLE", usage: "comma separated age:step tiers snapshots are thinned to, default 7d:1h,90d:1d"},
+	}
+)
+
+// registerOptions adds the flags of opts to fs.
+func registerOptions(fs *flag.FlagSet, opts ...[]option) {
+	for _, group := range opts {
+		for _, o := range group {
+			if o.bool {
+				envflag.BoolVar(fs, envflag.Name(o.env), o.env, o.usage)
+			} else {
+				envflag.Var(fs, envflag.Name(o.env), o.env, o.usage)
+			}
+		}
+	}
+}
+
+// parseFlags parses the flags of a command, which set the environment it's
+// then configured from, and configures logging.
+func parseFlags(fs *flag.FlagSet, args []string) error {
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: tdarr_exporter %s [flags]\n\nFlags:\n", fs.Name())
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() > 0 {
+		fs.Usage()
+		return fmt.Errorf("unexpected argument %q", fs.Arg(0))
+	}
+	return logging.Init()
+}
+
+// enabledCollectors returns whether each collector is enabled, for the
+// commands generating config for the exporter's metrics.
+func enabledCollectors() (map[string]bool, error) {
+	// only the collectors' own options are needed, not the server's
+	cfgs, err := collector.ConfigFromEnv(tdarr.Server{})
+	if err != nil {
+		return nil, err
+	}
+	enabled := make(map[string]bool, len(cfgs))
+	for name, c := range cfgs {
+		enabled[name] = c.Enabled
+	}
+	return enabled, nil
+}
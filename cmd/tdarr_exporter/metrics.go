@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"net/http/httptest"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/robertlestak/tdarr_exporter/internal/collector"
+	"github.com/robertlestak/tdarr_exporter/internal/prom"
+	"github.com/robertlestak/tdarr_exporter/internal/tdarr"
+	log "github.com/sirupsen/logrus"
+)
+
+// printMetrics runs every collector once and prints the metrics /metrics
+// would serve, for checking what the exporter makes of a server.
+func printMetrics(args []string) int {
+	l := log.WithFields(log.Fields{
+		"app": "tdarr_exporter",
+		"fn":  "printMetrics",
+	})
+	fs := flag.NewFlagSet("metrics", flag.ExitOnError)
+	registerOptions(fs, logOptions, tdarrOptions)
+	collector.RegisterFlags(fs)
+	if err := parseFlags(fs, args); err != nil {
+		l.WithError(err).Error("error parsing flags")
+		return exitError
+	}
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+	s := tdarr.NewServerFromEnv()
+	prom.InitMetrics()
+	cfgs, err := collector.ConfigFromEnv(s)
+	if err != nil {
+		l.WithError(err).Error("error reading collector config")
+		return exitError
+	}
+	reg := collector.New(&s, cfgs)
+	code := exitOK
+	if errs := reg.CollectOnce(ctx); len(errs) > 0 && len(errs) == len(reg.Enabled()) {
+		code = exitUnreachable
+	}
+	rec := httptest.NewRecorder()
+	promhttp.Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if _, err := rec.Body.WriteTo(os.Stdout); err != nil {
+		l.WithError(err).Error("error writing metrics")
+		return exitError
+	}
+	return code
+}
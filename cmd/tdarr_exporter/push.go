@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"os/signal"
+	"syscall"
+
+	"github.com/robertlestak/tdarr_exporter/internal/collector"
+	"github.com/robertlestak/tdarr_exporter/internal/prom"
+	"github.com/robertlestak/tdarr_exporter/internal/pushgateway"
+	"github.com/robertlestak/tdarr_exporter/internal/tdarr"
+	log "github.com/sirupsen/logrus"
+)
+
+// push performs a single collection cycle and pushes the result to a
+// pushgateway, for running the exporter as a cron job.
+func push(args []string) int {
+	l := log.WithFields(log.Fields{
+		"app": "tdarr_exporter",
+		"fn":  "push",
+	})
+	fs := flag.NewFlagSet("push", flag.ExitOnError)
+	registerOptions(fs, logOptions, tdarrOptions, pushOptions)
+	collector.RegisterFlags(fs)
+	if err := parseFlags(fs, args); err != nil {
+		l.WithError(err).Error("error parsing flags")
+		return exitError
+	}
+	cfg, err := pushgateway.ConfigFromEnv()
+	if err != nil {
+		l.WithError(err).Error("error reading pushgateway config")
+		return exitError
+	}
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+	s := tdarr.NewServerFromEnv()
+	prom.InitMetrics()
+	cfgs, err := collector.ConfigFromEnv(s)
+	if err != nil {
+		l.WithError(err).Error("error reading collector config")
+		return exitError
+	}
+	reg := collector.New(&s, cfgs)
+	errs := reg.CollectOnce(ctx)
+	if unreachable(errs, reg.Enabled()) {
+		if cfg.DeleteOnFailure {
+			if err := pushgateway.Delete(cfg); err != nil {
+				return exitPushError
+			}
+		}
+		return exitUnreachable
+	}
+	// the metrics of the other collectors which failed are pushed with
+	// their collector_success at 0
+	if err := pushgateway.Push(ctx, cfg); err != nil {
+		return exitPushError
+	}
+	if len(errs) > 0 {
+		l.WithField("failed", len(errs)).Warn("pushed metrics, some collectors failed")
+		return exitPartial
+	}
+	l.Info("pushed metrics")
+	return exitOK
+}
+
+// unreachable reports whether a collection cycle which failed with errs
+// found tdarr unreachable: when the statistics collector, which all the
+// other outputs rely on, or every enabled collector failed.
+func unreachable(errs map[string]error, enabled map[string]collector.Config) bool {
+	if _, ok := errs["statistics"]; ok {
+		return true
+	}
+	return len(errs) > 0 && len(errs) == len(enabled)
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/robertlestak/tdarr_exporter/internal/collector"
+)
+
+func TestUnreachable(t *testing.T) {
+	enabled := map[string]collector.Config{"statistics": {}, "nodes": {}, "settings": {}}
+	failed := errors.New("failed")
+	for _, tc := range []struct {
+		name    string
+		enabled map[string]collector.Config
+		errs    map[string]error
+		want    bool
+	}{
+		{"all succeeded", enabled, nil, false},
+		{"statistics failed", enabled, map[string]error{"statistics": failed}, true},
+		{"others failed", enabled, map[string]error{"nodes": failed, "settings": failed}, false},
+		{"all failed", enabled, map[string]error{"statistics": failed, "nodes": failed, "settings": failed}, true},
+		{"all failed without statistics", map[string]collector.Config{"nodes": {}}, map[string]error{"nodes": failed}, true},
+	} {
+		if got := unreachable(tc.errs, tc.enabled); got != tc.want {
+			t.Errorf("%s: got %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
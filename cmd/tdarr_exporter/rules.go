@@ -0,0 +1,58 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/robertlestak/tdarr_exporter/internal/collector"
+	"github.com/robertlestak/tdarr_exporter/internal/rules"
+	log "github.com/sirupsen/logrus"
+)
+
+// generateRules prints prometheus alerting and recording rules for the
+// metrics of the enabled collectors.
+func generateRules(args []string) int {
+	l := log.WithFields(log.Fields{
+		"app": "tdarr_exporter",
+		"fn":  "generateRules",
+	})
+	o := rules.DefaultOptions()
+	fs := flag.NewFlagSet("rules", flag.ExitOnError)
+	fs.StringVar(&o.Format, "format", o.Format, "output format, rules or prometheusrule")
+	fs.StringVar(&o.Name, "name", o.Name, "name of the PrometheusRule resource")
+	fs.StringVar(&o.Namespace, "namespace", o.Namespace, "namespace of the PrometheusRule resource")
+	fs.StringVar(&o.Job, "job", o.Job, "job label the exporter is scraped with")
+	fs.DurationVar(&o.UnreachableFor, "unreachable-for", o.UnreachableFor, "how long tdarr must be unreachable before alerting")
+	fs.DurationVar(&o.ErrorWindow, "error-window", o.ErrorWindow, "window over which transcode and health check error growth is measured")
+	fs.IntVar(&o.ErrorThreshold, "error-threshold", o.ErrorThreshold, "number of new errors within the window tolerated before alerting")
+	fs.DurationVar(&o.QueueStallWindow, "queue-stall-window", o.QueueStallWindow, "how long the transcode queue may go without shrinking")
+	fs.DurationVar(&o.NodeOfflineFor, "node-offline-for", o.NodeOfflineFor, "how long a node must be offline before alerting")
+	fs.DurationVar(&o.DBLoadStatusFor, "db-load-status-for", o.DBLoadStatusFor, "how long the DB load status may not be Stable before alerting")
+	out := fs.String("output", "", "file to write the rules to, stdout if empty")
+	registerOptions(fs, logOptions)
+	collector.RegisterFlags(fs)
+	if err := parseFlags(fs, args); err != nil {
+		l.WithError(err).Error("error parsing flags")
+		return exitError
+	}
+	var err error
+	if o.Collectors, err = enabledCollectors(); err != nil {
+		l.WithError(err).Error("error reading collector config")
+		return exitError
+	}
+	bd, err := rules.Generate(o)
+	if err != nil {
+		l.WithError(err).Error("error generating rules")
+		return exitError
+	}
+	if *out == "" {
+		fmt.Print(string(bd))
+		return exitOK
+	}
+	if err := os.WriteFile(*out, bd, 0644); err != nil {
+		l.WithError(err).Error("error writing rules")
+		return exitError
+	}
+	return exitOK
+}
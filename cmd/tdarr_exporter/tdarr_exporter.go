@@ -1,48 +1,200 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
 	"net/http"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/robertlestak/tdarr_exporter/internal/collector"
+	"github.com/robertlestak/tdarr_exporter/internal/counters"
+	"github.com/robertlestak/tdarr_exporter/internal/events"
+	"github.com/robertlestak/tdarr_exporter/internal/health"
+	"github.com/robertlestak/tdarr_exporter/internal/history"
+	"github.com/robertlestak/tdarr_exporter/internal/influx"
+	"github.com/robertlestak/tdarr_exporter/internal/mqtt"
+	"github.com/robertlestak/tdarr_exporter/internal/otlp"
 	"github.com/robertlestak/tdarr_exporter/internal/prom"
+	"github.com/robertlestak/tdarr_exporter/internal/sink"
+	"github.com/robertlestak/tdarr_exporter/internal/sse"
 	"github.com/robertlestak/tdarr_exporter/internal/tdarr"
+	"github.com/robertlestak/tdarr_exporter/internal/web"
 	log "github.com/sirupsen/logrus"
 )
 
-func init() {
-	ll, err := log.ParseLevel(os.Getenv("LOG_LEVEL"))
-	if err != nil {
-		ll = log.InfoLevel
+// exit codes of the commands
+const (
+	exitOK          = 0
+	exitError       = 1
+	exitUnreachable = 2
+	exitPushError   = 3
+	exitAuthError   = 4
+	exitPartial     = 5
+)
+
+const usage = `Usage: tdarr_exporter [command] [flags]
+
+Commands:
+  serve      serve metrics and run the outputs, the default
+  push       fetch once and push the metrics to a pushgateway
+  metrics    fetch once and print the metrics /metrics would serve
+  dump       fetch once and print the stats as JSON or a table
+  check      check the connection to tdarr, its auth and version
+  top        show the stats, nodes and workers, refreshed every interval
+  version    print build information
+  dashboard  print a grafana dashboard
+  rules      print prometheus alerting and recording rules
+
+Run tdarr_exporter <command> -h for the flags of a command. Every flag can
+also be set with the environment variable shown in its usage.
+`
+
+func main() {
+	cmd, args := "serve", os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		cmd, args = args[0], args[1:]
+	}
+	switch cmd {
+	case "serve":
+		os.Exit(serve(args))
+	case "push":
+		os.Exit(push(args))
+	case "metrics":
+		os.Exit(printMetrics(args))
+	case "dump":
+		os.Exit(dump(args))
+	case "check":
+		os.Exit(check(args))
+	case "top":
+		os.Exit(top(args))
+	case "version":
+		os.Exit(printVersion(args))
+	case "dashboard":
+		os.Exit(generateDashboard(args))
+	case "rules":
+		os.Exit(generateRules(args))
+	case "help":
+		fmt.Print(usage)
+		os.Exit(exitOK)
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n%s", cmd, usage)
+		os.Exit(exitError)
 	}
-	log.SetLevel(ll)
 }
 
-func main() {
+// serve runs the collectors and serves their metrics until SIGINT or
+// SIGTERM.
+func serve(args []string) int {
 	l := log.WithFields(log.Fields{
 		"app": "tdarr_exporter",
-		"fn":  "main",
+		"fn":  "serve",
 	})
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	registerOptions(fs, logOptions, tdarrOptions, stateOptions, serveOptions)
+	collector.RegisterFlags(fs)
+	if err := parseFlags(fs, args); err != nil {
+		l.WithError(err).Error("error parsing flags")
+		return exitError
+	}
 	l.Debug("starting tdarr_exporter")
 	s := tdarr.NewServerFromEnv()
 	prom.InitMetrics()
-	go func() {
-		for {
-			l.Info("getting stats")
-			stats, err := s.GetStats()
-			if err != nil {
-				l.WithError(err).Error("error getting stats")
-				os.Exit(1)
-			}
-			l.Debug("got stats", stats)
-			if err := stats.ExportProm(); err != nil {
-				l.WithError(err).Error("error exporting stats")
-				os.Exit(1)
-			}
-			time.Sleep(s.Interval)
+	cfgs, err := collector.ConfigFromEnv(s)
+	if err != nil {
+		l.WithError(err).Error("error reading collector config")
+		return exitError
+	}
+	reg := collector.New(&s, cfgs)
+	var sinks []sink.Sink
+	ct, err := counters.LoadFromEnv(s)
+	if err != nil {
+		l.WithError(err).Error("error loading counter state")
+		return exitError
+	}
+	if ct != nil {
+		sinks = append(sinks, ct)
+	}
+	// push sinks run after the counters are updated, so they see them
+	o, err := otlp.NewSinkFromEnv(s)
+	if err != nil {
+		l.WithError(err).Error("error creating otlp sink")
+		return exitError
+	}
+	if o != nil {
+		sinks = append(sinks, o)
+	}
+	ifx, err := influx.NewSinkFromEnv(s)
+	if err != nil {
+		l.WithError(err).Error("error creating influx sink")
+		return exitError
+	}
+	if ifx != nil {
+		sinks = append(sinks, ifx)
+	}
+	mq, err := mqtt.NewSinkFromEnv(s)
+	if err != nil {
+		l.WithError(err).Error("error creating mqtt sink")
+		return exitError
+	}
+	if mq != nil {
+		sinks = append(sinks, mq)
+	}
+	ev, err := events.NewEngineFromEnv(s)
+	if err != nil {
+		l.WithError(err).Error("error creating event engine")
+		return exitError
+	}
+	if ev != nil {
+		sinks = append(sinks, ev)
+	}
+	sb, err := sse.NewBrokerFromEnv(s)
+	if err != nil {
+		l.WithError(err).Error("error creating sse broker")
+		return exitError
+	}
+	if sb != nil {
+		sinks = append(sinks, sb)
+	}
+	hs, err := history.OpenFromEnv()
+	if err != nil {
+		l.WithError(err).Error("error opening history store")
+		return exitError
+	}
+	if hs != nil {
+		sinks = append(sinks, hs)
+	}
+	ht, err := health.NewTrackerFromEnv()
+	if err != nil {
+		l.WithError(err).Error("error creating health tracker")
+		return exitError
+	}
+	for name, cfg := range reg.Enabled() {
+		ht.Register(name, name == "statistics", cfg.Interval)
+	}
+	// cancelled on SIGINT or SIGTERM, or when the http server fails
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+	// the outputs are driven by the statistics document
+	reg.OnSuccess = func(name string) {
+		ht.Success(name)
+		if name == "statistics" {
+			sink.PublishAll(ctx, sinks, reg.State().Stats())
 		}
-	}()
+	}
+	reg.OnFailure = func(name string, err error) {
+		ht.Failure(name, err)
+		if name == "statistics" {
+			sink.PublishFailureAll(ctx, sinks, err)
+		}
+	}
+	go reg.Run(ctx)
 	l.Debug("starting http server")
 	port := os.Getenv("PORT")
 	if port == "" {
@@ -51,9 +203,64 @@ func main() {
 	http.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusOK)
 	})
-	http.Handle("/metrics", promhttp.Handler())
-	if err := http.ListenAndServe(":"+port, nil); err != nil {
-		l.WithError(err).Error("error starting http server")
-		os.Exit(1)
+	http.Handle("/livez", ht.LivezHandler())
+	http.Handle("/readyz", ht.ReadyzHandler())
+	http.Handle("/metrics", reg.Handler(promhttp.Handler()))
+	if ifx != nil && ifx.Serve() {
+		http.Handle("/metrics.influx", ifx.Handler())
+	}
+	if sb != nil {
+		http.Handle("/events", sb.Handler())
+	}
+	if hs != nil {
+		http.Handle("/api/v1/history", hs.Handler())
+	}
+	srv := &http.Server{Addr: ":" + port}
+	errc := make(chan error, 1)
+	if sb != nil {
+		// event streams never finish on their own, so end them when the
+		// server starts draining
+		srv.RegisterOnShutdown(func() { sb.Close(context.Background()) })
+	}
+	go func() {
+		if err := web.ListenAndServe(srv, os.Getenv("WEB_CONFIG_FILE")); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			l.WithError(err).Error("error starting http server")
+			errc <- err
+		}
+	}()
+	code := exitOK
+	select {
+	case <-ctx.Done():
+		l.Info("shutting down")
+	case <-errc:
+		code = exitError
+	}
+	// stop collecting and cancel in-flight requests to tdarr
+	cancel()
+	sctx, scancel := context.WithTimeout(context.Background(), shutdownTimeout())
+	defer scancel()
+	if err := srv.Shutdown(sctx); err != nil {
+		l.WithError(err).Warn("error draining http server")
+	}
+	sink.CloseAll(sctx, sinks)
+	return code
+}
+
+// shutdownTimeout returns how long to wait for the http server to drain and
+// the sinks to flush on shutdown, from SHUTDOWN_TIMEOUT.
+func shutdownTimeout() time.Duration {
+	l := log.WithFields(log.Fields{
+		"app": "tdarr_exporter",
+		"fn":  "shutdownTimeout",
+	})
+	v := os.Getenv("SHUTDOWN_TIMEOUT")
+	if v == "" {
+		return 10 * time.Second
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		l.WithError(err).Warn("invalid SHUTDOWN_TIMEOUT, using 10s")
+		return 10 * time.Second
 	}
+	return d
 }
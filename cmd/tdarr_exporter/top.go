@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/robertlestak/tdarr_exporter/internal/tdarr"
+	log "github.com/sirupsen/logrus"
+)
+
+// ANSI escapes drawing the terminal UI of top
+const (
+	enterScreen = "\x1b[?1049h\x1b[?25l" // alternate screen, cursor hidden
+	leaveScreen = "\x1b[?25h\x1b[?1049l"
+	clearScreen = "\x1b[H\x1b[2J"
+)
+
+// top shows the stats, libraries, nodes and workers of a server, refreshed
+// every interval, for a quick look from a shell. When stdout isn't a
+// terminal the stats are printed as plain text every interval instead.
+func top(args []string) int {
+	l := log.WithFields(log.Fields{
+		"app": "tdarr_exporter",
+		"fn":  "top",
+	})
+	fs := flag.NewFlagSet("top", flag.ExitOnError)
+	interval := fs.Duration("interval", 2*time.Second, "refresh interval")
+	plain := fs.Bool("plain", false, "print plain text even when stdout is a terminal")
+	registerOptions(fs, logOptions, tdarrOptions)
+	if err := parseFlags(fs, args); err != nil {
+		l.WithError(err).Error("error parsing flags")
+		return exitError
+	}
+	if *interval <= 0 {
+		l.WithField("interval", *interval).Error("invalid interval")
+		return exitError
+	}
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+	tty := !*plain && isTerminal(os.Stdout)
+	if tty && log.GetLevel() < log.DebugLevel {
+		// errors are shown in the UI, and logs would scroll it
+		log.SetLevel(log.FatalLevel)
+	}
+	s := tdarr.NewServerFromEnv()
+	if tty {
+		os.Stdout.WriteString(enterScreen)
+		defer os.Stdout.WriteString(leaveScreen)
+	}
+	var last *tdarr.TdarrStatsResponse
+	t := time.NewTicker(*interval)
+	defer t.Stop()
+	for {
+		stats, err := fetch(ctx, &s)
+		if ctx.Err() != nil {
+			return exitOK
+		}
+		if err == nil {
+			last = stats
+		}
+		if tty {
+			drawTop(s.Host, last, err)
+		} else if err != nil {
+			fmt.Printf("%s error: %s\n\n", time.Now().Format(time.TimeOnly), err)
+		} else {
+			writeStats(os.Stdout, s.Host, stats, false)
+			fmt.Println()
+		}
+		select {
+		case <-ctx.Done():
+			return exitOK
+		case <-t.C:
+		}
+	}
+}
+
+// drawTop redraws the screen with the last stats fetched, and the error of
+// the last fetch if it failed.
+func drawTop(host string, stats *tdarr.TdarrStatsResponse, err error) {
+	// drawn to a buffer and written at once, so that the screen doesn't
+	// flicker
+	var b bytes.Buffer
+	b.WriteString(clearScreen)
+	if err != nil {
+		fmt.Fprintf(&b, "error: %s\n", err)
+		if stats != nil {
+			fmt.Fprintf(&b, "showing stats from %s\n", stats.FetchedAt.Format(time.TimeOnly))
+		}
+		b.WriteString("\n")
+	}
+	if stats != nil {
+		writeStats(&b, host, stats, true)
+	}
+	b.WriteString("\nctrl-c to quit\n")
+	os.Stdout.Write(b.Bytes())
+}
+
+// isTerminal reports whether f is a terminal rather than a pipe or file.
+// Other character devices, such as /dev/null, count as terminals, which
+// --plain works around.
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return fi.Mode()&os.ModeCharDevice != 0
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"runtime"
+	"runtime/debug"
+)
+
+// set at build time with -ldflags "-X main.version=... -X main.commit=...
+// -X main.date=...", falling back to the VCS information go build embeds
+var (
+	version = "dev"
+	commit  string
+	date    string
+)
+
+// printVersion prints the build information of the exporter.
+func printVersion(args []string) int {
+	fs := flag.NewFlagSet("version", flag.ExitOnError)
+	fs.Parse(args)
+	c, d, modified := commit, date, false
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		for _, s := range bi.Settings {
+			switch s.Key {
+			case "vcs.revision":
+				if c == "" {
+					c = s.Value
+				}
+			case "vcs.time":
+				if d == "" {
+					d = s.Value
+				}
+			case "vcs.modified":
+				modified = s.Value == "true"
+			}
+		}
+	}
+	if c == "" {
+		c = "unknown"
+	} else if modified {
+		c += " (modified)"
+	}
+	if d == "" {
+		d = "unknown"
+	}
+	fmt.Printf("tdarr_exporter %s\n", version)
+	fmt.Printf("  commit:     %s\n", c)
+	fmt.Printf("  build date: %s\n", d)
+	fmt.Printf("  go version: %s\n", runtime.Version())
+	fmt.Printf("  platform:   %s/%s\n", runtime.GOOS, runtime.GOARCH)
+	return exitOK
+}
@@ -0,0 +1,605 @@
+package collector
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/robertlestak/tdarr_exporter/internal/envflag"
+	"github.com/robertlestak/tdarr_exporter/internal/prom"
+	"github.com/robertlestak/tdarr_exporter/internal/tdarr"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sync/singleflight"
+)
+
+// Collector fetches one kind of data from tdarr and sets its metrics.
+type Collector interface {
+	Update(ctx context.Context, s *tdarr.Server, st *State) error
+	// Metrics are the metrics set by the collector. They are unregistered
+	// when the collector is disabled, so that they aren't exported as zero.
+	Metrics() []prometheus.Collector
+}
+
+type factory struct {
+	enabled bool
+	create  func() Collector
+}
+
+var factories = make(map[string]factory)
+
+// register makes a collector available, and enabled by default if enabled
+// is set.
+func register(name string, enabled bool, create func() Collector) {
+	factories[name] = factory{enabled: enabled, create: create}
+}
+
+// Names returns the names of the available collectors, sorted.
+func Names() []string {
+	var names []string
+	for name := range factories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+var (
+	collectorSuccess = prom.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "tdarr_exporter_collector_success",
+		Help: "Whether the last run of a collector succeeded",
+	}, []string{"collector"})
+	collectorDuration = prom.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "tdarr_exporter_collector_duration_seconds",
+		Help: "Duration of the last run of a collector",
+	}, []string{"collector"})
+	collectorStale = prom.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "tdarr_exporter_collector_stale",
+		Help: "Whether the metrics of a collector are the values of its last successful run, served while it fails",
+	}, []string{"collector"})
+	dataAgeDesc = prometheus.NewDesc(
+		"tdarr_data_age_seconds",
+		"Time since the last successful run of a collector in the cache_age outage mode",
+		[]string{"collector"}, nil,
+	)
+)
+
+// State holds the latest data fetched by the collectors, for the outputs
+// which need more than metrics.
+type State struct {
+	mu    sync.Mutex
+	stats *tdarr.TdarrStatsResponse
+	nodes map[string]tdarr.Node
+	// fetched is the latest statistics document fetched by any collector,
+	// requested at fetchedAt, shared by the collectors reading it
+	fetched   *tdarr.TdarrStatsResponse
+	fetchedAt time.Time
+}
+
+// fetchStats returns the latest statistics document if it was requested
+// after since, and otherwise fetches it.
+func (st *State) fetchStats(ctx context.Context, s *tdarr.Server, since time.Time) (*tdarr.TdarrStatsResponse, time.Time, error) {
+	st.mu.Lock()
+	stats, at := st.fetched, st.fetchedAt
+	st.mu.Unlock()
+	if stats != nil && at.After(since) {
+		return stats, at, nil
+	}
+	at = time.Now()
+	fetched, err := s.GetStats(ctx)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if at.After(st.fetchedAt) {
+		st.fetched, st.fetchedAt = &fetched, at
+	}
+	return &fetched, at, nil
+}
+
+func (st *State) setStats(stats *tdarr.TdarrStatsResponse) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.stats = stats
+}
+
+func (st *State) setNodes(nodes map[string]tdarr.Node) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.nodes = nodes
+}
+
+// clear forgets the data of a collector whose metrics are dropped.
+func (st *State) clear(name string) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	switch name {
+	case "statistics":
+		st.stats = nil
+	case "nodes":
+		st.nodes = nil
+	}
+}
+
+// Stats returns the latest statistics with the latest nodes attached, or
+// nil if the statistics haven't been fetched.
+func (st *State) Stats() *tdarr.TdarrStatsResponse {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.stats == nil {
+		return nil
+	}
+	stats := *st.stats
+	stats.Nodes = st.nodes
+	return &stats
+}
+
+// Outage modes, which set what a collector serves while it fails.
+const (
+	// OutageDrop leaves the collector's metrics out of scrapes
+	OutageDrop = "drop"
+	// OutageCache serves the metrics of the last successful run
+	OutageCache = "cache"
+	// OutageCacheAge serves the metrics of the last successful run, along
+	// with their age in tdarr_data_age_seconds
+	OutageCacheAge = "cache_age"
+)
+
+// Config is the configuration of a collector.
+type Config struct {
+	Enabled bool
+	// Interval is the time between runs. Collectors with an interval of 0
+	// run on demand, when /metrics is scraped.
+	Interval time.Duration
+	// Timeout bounds a run of the collector, including its requests
+	Timeout time.Duration
+	// Jitter is the fraction of the interval by which runs are randomly
+	// offset, so that collectors sharing an interval don't all hit tdarr at
+	// the same time
+	Jitter float64
+	// Outage is what the collector serves while it fails, one of
+	// OutageDrop, OutageCache or OutageCacheAge
+	Outage string
+	// MaxAge is the age after which the metrics of the last successful run
+	// are dropped rather than served, 0 for no limit
+	MaxAge time.Duration
+}
+
+// ConfigFromEnv returns the configuration of every collector. Collectors
+// are enabled with COLLECTOR_<NAME>, and their interval and timeout are set
+// with COLLECTOR_<NAME>_INTERVAL and COLLECTOR_<NAME>_TIMEOUT, defaulting
+// to TDARR_INTERVAL and TDARR_TIMEOUT. COLLECTOR_JITTER sets the jitter of
+// every collector, default 0.1. The outage mode and max age default to
+// COLLECTOR_OUTAGE and COLLECTOR_MAX_AGE, cache and 5m, and are set with
+// COLLECTOR_<NAME>_OUTAGE and COLLECTOR_<NAME>_MAX_AGE.
+func ConfigFromEnv(s tdarr.Server) (map[string]*Config, error) {
+	jitter := 0.1
+	if v := os.Getenv("COLLECTOR_JITTER"); v != "" {
+		if err := parseJitter(v, &jitter); err != nil {
+			return nil, fmt.Errorf("invalid COLLECTOR_JITTER: %w", err)
+		}
+	}
+	outage := OutageCache
+	if v := os.Getenv("COLLECTOR_OUTAGE"); v != "" {
+		if err := parseOutage(v, &outage); err != nil {
+			return nil, fmt.Errorf("invalid COLLECTOR_OUTAGE: %w", err)
+		}
+	}
+	maxAge := time.Minute * 5
+	if v := os.Getenv("COLLECTOR_MAX_AGE"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			return nil, fmt.Errorf("invalid COLLECTOR_MAX_AGE %q", v)
+		}
+		maxAge = d
+	}
+	cfgs := make(map[string]*Config)
+	for _, name := range Names() {
+		c := &Config{
+			Enabled:  factories[name].enabled,
+			Interval: s.Interval,
+			Timeout:  s.Timeout,
+			Jitter:   jitter,
+			Outage:   outage,
+			MaxAge:   maxAge,
+		}
+		env := "COLLECTOR_" + strings.ToUpper(name)
+		if v := os.Getenv(env); v != "" {
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s %q", env, v)
+			}
+			c.Enabled = b
+		}
+		if v := os.Getenv(env + "_OUTAGE"); v != "" {
+			if err := parseOutage(v, &c.Outage); err != nil {
+				return nil, fmt.Errorf("invalid %s_OUTAGE: %w", env, err)
+			}
+		}
+		for _, d := range []struct {
+			env  string
+			d    *time.Duration
+			zero bool
+		}{
+			{env + "_INTERVAL", &c.Interval, true},
+			{env + "_TIMEOUT", &c.Timeout, false},
+			{env + "_MAX_AGE", &c.MaxAge, true},
+		} {
+			if v := os.Getenv(d.env); v != "" {
+				pd, err := time.ParseDuration(v)
+				if err != nil || pd < 0 || (pd == 0 && !d.zero) {
+					return nil, fmt.Errorf("invalid %s %q", d.env, v)
+				}
+				*d.d = pd
+			}
+		}
+		cfgs[name] = c
+	}
+	return cfgs, nil
+}
+
+func parseJitter(v string, j *float64) error {
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		return err
+	}
+	if f < 0 || f > 1 {
+		return fmt.Errorf("%s is not between 0 and 1", v)
+	}
+	*j = f
+	return nil
+}
+
+func parseOutage(v string, o *string) error {
+	switch v {
+	case OutageDrop, OutageCache, OutageCacheAge:
+		*o = v
+		return nil
+	}
+	return fmt.Errorf("%q is not one of %s, %s or %s", v, OutageDrop, OutageCache, OutageCacheAge)
+}
+
+// RegisterFlags adds a flag to fs for each of the collector environment
+// variables: --collector.<name>, --collector.<name>.interval, .timeout,
+// .outage and .max-age, and --collector.jitter, --collector.outage and
+// --collector.max-age. They must be parsed before ConfigFromEnv is called.
+func RegisterFlags(fs *flag.FlagSet) {
+	for _, name := range Names() {
+		env := "COLLECTOR_" + strings.ToUpper(name)
+		on := "off"
+		if factories[name].enabled {
+			on = "on"
+		}
+		envflag.BoolVar(fs, "collector."+name, env, "enable the "+name+" collector, "+on+" by default")
+		envflag.Var(fs, "collector."+name+".interval", env+"_INTERVAL", "interval of the "+name+" collector, 0 to run it on demand, default TDARR_INTERVAL")
+		envflag.Var(fs, "collector."+name+".timeout", env+"_TIMEOUT", "timeout of the "+name+" collector, default TDARR_TIMEOUT")
+		envflag.Var(fs, "collector."+name+".outage", env+"_OUTAGE", "what the "+name+" collector serves while it fails: drop, cache or cache_age, default COLLECTOR_OUTAGE")
+		envflag.Var(fs, "collector."+name+".max-age", env+"_MAX_AGE", "age after which the cached metrics of the "+name+" collector are dropped, default COLLECTOR_MAX_AGE")
+	}
+	envflag.Var(fs, "collector.jitter", "COLLECTOR_JITTER", "fraction of the interval by which collector runs are randomly offset, default 0.1")
+	envflag.Var(fs, "collector.outage", "COLLECTOR_OUTAGE", "what collectors serve while they fail: drop, cache or cache_age, default cache")
+	envflag.Var(fs, "collector.max-age", "COLLECTOR_MAX_AGE", "age after which cached metrics are dropped, 0 for no limit, default 5m")
+}
+
+type entry struct {
+	name string
+	cfg  Config
+	c    Collector
+
+	mu          sync.Mutex
+	lastSuccess time.Time
+	// stale is set while the collector fails and its last successful
+	// run's metrics are served
+	stale bool
+	// dropped is set while the collector's metrics are unregistered
+	dropped bool
+}
+
+// succeed records a successful run, registering the collector's metrics
+// again if they were dropped.
+func (e *entry) succeed() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.lastSuccess = time.Now()
+	e.stale = false
+	if !e.dropped {
+		return
+	}
+	for _, m := range e.c.Metrics() {
+		prometheus.Register(m)
+	}
+	e.dropped = false
+}
+
+// fail applies the outage mode of the collector after a failed run, and
+// reports whether the metrics of its last successful run are still served.
+// Otherwise they are unregistered, and its data is cleared from st, until
+// it next succeeds.
+func (e *entry) fail(st *State) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.cfg.Outage != OutageDrop && !e.lastSuccess.IsZero() && !e.expired() {
+		e.stale = true
+		return true
+	}
+	e.drop(st)
+	return false
+}
+
+// expired reports whether the last successful run is older than the max
+// age. e.mu must be held.
+func (e *entry) expired() bool {
+	return e.cfg.MaxAge > 0 && time.Since(e.lastSuccess) > e.cfg.MaxAge
+}
+
+// expire drops the metrics served by a failing collector once they're
+// older than its max age, rather than when its next run fails, which for a
+// long interval is well past it.
+func (e *entry) expire(st *State) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.stale && e.expired() {
+		e.drop(st)
+	}
+}
+
+// drop unregisters the collector's metrics and clears its data from st.
+// e.mu must be held.
+func (e *entry) drop(st *State) {
+	e.stale = false
+	collectorStale.WithLabelValues(e.name).Set(0)
+	if e.dropped {
+		return
+	}
+	for _, m := range e.c.Metrics() {
+		if m == prom.Up {
+			// reports the outage itself
+			continue
+		}
+		prometheus.Unregister(m)
+	}
+	st.clear(e.name)
+	e.dropped = true
+}
+
+// wait returns the time until the next run of a collector which started
+// its last run at start: its interval, offset by up to its jitter either
+// way.
+func (e *entry) wait(start time.Time) time.Duration {
+	d := e.cfg.Interval
+	if e.cfg.Jitter > 0 {
+		d += time.Duration((rand.Float64()*2 - 1) * e.cfg.Jitter * float64(d))
+	}
+	return time.Until(start.Add(d))
+}
+
+// Registry runs the enabled collectors against a server.
+type Registry struct {
+	server  *tdarr.Server
+	entries []*entry
+	state   State
+	// flight shares the runs of the on demand collectors
+	flight singleflight.Group
+
+	// OnSuccess and OnFailure are called after each run of a collector
+	OnSuccess func(name string)
+	OnFailure func(name string, err error)
+}
+
+// New creates the enabled collectors, and unregisters the metrics of the
+// disabled ones. prom.InitMetrics must have been called.
+func New(s *tdarr.Server, cfgs map[string]*Config) *Registry {
+	r := &Registry{server: s}
+	for _, name := range Names() {
+		c := factories[name].create()
+		cfg := cfgs[name]
+		if !cfg.Enabled {
+			for _, m := range c.Metrics() {
+				prometheus.Unregister(m)
+			}
+			continue
+		}
+		r.entries = append(r.entries, &entry{name: name, cfg: *cfg, c: c})
+	}
+	prometheus.MustRegister(dataAge{r})
+	return r
+}
+
+// dataAge exports tdarr_data_age_seconds for the collectors in the
+// cache_age outage mode, computed at scrape time.
+type dataAge struct {
+	r *Registry
+}
+
+func (d dataAge) Describe(ch chan<- *prometheus.Desc) {
+	ch <- dataAgeDesc
+}
+
+func (d dataAge) Collect(ch chan<- prometheus.Metric) {
+	for _, e := range d.r.entries {
+		if e.cfg.Outage != OutageCacheAge {
+			continue
+		}
+		e.mu.Lock()
+		last, dropped := e.lastSuccess, e.dropped
+		e.mu.Unlock()
+		if last.IsZero() || dropped {
+			continue
+		}
+		ch <- prometheus.MustNewConstMetric(dataAgeDesc, prometheus.GaugeValue, time.Since(last).Seconds(), e.name)
+	}
+}
+
+// Enabled returns the configuration of the enabled collectors, by name.
+func (r *Registry) Enabled() map[string]Config {
+	en := make(map[string]Config, len(r.entries))
+	for _, e := range r.entries {
+		en[e.name] = e.cfg
+	}
+	return en
+}
+
+func (r *Registry) State() *State {
+	return &r.state
+}
+
+// collect runs a collector with its timeout and records the outcome.
+func (r *Registry) collect(ctx context.Context, e *entry) error {
+	l := log.WithFields(log.Fields{
+		"app":       "tdarr_exporter",
+		"fn":        "collect",
+		"collector": e.name,
+	})
+	l.Debug("running collector")
+	cctx, cancel := context.WithTimeout(ctx, e.cfg.Timeout)
+	defer cancel()
+	start := time.Now()
+	err := e.c.Update(cctx, r.server, &r.state)
+	collectorDuration.WithLabelValues(e.name).Set(time.Since(start).Seconds())
+	if ctx.Err() != nil {
+		// shutting down, not a failure of the collector
+		return ctx.Err()
+	}
+	if err != nil {
+		l.WithError(err).Error("collector failed")
+		collectorSuccess.WithLabelValues(e.name).Set(0)
+		if e.fail(&r.state) {
+			collectorStale.WithLabelValues(e.name).Set(1)
+		}
+		// the outputs are given the other collectors' data too
+		r.expire()
+		if r.OnFailure != nil {
+			r.OnFailure(e.name, err)
+		}
+		return err
+	}
+	collectorSuccess.WithLabelValues(e.name).Set(1)
+	collectorStale.WithLabelValues(e.name).Set(0)
+	e.succeed()
+	r.expire()
+	if r.OnSuccess != nil {
+		r.OnSuccess(e.name)
+	}
+	return nil
+}
+
+// CollectOnce runs every enabled collector once, at the same time, and
+// returns the errors of the failed collectors by name.
+func (r *Registry) CollectOnce(ctx context.Context) map[string]error {
+	var (
+		mu   sync.Mutex
+		wg   sync.WaitGroup
+		errs = make(map[string]error)
+	)
+	for _, e := range r.entries {
+		wg.Add(1)
+		go func(e *entry) {
+			defer wg.Done()
+			if err := r.collect(ctx, e); err != nil {
+				mu.Lock()
+				errs[e.name] = err
+				mu.Unlock()
+			}
+		}(e)
+	}
+	wg.Wait()
+	return errs
+}
+
+// Run runs each collector on its own interval until ctx is done. Collectors
+// run independently, so a slow one doesn't delay the others, and their
+// first runs are spread over their jitter.
+func (r *Registry) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, e := range r.entries {
+		if e.cfg.Interval == 0 {
+			// run once, so that the exporter can become ready before
+			// the first scrape
+			go r.collectShared(ctx, e)
+			continue
+		}
+		wg.Add(1)
+		go func(e *entry) {
+			defer wg.Done()
+			r.run(ctx, e)
+		}(e)
+	}
+	wg.Wait()
+}
+
+func (r *Registry) run(ctx context.Context, e *entry) {
+	first := time.Duration(rand.Float64() * e.cfg.Jitter * float64(e.cfg.Interval))
+	t := time.NewTimer(first)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		start := time.Now()
+		if err := r.collect(ctx, e); err != nil && ctx.Err() != nil {
+			return
+		}
+		// a run which overran its interval is followed by the next at once
+		t.Reset(max(e.wait(start), 0))
+	}
+}
+
+// expire drops the metrics of the failing collectors which are older than
+// their max age.
+func (r *Registry) expire() {
+	for _, e := range r.entries {
+		e.expire(&r.state)
+	}
+}
+
+// Handler runs the on demand collectors before serving a scrape with next,
+// and drops the cached metrics which have passed their max age. Scrapes
+// which arrive together, such as those of a pair of prometheus replicas,
+// share the runs of the collectors.
+func (r *Registry) Handler(next http.Handler) http.Handler {
+	var onDemand []*entry
+	for _, e := range r.entries {
+		if e.cfg.Interval == 0 {
+			onDemand = append(onDemand, e)
+		}
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		r.expire()
+		var wg sync.WaitGroup
+		for _, e := range onDemand {
+			wg.Add(1)
+			go func(e *entry) {
+				defer wg.Done()
+				r.collectShared(req.Context(), e)
+			}(e)
+		}
+		wg.Wait()
+		next.ServeHTTP(w, req)
+	})
+}
+
+// collectShared runs an on demand collector, unless it is already running
+// for another scrape, in which case that run is waited for. A collector
+// and its hooks thus never run more than once at a time. The run isn't
+// cancelled with the scrape which started it, so that the others sharing
+// it don't fail with it; it is bounded by the collector's timeout.
+func (r *Registry) collectShared(ctx context.Context, e *entry) {
+	ch := r.flight.DoChan(e.name, func() (any, error) {
+		return nil, r.collect(context.WithoutCancel(ctx), e)
+	})
+	select {
+	case <-ch:
+	case <-ctx.Done():
+	}
+}
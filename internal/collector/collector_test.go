@@ -0,0 +1,82 @@
+package collector
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/robertlestak/tdarr_exporter/internal/prom"
+	"github.com/robertlestak/tdarr_exporter/internal/tdarr"
+)
+
+// fakeTdarr serves a statistics document, slowly enough that scrapes
+// arriving together overlap.
+func fakeTdarr(t *testing.T, requests *atomic.Int32) *tdarr.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		time.Sleep(50 * time.Millisecond)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"totalFileCount":3,"DBFetchTime":"1s","tdarrScore":"90","healthCheckScore":"80","pies":[]}`))
+	}))
+	t.Cleanup(srv.Close)
+	return &tdarr.Server{Host: srv.URL}
+}
+
+// initMetrics registers the metrics once, however many tests need them.
+var initMetrics sync.Once
+
+func TestHandlerConcurrentScrapes(t *testing.T) {
+	initMetrics.Do(prom.InitMetrics)
+	var requests atomic.Int32
+	cfgs := make(map[string]*Config)
+	for _, name := range Names() {
+		cfgs[name] = &Config{Timeout: 5 * time.Second}
+	}
+	cfgs["statistics"].Enabled = true
+	r := New(fakeTdarr(t, &requests), cfgs)
+	t.Cleanup(func() { prometheus.Unregister(dataAge{r}) })
+	var running, overlapped, successes atomic.Int32
+	r.OnSuccess = func(name string) {
+		if running.Add(1) > 1 {
+			overlapped.Add(1)
+		}
+		// the outputs publishing the stats take a while
+		time.Sleep(10 * time.Millisecond)
+		successes.Add(1)
+		running.Add(-1)
+	}
+	h := r.Handler(promhttp.Handler())
+
+	var wg sync.WaitGroup
+	codes := make([]int, 2)
+	for i := range codes {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+			codes[i] = rec.Code
+		}(i)
+	}
+	wg.Wait()
+	for i, code := range codes {
+		if code != http.StatusOK {
+			t.Errorf("scrape %d: got status %d", i, code)
+		}
+	}
+	if n := overlapped.Load(); n > 0 {
+		t.Errorf("OnSuccess ran concurrently %d times", n)
+	}
+	if got, want := requests.Load(), successes.Load(); got != want || got == 0 {
+		t.Errorf("got %d requests to tdarr for %d runs", got, want)
+	}
+	if got := r.State().Stats(); got == nil || got.TotalFileCount != 3 {
+		t.Errorf("got state %+v", got)
+	}
+}
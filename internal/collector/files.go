@@ -0,0 +1,70 @@
+package collector
+
+import (
+	"context"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/robertlestak/tdarr_exporter/internal/prom"
+	"github.com/robertlestak/tdarr_exporter/internal/tdarr"
+)
+
+func init() {
+	// off by default, as it fetches the whole file DB
+	register("files", false, func() Collector { return filesCollector{} })
+}
+
+var libraryLanguageFiles = prom.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "tdarr_library_language_files",
+	Help: "Number of files in tdarr library with an audio or subtitle stream in a language, as an ISO 639-2/B code",
+}, []string{"library_name", "library_id", "stream_type", "language"})
+
+// languageStreamTypes are the stream types whose languages are exported
+var languageStreamTypes = map[string]bool{"audio": true, "subtitle": true}
+
+// filesCollector exports the languages of the audio and subtitle streams
+// of each library, which the statistics document only has server wide and
+// without the stream type.
+type filesCollector struct{}
+
+func (filesCollector) Metrics() []prometheus.Collector {
+	return []prometheus.Collector{libraryLanguageFiles}
+}
+
+func (filesCollector) Update(ctx context.Context, s *tdarr.Server, st *State) error {
+	libs, err := s.GetLibrarySettings(ctx)
+	if err != nil {
+		return err
+	}
+	names := make(map[string]string, len(libs))
+	for _, lib := range libs {
+		names[lib.ID] = lib.Name
+	}
+	files, err := s.GetFiles(ctx)
+	if err != nil {
+		return err
+	}
+	type key struct {
+		lib, streamType, lang string
+	}
+	counts := make(map[key]int)
+	for _, f := range files {
+		// a file with several streams in a language counts once
+		seen := make(map[key]bool)
+		for _, stream := range f.FFProbeData.Streams {
+			if !languageStreamTypes[stream.CodecType] {
+				continue
+			}
+			k := key{f.DB, stream.CodecType, tdarr.NormalizeLanguage(stream.Tags.Language)}
+			if !seen[k] {
+				seen[k] = true
+				counts[k]++
+			}
+		}
+	}
+	// languages come and go with the files
+	libraryLanguageFiles.Reset()
+	for k, n := range counts {
+		libraryLanguageFiles.WithLabelValues(names[k.lib], k.lib, k.streamType, k.lang).Set(float64(n))
+	}
+	return nil
+}
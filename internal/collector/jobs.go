@@ -0,0 +1,44 @@
+package collector
+
+import (
+	"context"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/robertlestak/tdarr_exporter/internal/prom"
+	"github.com/robertlestak/tdarr_exporter/internal/tdarr"
+)
+
+func init() {
+	// the job history grows with every file processed, so it is off by
+	// default
+	register("jobs", false, func() Collector { return jobsCollector{} })
+}
+
+var jobs = prom.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "tdarr_jobs",
+	Help: "Number of jobs in the tdarr job history",
+}, []string{"type", "status"})
+
+// jobsCollector exports the job history, counted by type and status.
+type jobsCollector struct{}
+
+func (jobsCollector) Metrics() []prometheus.Collector {
+	return []prometheus.Collector{jobs}
+}
+
+func (jobsCollector) Update(ctx context.Context, s *tdarr.Server, st *State) error {
+	js, err := s.GetJobs(ctx)
+	if err != nil {
+		return err
+	}
+	type key struct{ typ, status string }
+	counts := make(map[key]int)
+	for _, j := range js {
+		counts[key{j.Type, j.Status}]++
+	}
+	jobs.Reset()
+	for k, n := range counts {
+		jobs.WithLabelValues(k.typ, k.status).Set(float64(n))
+	}
+	return nil
+}
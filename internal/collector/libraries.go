@@ -0,0 +1,63 @@
+package collector
+
+import (
+	"context"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/robertlestak/tdarr_exporter/internal/prom"
+	"github.com/robertlestak/tdarr_exporter/internal/tdarr"
+)
+
+func init() {
+	register("libraries", true, func() Collector { return &librariesCollector{} })
+}
+
+// librariesCollector exports the per library breakdowns of the statistics
+// document, sharing the document fetched by the statistics collector.
+type librariesCollector struct {
+	statsReader
+}
+
+func (*librariesCollector) Metrics() []prometheus.Collector {
+	return []prometheus.Collector{
+		prom.LibraryTotalFileCount, prom.LibraryTotalTranscodeCount, prom.LibraryTotalHealthCheckCount,
+		prom.LibrarySizeDiff, prom.LibraryTranscodeStatus, prom.LibraryHealth, prom.LibraryVideoCodec,
+		prom.LibraryVideoContainer, prom.LibraryVideoResolution, prom.LibraryAudioCodec,
+		prom.LibraryAudioContainer,
+	}
+}
+
+func (c *librariesCollector) Update(ctx context.Context, s *tdarr.Server, st *State) error {
+	stats, err := c.stats(ctx, s, st)
+	if err != nil {
+		return err
+	}
+	for _, c := range stats.ParsedPies {
+		prom.LibraryTotalFileCount.WithLabelValues(c.Library, c.ID).Set(float64(c.TotalFileCount))
+		prom.LibraryTotalTranscodeCount.WithLabelValues(c.Library, c.ID).Set(float64(c.TotalTranscodeCount))
+		prom.LibraryTotalHealthCheckCount.WithLabelValues(c.Library, c.ID).Set(float64(c.TotalHealthCheckCount))
+		prom.LibrarySizeDiff.WithLabelValues(c.Library, c.ID).Set(c.SizeDiff)
+		for _, t := range c.TranscodeStatus {
+			prom.LibraryTranscodeStatus.WithLabelValues(c.Library, c.ID, t.Name).Set(float64(t.Value))
+		}
+		for _, h := range c.Health {
+			prom.LibraryHealth.WithLabelValues(c.Library, c.ID, h.Name).Set(float64(h.Value))
+		}
+		for _, v := range c.VideoCodec {
+			prom.LibraryVideoCodec.WithLabelValues(c.Library, c.ID, v.Name).Set(float64(v.Value))
+		}
+		for _, v := range c.Container {
+			prom.LibraryVideoContainer.WithLabelValues(c.Library, c.ID, v.Name).Set(float64(v.Value))
+		}
+		for _, r := range c.Resolution {
+			prom.LibraryVideoResolution.WithLabelValues(c.Library, c.ID, r.Name).Set(float64(r.Value))
+		}
+		for _, a := range c.AudioCodec {
+			prom.LibraryAudioCodec.WithLabelValues(c.Library, c.ID, a.Name).Set(float64(a.Value))
+		}
+		for _, v := range c.AudioContainer {
+			prom.LibraryAudioContainer.WithLabelValues(c.Library, c.ID, v.Name).Set(float64(v.Value))
+		}
+	}
+	return nil
+}
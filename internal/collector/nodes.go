@@ -0,0 +1,125 @@
+package collector
+
+import (
+	"context"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/robertlestak/tdarr_exporter/internal/prom"
+	"github.com/robertlestak/tdarr_exporter/internal/tdarr"
+)
+
+func init() {
+	register("nodes", true, func() Collector {
+		return &nodesCollector{seen: make(map[string]string)}
+	})
+}
+
+var (
+	nodeLabels   = []string{"node_id", "node_name"}
+	workerLabels = []string{"node_id", "node_name", "worker_id", "worker_type"}
+
+	nodeOnline = prom.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "tdarr_node_online",
+		Help: "Whether a tdarr node is connected to the server, 0 for nodes which have disconnected",
+	}, nodeLabels)
+	nodePaused = prom.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "tdarr_node_paused",
+		Help: "Whether a tdarr node is paused",
+	}, nodeLabels)
+	nodeWorkerLimit = prom.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "tdarr_node_worker_limit",
+		Help: "Maximum number of workers of a type on a tdarr node",
+	}, append(nodeLabels, "worker_type"))
+	nodeWorkers = prom.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "tdarr_node_workers",
+		Help: "Number of busy workers of a type on a tdarr node",
+	}, append(nodeLabels, "worker_type"))
+	workerProgress = prom.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "tdarr_worker_progress_percent",
+		Help: "Progress of the file being processed by a tdarr worker",
+	}, workerLabels)
+	workerFPS = prom.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "tdarr_worker_fps",
+		Help: "Frames per second of the transcode run by a tdarr worker",
+	}, workerLabels)
+)
+
+// nodesCollector exports the nodes connected to the server and their
+// workers.
+type nodesCollector struct {
+	mu sync.Mutex
+	// seen holds the name of every node seen since startup by ID, so that
+	// nodes which disconnect are reported offline rather than dropped
+	seen map[string]string
+}
+
+func (c *nodesCollector) Metrics() []prometheus.Collector {
+	return []prometheus.Collector{nodeOnline, nodePaused, nodeWorkerLimit, nodeWorkers, workerProgress, workerFPS}
+}
+
+func (c *nodesCollector) Update(ctx context.Context, s *tdarr.Server, st *State) error {
+	nodes, err := s.GetNodes(ctx)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	// workers come and go with each file, so only the current ones are kept
+	workerProgress.Reset()
+	workerFPS.Reset()
+	for id, name := range c.seen {
+		if n, ok := nodes[id]; !ok {
+			c.forget(id, name, true)
+		} else if n.Name() != name {
+			c.forget(id, name, false)
+		}
+	}
+	for id, n := range nodes {
+		name := n.Name()
+		c.seen[id] = name
+		nodeOnline.WithLabelValues(id, name).Set(1)
+		nodePaused.WithLabelValues(id, name).Set(boolFloat(n.NodePaused))
+		busy := make(map[string]int)
+		for t := range n.WorkerLimits {
+			busy[t] = 0
+		}
+		for wid, w := range n.Workers {
+			if !w.Idle {
+				busy[w.WorkerType]++
+			}
+			workerProgress.WithLabelValues(id, name, wid, w.WorkerType).Set(w.Percentage)
+			workerFPS.WithLabelValues(id, name, wid, w.WorkerType).Set(w.FPS)
+		}
+		for t, limit := range n.WorkerLimits {
+			nodeWorkerLimit.WithLabelValues(id, name, t).Set(float64(limit))
+		}
+		for t, b := range busy {
+			nodeWorkers.WithLabelValues(id, name, t).Set(float64(b))
+		}
+	}
+	st.setNodes(nodes)
+	return nil
+}
+
+// forget removes the series of a node which has disconnected or been
+// renamed. Disconnected nodes are kept as offline.
+func (c *nodesCollector) forget(id, name string, offline bool) {
+	labels := prometheus.Labels{"node_id": id, "node_name": name}
+	nodePaused.Delete(labels)
+	nodeWorkerLimit.DeletePartialMatch(labels)
+	nodeWorkers.DeletePartialMatch(labels)
+	if offline {
+		nodeOnline.With(labels).Set(0)
+	} else {
+		nodeOnline.Delete(labels)
+	}
+	delete(c.seen, id)
+}
+
+func boolFloat(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
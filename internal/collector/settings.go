@@ -0,0 +1,68 @@
+package collector
+
+import (
+	"context"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/robertlestak/tdarr_exporter/internal/prom"
+	"github.com/robertlestak/tdarr_exporter/internal/tdarr"
+)
+
+func init() {
+	register("settings", true, func() Collector { return settingsCollector{} })
+}
+
+var (
+	libraryLabels = []string{"library_name", "library_id"}
+
+	libraryInfo = prom.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "tdarr_library_info",
+		Help: "Settings of tdarr library, always 1",
+	}, append(libraryLabels, "folder"))
+	libraryProcessing = prom.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "tdarr_library_processing_enabled",
+		Help: "Whether tdarr library is processed",
+	}, libraryLabels)
+	libraryFolderWatching = prom.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "tdarr_library_folder_watching_enabled",
+		Help: "Whether tdarr library is watched for new files",
+	}, libraryLabels)
+	libraryPriority = prom.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "tdarr_library_priority",
+		Help: "Priority of tdarr library",
+	}, libraryLabels)
+	nodesPaused = prom.NewGauge(prometheus.GaugeOpts{
+		Name: "tdarr_all_nodes_paused",
+		Help: "Whether every tdarr node is paused by the global setting",
+	})
+)
+
+// settingsCollector exports the library and global settings.
+type settingsCollector struct{}
+
+func (settingsCollector) Metrics() []prometheus.Collector {
+	return []prometheus.Collector{libraryInfo, libraryProcessing, libraryFolderWatching, libraryPriority, nodesPaused}
+}
+
+func (settingsCollector) Update(ctx context.Context, s *tdarr.Server, st *State) error {
+	libs, err := s.GetLibrarySettings(ctx)
+	if err != nil {
+		return err
+	}
+	gs, err := s.GetGlobalSettings(ctx)
+	if err != nil {
+		return err
+	}
+	// removed libraries are dropped
+	for _, v := range []*prometheus.GaugeVec{libraryInfo, libraryProcessing, libraryFolderWatching, libraryPriority} {
+		v.Reset()
+	}
+	for _, lib := range libs {
+		libraryInfo.WithLabelValues(lib.Name, lib.ID, lib.Folder).Set(1)
+		libraryProcessing.WithLabelValues(lib.Name, lib.ID).Set(boolFloat(lib.ProcessLibrary))
+		libraryFolderWatching.WithLabelValues(lib.Name, lib.ID).Set(boolFloat(lib.FolderWatching))
+		libraryPriority.WithLabelValues(lib.Name, lib.ID).Set(float64(lib.Priority))
+	}
+	nodesPaused.Set(boolFloat(gs.PauseAllNodes))
+	return nil
+}
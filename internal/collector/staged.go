@@ -0,0 +1,41 @@
+package collector
+
+import (
+	"context"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/robertlestak/tdarr_exporter/internal/prom"
+	"github.com/robertlestak/tdarr_exporter/internal/tdarr"
+)
+
+func init() {
+	register("staged", true, func() Collector { return stagedCollector{} })
+}
+
+var stagedFiles = prom.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "tdarr_staged_files",
+	Help: "Number of files staged for processing in tdarr library",
+}, []string{"library_id"})
+
+// stagedCollector exports the number of staged files of each library.
+type stagedCollector struct{}
+
+func (stagedCollector) Metrics() []prometheus.Collector {
+	return []prometheus.Collector{stagedFiles}
+}
+
+func (stagedCollector) Update(ctx context.Context, s *tdarr.Server, st *State) error {
+	staged, err := s.GetStaged(ctx)
+	if err != nil {
+		return err
+	}
+	counts := make(map[string]int)
+	for _, f := range staged {
+		counts[f.DB]++
+	}
+	stagedFiles.Reset()
+	for lib, n := range counts {
+		stagedFiles.WithLabelValues(lib).Set(float64(n))
+	}
+	return nil
+}
@@ -0,0 +1,180 @@
+package collector
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/robertlestak/tdarr_exporter/internal/prom"
+	"github.com/robertlestak/tdarr_exporter/internal/tdarr"
+	log "github.com/sirupsen/logrus"
+)
+
+func init() {
+	register("statistics", true, func() Collector { return &statisticsCollector{} })
+}
+
+// statsReader fetches the statistics document for a collector, sharing it
+// with the other collectors reading it: a run uses the document fetched by
+// another collector since the collector's previous run, so that collectors
+// sharing an interval make one request per interval between them.
+type statsReader struct {
+	mu sync.Mutex
+	// since is when the previous run started, or when the document it used
+	// was requested if that's later
+	since time.Time
+}
+
+func (r *statsReader) stats(ctx context.Context, s *tdarr.Server, st *State) (*tdarr.TdarrStatsResponse, error) {
+	start := time.Now()
+	r.mu.Lock()
+	since := r.since
+	r.mu.Unlock()
+	stats, at, err := st.fetchStats(ctx, s, since)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.since = latest(r.since, start, at)
+	return stats, err
+}
+
+func latest(ts ...time.Time) time.Time {
+	var l time.Time
+	for _, t := range ts {
+		if t.After(l) {
+			l = t
+		}
+	}
+	return l
+}
+
+// statisticsCollector exports the server wide totals of the statistics
+// document, and makes the document available to the outputs.
+type statisticsCollector struct {
+	statsReader
+
+	mu sync.Mutex
+	// lastLoadStatus is the status of the previous update, for counting
+	// transitions
+	lastLoadStatus string
+}
+
+func (c *statisticsCollector) Metrics() []prometheus.Collector {
+	return []prometheus.Collector{
+		prom.Up, prom.TotalFileCount, prom.TotalTranscodeCount, prom.TotalHealthCheckCount,
+		prom.SizeDiff, prom.DBFetchTime, prom.DBLoadStatus, prom.DBLoadStatusTransitions,
+		prom.DBQueue, prom.TdarrScore, prom.HealthCheckScore, prom.AverageNumberOfStreamsInVideo,
+		prom.Languages, prom.StreamStatsDurationAverage, prom.StreamStatsDurationHighest,
+		prom.StreamStatsDurationTotal, prom.StreamStatsBitrateAverage, prom.StreamStatsBitrateHighest,
+		prom.StreamStatsBitrateTotal, prom.StreamStatsNbFramesAverage, prom.StreamStatsNbFramesHighest,
+		prom.StreamStatsNbFramesTotal, prom.Table0Count, prom.Table1Count, prom.Table2Count,
+		prom.Table3Count, prom.Table4Count, prom.Table5Count, prom.Table6Count,
+		prom.Table0ViewableCount, prom.Table1ViewableCount, prom.Table2ViewableCount,
+		prom.Table3ViewableCount, prom.Table4ViewableCount, prom.Table5ViewableCount,
+		prom.Table6ViewableCount,
+	}
+}
+
+func (c *statisticsCollector) Update(ctx context.Context, s *tdarr.Server, st *State) error {
+	l := log.WithFields(log.Fields{
+		"app": "tdarr_exporter",
+		"fn":  "statisticsCollector.Update",
+	})
+	stats, err := c.stats(ctx, s, st)
+	if err == nil {
+		err = c.export(stats)
+	}
+	if err != nil {
+		prom.Up.Set(0)
+		return err
+	}
+	l.Debug("exported statistics")
+	prom.Up.Set(1)
+	st.setStats(stats)
+	return nil
+}
+
+func (c *statisticsCollector) export(s *tdarr.TdarrStatsResponse) error {
+	l := log.WithFields(log.Fields{
+		"app": "tdarr_exporter",
+		"fn":  "statisticsCollector.export",
+	})
+	// parse everything before setting any gauge, so that a document which
+	// fails to parse leaves the last successful run's values in place
+	// parse fetch time as duration
+	d, err := time.ParseDuration(s.DBFetchTime)
+	if err != nil {
+		l.WithError(err).Error("error parsing DBFetchTime")
+		return err
+	}
+	// parse tdarr score as float
+	tf, err := strconv.ParseFloat(s.TdarrScore, 64)
+	if err != nil {
+		l.WithError(err).Error("error parsing TdarrScore")
+		return err
+	}
+	hf, err := strconv.ParseFloat(s.HealthCheckScore, 64)
+	if err != nil {
+		l.WithError(err).Error("error parsing HealthCheckScore")
+		return err
+	}
+	prom.TotalFileCount.Set(float64(s.TotalFileCount))
+	prom.TotalTranscodeCount.Set(float64(s.TotalTranscodeCount))
+	prom.TotalHealthCheckCount.Set(float64(s.TotalHealthCheckCount))
+	prom.SizeDiff.Set(s.SizeDiff)
+	prom.DBFetchTime.Set(d.Seconds())
+	c.exportLoadStatus(s)
+	prom.DBQueue.Set(float64(s.DBQueue))
+	prom.TdarrScore.Set(tf)
+	prom.HealthCheckScore.Set(hf)
+	prom.AverageNumberOfStreamsInVideo.Set(s.AvgNumberOfStreamsInVideo)
+	// set languages
+	for k, n := range s.NormalizedLanguages() {
+		prom.Languages.WithLabelValues(k).Set(float64(n))
+	}
+	prom.StreamStatsDurationAverage.Set(float64(s.StreamStats.Duration.Average))
+	prom.StreamStatsDurationHighest.Set(float64(s.StreamStats.Duration.Highest))
+	prom.StreamStatsDurationTotal.Set(float64(s.StreamStats.Duration.Total))
+	prom.StreamStatsBitrateAverage.Set(float64(s.StreamStats.BitRate.Average))
+	prom.StreamStatsBitrateHighest.Set(float64(s.StreamStats.BitRate.Highest))
+	prom.StreamStatsBitrateTotal.Set(float64(s.StreamStats.BitRate.Total))
+	prom.StreamStatsNbFramesAverage.Set(float64(s.StreamStats.NbFrames.Average))
+	prom.StreamStatsNbFramesHighest.Set(float64(s.StreamStats.NbFrames.Highest))
+	prom.StreamStatsNbFramesTotal.Set(float64(s.StreamStats.NbFrames.Total))
+	prom.Table0Count.Set(float64(s.Table0Count))
+	prom.Table1Count.Set(float64(s.Table1Count))
+	prom.Table2Count.Set(float64(s.Table2Count))
+	prom.Table3Count.Set(float64(s.Table3Count))
+	prom.Table4Count.Set(float64(s.Table4Count))
+	prom.Table5Count.Set(float64(s.Table5Count))
+	prom.Table6Count.Set(float64(s.Table6Count))
+	prom.Table0ViewableCount.Set(float64(s.Table0ViewableCount))
+	prom.Table1ViewableCount.Set(float64(s.Table1ViewableCount))
+	prom.Table2ViewableCount.Set(float64(s.Table2ViewableCount))
+	prom.Table3ViewableCount.Set(float64(s.Table3ViewableCount))
+	prom.Table4ViewableCount.Set(float64(s.Table4ViewableCount))
+	prom.Table5ViewableCount.Set(float64(s.Table5ViewableCount))
+	prom.Table6ViewableCount.Set(float64(s.Table6ViewableCount))
+	return nil
+}
+
+// exportLoadStatus sets the DB load status state set, with the current
+// status at 1 and every other status at 0.
+func (c *statisticsCollector) exportLoadStatus(s *tdarr.TdarrStatsResponse) {
+	status := s.LoadStatus()
+	states := append(append([]string(nil), tdarr.KnownLoadStatuses...), tdarr.LoadStatusOther)
+	for _, st := range states {
+		v := 0.0
+		if st == status {
+			v = 1
+		}
+		prom.DBLoadStatus.WithLabelValues(st).Set(v)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.lastLoadStatus != "" && c.lastLoadStatus != status {
+		prom.DBLoadStatusTransitions.WithLabelValues(c.lastLoadStatus, status).Inc()
+	}
+	c.lastLoadStatus = status
+}
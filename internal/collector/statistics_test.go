@@ -0,0 +1,42 @@
+package collector
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/robertlestak/tdarr_exporter/internal/prom"
+	"github.com/robertlestak/tdarr_exporter/internal/tdarr"
+)
+
+func TestExportLoadStatus(t *testing.T) {
+	defer func(known []string) { tdarr.KnownLoadStatuses = known }(tdarr.KnownLoadStatuses)
+	tdarr.KnownLoadStatuses = []string{"Stable", "Busy"}
+	prom.DBLoadStatus.Reset()
+	prom.DBLoadStatusTransitions.Reset()
+	c := &statisticsCollector{}
+	for _, status := range []string{"Stable", "Stable", "Busy", "Rebuilding", "Stable"} {
+		c.exportLoadStatus(&tdarr.TdarrStatsResponse{DBLoadStatus: status})
+	}
+	for status, want := range map[string]float64{"Stable": 1, "Busy": 0, tdarr.LoadStatusOther: 0} {
+		if got := testutil.ToFloat64(prom.DBLoadStatus.WithLabelValues(status)); got != want {
+			t.Errorf("status %s is %v, want %v", status, got, want)
+		}
+	}
+	if got := testutil.ToFloat64(prom.DBLoadStatus.WithLabelValues("Rebuilding")); got != 0 {
+		t.Errorf("unknown status exported on its own: %v", got)
+	}
+	// the first status isn't a transition, nor is a repeated status
+	want := map[[2]string]float64{
+		{"Stable", "Busy"}:                1,
+		{"Busy", tdarr.LoadStatusOther}:   1,
+		{tdarr.LoadStatusOther, "Stable"}: 1,
+	}
+	if got := testutil.CollectAndCount(prom.DBLoadStatusTransitions); got != len(want) {
+		t.Errorf("got %d transitions, want %d", got, len(want))
+	}
+	for tr, n := range want {
+		if got := testutil.ToFloat64(prom.DBLoadStatusTransitions.WithLabelValues(tr[0], tr[1])); got != n {
+			t.Errorf("transition %s to %s counted %v times, want %v", tr[0], tr[1], got, n)
+		}
+	}
+}
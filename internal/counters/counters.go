@@ -0,0 +1,244 @@
+package counters
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"math"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/robertlestak/tdarr_exporter/internal/prom"
+	"github.com/robertlestak/tdarr_exporter/internal/tdarr"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	transcodes   = "transcodes"
+	healthChecks = "health_checks"
+	sizeDiff     = "size_diff"
+)
+
+// resetFraction is the fraction of its last value below which a value which
+// may go down, such as the size diff, is taken to have been reset.
+const resetFraction = 0.05
+
+// Counter turns a raw value, which goes backwards when tdarr's stats are
+// reset, into a total which carries on from the values seen before each
+// reset.
+type Counter struct {
+	// Last is the last raw value seen
+	Last float64 `json:"last"`
+	// Offset is the sum of the raw values seen before each reset
+	Offset float64 `json:"offset"`
+	Resets int     `json:"resets"`
+}
+
+// observe records a raw value and reports whether it was a reset. A
+// monotonic value was reset whenever it goes backwards. Others, such as
+// the size diff or the file counts of a library, also go down when files
+// are deleted or grow, so they are only taken to have been reset when they
+// drop to near zero; any other drop is just taken off the total.
+func (c *Counter) observe(v float64, monotonic bool) bool {
+	reset := v < c.Last
+	if !monotonic {
+		reset = reset && c.Last > 0 && math.Abs(v) <= c.Last*resetFraction
+	}
+	if reset {
+		c.Offset += c.Last
+		c.Resets++
+	}
+	c.Last = v
+	return reset
+}
+
+func (c *Counter) total() float64 {
+	return c.Offset + c.Last
+}
+
+type ServerState struct {
+	Counters  map[string]*Counter            `json:"counters"`
+	Libraries map[string]map[string]*Counter `json:"libraries"`
+}
+
+// State is the content of the state file, keyed by tdarr host.
+type State struct {
+	Servers map[string]*ServerState `json:"servers"`
+}
+
+// Tracker keeps the monotonic counters of a server in a state file, so
+// that they survive both exporter restarts and tdarr stats resets.
+type Tracker struct {
+	path   string
+	server string
+
+	mu    sync.Mutex
+	state State
+	// emitted holds the value each prometheus counter was last raised to
+	emitted map[prometheus.Counter]float64
+}
+
+func Load(path string, s tdarr.Server) (*Tracker, error) {
+	l := log.WithFields(log.Fields{
+		"app": "tdarr_exporter",
+		"fn":  "Load",
+	})
+	t := &Tracker{
+		path:    path,
+		server:  s.Host,
+		state:   State{Servers: make(map[string]*ServerState)},
+		emitted: make(map[prometheus.Counter]float64),
+	}
+	bd, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		l.WithField("path", path).Info("no state file, starting counters from zero")
+	} else if err != nil {
+		l.WithError(err).Error("error reading state file")
+		return nil, err
+	} else if err := json.Unmarshal(bd, &t.state); err != nil {
+		l.WithError(err).Error("error parsing state file")
+		return nil, err
+	}
+	if t.state.Servers == nil {
+		t.state.Servers = make(map[string]*ServerState)
+	}
+	return t, nil
+}
+
+// LoadFromEnv loads the tracker from the state file named by STATE_PATH. It
+// returns nil if no state file is configured.
+func LoadFromEnv(s tdarr.Server) (*Tracker, error) {
+	path := os.Getenv("STATE_PATH")
+	if path == "" {
+		return nil, nil
+	}
+	return Load(path, s)
+}
+
+func (t *Tracker) Name() string {
+	return "counters"
+}
+
+func counter(m map[string]*Counter, name string) *Counter {
+	c, ok := m[name]
+	if !ok {
+		c = &Counter{}
+		m[name] = c
+	}
+	return c
+}
+
+// update feeds a raw value into a counter and raises the prometheus counter
+// to the new total. When the total goes down the prometheus counter is left
+// where it is, and only raised again once the total is above it.
+func (t *Tracker) update(m map[string]*Counter, name, libraryID string, v float64, monotonic bool, pc prometheus.Counter) {
+	c := counter(m, name)
+	if c.observe(v, monotonic) {
+		log.WithFields(log.Fields{
+			"app":        "tdarr_exporter",
+			"fn":         "update",
+			"counter":    name,
+			"library_id": libraryID,
+		}).Warn("counter reset detected")
+		prom.CounterResets.WithLabelValues(name, libraryID).Inc()
+	}
+	total := c.total()
+	if d := total - t.emitted[pc]; d > 0 {
+		pc.Add(d)
+	}
+	t.emitted[pc] = max(t.emitted[pc], total)
+}
+
+// Publish updates the counters from the snapshot and saves the state file.
+func (t *Tracker) Publish(ctx context.Context, stats *tdarr.TdarrStatsResponse) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	ss, ok := t.state.Servers[t.server]
+	if !ok {
+		ss = &ServerState{}
+		t.state.Servers[t.server] = ss
+	}
+	if ss.Counters == nil {
+		ss.Counters = make(map[string]*Counter)
+	}
+	if ss.Libraries == nil {
+		ss.Libraries = make(map[string]map[string]*Counter)
+	}
+	if len(t.emitted) == 0 {
+		t.restoreResets(ss)
+	}
+	// only the server's transcode and health check counts never go down
+	// other than when the stats are reset
+	t.update(ss.Counters, transcodes, "", float64(stats.TotalTranscodeCount), true, prom.TranscodesTotal.WithLabelValues())
+	t.update(ss.Counters, healthChecks, "", float64(stats.TotalHealthCheckCount), true, prom.HealthChecksTotal.WithLabelValues())
+	t.update(ss.Counters, sizeDiff, "", stats.SizeDiff, false, prom.SizeDiffTotal.WithLabelValues())
+	for _, c := range stats.ParsedPies {
+		lc, ok := ss.Libraries[c.ID]
+		if !ok {
+			lc = make(map[string]*Counter)
+			ss.Libraries[c.ID] = lc
+		}
+		t.update(lc, transcodes, c.ID, float64(c.TotalTranscodeCount), false, prom.LibraryTranscodesTotal.WithLabelValues(c.Library, c.ID))
+		t.update(lc, healthChecks, c.ID, float64(c.TotalHealthCheckCount), false, prom.LibraryHealthChecksTotal.WithLabelValues(c.Library, c.ID))
+		t.update(lc, sizeDiff, c.ID, c.SizeDiff, false, prom.LibrarySizeDiffTotal.WithLabelValues(c.Library, c.ID))
+	}
+	return t.save()
+}
+
+// restoreResets brings the reset counters up to the resets recorded in the
+// state file, on the first update after startup.
+func (t *Tracker) restoreResets(ss *ServerState) {
+	for name, c := range ss.Counters {
+		if c.Resets > 0 {
+			prom.CounterResets.WithLabelValues(name, "").Add(float64(c.Resets))
+		}
+	}
+	for id, lc := range ss.Libraries {
+		for name, c := range lc {
+			if c.Resets > 0 {
+				prom.CounterResets.WithLabelValues(name, id).Add(float64(c.Resets))
+			}
+		}
+	}
+}
+
+// save writes the state file atomically, so that a crash can't leave a
+// truncated file behind.
+func (t *Tracker) save() error {
+	l := log.WithFields(log.Fields{
+		"app": "tdarr_exporter",
+		"fn":  "save",
+	})
+	bd, err := json.MarshalIndent(t.state, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(t.path), filepath.Base(t.path)+".tmp")
+	if err != nil {
+		l.WithError(err).Error("error creating state file")
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(bd); err != nil {
+		tmp.Close()
+		l.WithError(err).Error("error writing state file")
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), t.path); err != nil {
+		l.WithError(err).Error("error replacing state file")
+		return err
+	}
+	return nil
+}
+
+func (t *Tracker) Close(ctx context.Context) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.save()
+}
@@ -0,0 +1,73 @@
+package counters
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestUpdate(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		monotonic bool
+		values    []float64
+		// want is the prometheus counter after each value
+		want   []float64
+		resets int
+	}{
+		{
+			name:      "monotonic reset",
+			monotonic: true,
+			values:    []float64{100, 120, 3, 10},
+			want:      []float64{100, 120, 123, 130},
+			resets:    1,
+		},
+		{
+			name:      "monotonic small drop is a reset",
+			monotonic: true,
+			values:    []float64{100, 90, 95},
+			want:      []float64{100, 190, 195},
+			resets:    1,
+		},
+		{
+			// files deleted, then more space saved
+			name:   "drop",
+			values: []float64{100, 90, 95, 110},
+			want:   []float64{100, 100, 100, 110},
+		},
+		{
+			// a transcode which grew a file
+			name:   "drop below zero",
+			values: []float64{10, -2, 12},
+			want:   []float64{10, 10, 12},
+		},
+		{
+			name:   "reset to near zero",
+			values: []float64{100, 120, 2, 10},
+			want:   []float64{100, 120, 122, 130},
+			resets: 1,
+		},
+		{
+			name:   "drop after a reset",
+			values: []float64{100, 0, 50, 40, 60},
+			want:   []float64{100, 100, 150, 150, 160},
+			resets: 1,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			tr := &Tracker{emitted: make(map[prometheus.Counter]float64)}
+			m := make(map[string]*Counter)
+			pc := prometheus.NewCounter(prometheus.CounterOpts{Name: "test_total", Help: "test"})
+			for i, v := range tc.values {
+				tr.update(m, sizeDiff, "lib", v, tc.monotonic, pc)
+				if got := testutil.ToFloat64(pc); got != tc.want[i] {
+					t.Errorf("after %v: counter is %v, want %v", tc.values[:i+1], got, tc.want[i])
+				}
+			}
+			if got := m[sizeDiff].Resets; got != tc.resets {
+				t.Errorf("got %d resets, want %d", got, tc.resets)
+			}
+		})
+	}
+}
@@ -0,0 +1,325 @@
+package dashboard
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+
+	"github.com/robertlestak/tdarr_exporter/internal/prom"
+)
+
+type Options struct {
+	Title string
+	UID   string
+	// Collectors are the enabled collectors. Rows showing the metrics of
+	// other collectors are left out.
+	Collectors map[string]bool
+	// Counters is whether the monotonic counters are enabled, which they
+	// are when STATE_PATH is set. Rows showing them are left out otherwise.
+	Counters bool
+}
+
+type target struct {
+	Expr         string `json:"expr"`
+	LegendFormat string `json:"legendFormat,omitempty"`
+	RefID        string `json:"refId"`
+	Datasource   any    `json:"datasource,omitempty"`
+}
+
+type gridPos struct {
+	H int `json:"h"`
+	W int `json:"w"`
+	X int `json:"x"`
+	Y int `json:"y"`
+}
+
+type panel struct {
+	ID          int            `json:"id"`
+	Type        string         `json:"type"`
+	Title       string         `json:"title"`
+	GridPos     gridPos        `json:"gridPos"`
+	Datasource  any            `json:"datasource,omitempty"`
+	Targets     []target       `json:"targets,omitempty"`
+	FieldConfig map[string]any `json:"fieldConfig,omitempty"`
+	Options     map[string]any `json:"options,omitempty"`
+	Collapsed   bool           `json:"collapsed,omitempty"`
+	Panels      []panel        `json:"panels"`
+}
+
+// query is a panel query before it's bound to a datasource.
+type query struct {
+	expr   string
+	legend string
+}
+
+// panelSpec describes a panel of a row. Width is in grid units out of 24.
+type panelSpec struct {
+	title   string
+	kind    string
+	width   int
+	unit    string
+	queries []query
+}
+
+// row groups panels. collectors are the collectors setting the metrics of
+// the row, which is left out of the dashboard unless they're all enabled,
+// along with the counters if the row shows them.
+type row struct {
+	title      string
+	collectors []string
+	counters   bool
+	panels     []panelSpec
+}
+
+const (
+	server  = `instance=~"$server"`
+	library = `instance=~"$server", library_name=~"$library"`
+)
+
+var rows = []row{
+	{
+		title:      "Overview",
+		collectors: []string{"statistics"},
+		panels: []panelSpec{
+			{"Files", "stat", 4, "none", []query{{`sum(tdarr_total_file_count{` + server + `})`, ""}}},
+			{"Transcodes", "stat", 4, "none", []query{{`sum(tdarr_total_transcode_count{` + server + `})`, ""}}},
+			{"Health checks", "stat", 4, "none", []query{{`sum(tdarr_total_health_check_count{` + server + `})`, ""}}},
+			{"Space saved", "stat", 4, "decgbytes", []query{{`sum(tdarr_size_diff{` + server + `})`, ""}}},
+			{"Tdarr score", "gauge", 4, "percent", []query{{`avg(tdarr_score{` + server + `})`, ""}}},
+			{"Health check score", "gauge", 4, "percent", []query{{`avg(tdarr_health_check_score{` + server + `})`, ""}}},
+		},
+	},
+	{
+		title:      "Queues",
+		collectors: []string{"statistics"},
+		panels: []panelSpec{
+			{"Transcode queue", "timeseries", 12, "none", []query{
+				{`tdarr_table_0_count{` + server + `}`, "queued {{instance}}"},
+				{`tdarr_table_1_count{` + server + `}`, "success {{instance}}"},
+				{`tdarr_table_2_count{` + server + `}`, "error {{instance}}"},
+			}},
+			{"Health check queue", "timeseries", 12, "none", []query{
+				{`tdarr_table_3_count{` + server + `}`, "queued {{instance}}"},
+				{`tdarr_table_4_count{` + server + `}`, "healthy {{instance}}"},
+				{`tdarr_table_5_count{` + server + `}`, "error {{instance}}"},
+			}},
+			{"DB queue", "timeseries", 12, "none", []query{
+				{`tdarr_db_queue{` + server + `}`, "{{instance}}"},
+			}},
+			{"DB fetch time", "timeseries", 12, "s", []query{
+				{`tdarr_db_fetch_time{` + server + `}`, "{{instance}}"},
+			}},
+		},
+	},
+	{
+		title:      "Nodes",
+		collectors: []string{"nodes"},
+		panels: []panelSpec{
+			{"Online nodes", "stat", 6, "none", []query{
+				{`sum(tdarr_node_online{` + server + `})`, ""},
+			}},
+			{"Busy workers", "timeseries", 18, "none", []query{
+				{`sum by (node_name, worker_type) (tdarr_node_workers{` + server + `})`, "{{node_name}} {{worker_type}}"},
+			}},
+			{"Worker progress", "bargauge", 24, "percent", []query{
+				{`tdarr_worker_progress_percent{` + server + `}`, "{{node_name}} {{worker_type}} {{worker_id}}"},
+			}},
+		},
+	},
+	{
+		title:      "Libraries",
+		collectors: []string{"libraries"},
+		panels: []panelSpec{
+			{"Files", "timeseries", 12, "none", []query{
+				{`tdarr_library_total_file_count{` + library + `}`, "{{library_name}}"},
+			}},
+			{"Space saved", "timeseries", 12, "decgbytes", []query{
+				{`tdarr_library_size_diff{` + library + `}`, "{{library_name}}"},
+			}},
+			{"Transcode status", "timeseries", 12, "none", []query{
+				{`sum by (library_name, status) (tdarr_library_transcode_status{` + library + `})`, "{{library_name}} {{status}}"},
+			}},
+			{"Health", "timeseries", 12, "none", []query{
+				{`sum by (library_name, health) (tdarr_library_health{` + library + `})`, "{{library_name}} {{health}}"},
+			}},
+		},
+	},
+	{
+		title:      "Codecs and resolutions",
+		collectors: []string{"libraries"},
+		panels: []panelSpec{
+			{"Video codecs", "piechart", 6, "none", []query{
+				{`sum by (codec) (tdarr_library_video_codec{` + library + `})`, "{{codec}}"},
+			}},
+			{"Video containers", "piechart", 6, "none", []query{
+				{`sum by (container) (tdarr_library_video_container{` + library + `})`, "{{container}}"},
+			}},
+			{"Resolutions", "piechart", 6, "none", []query{
+				{`sum by (resolution) (tdarr_library_video_resolution{` + library + `})`, "{{resolution}}"},
+			}},
+			{"Audio codecs", "piechart", 6, "none", []query{
+				{`sum by (codec) (tdarr_library_audio_codec{` + library + `})`, "{{codec}}"},
+			}},
+		},
+	},
+	{
+		title: "Exporter",
+		panels: []panelSpec{
+			{"Collector success", "timeseries", 12, "none", []query{
+				{`tdarr_exporter_collector_success{` + server + `}`, "{{collector}} {{instance}}"},
+			}},
+			{"Collector duration", "timeseries", 12, "s", []query{
+				{`tdarr_exporter_collector_duration_seconds{` + server + `}`, "{{collector}} {{instance}}"},
+			}},
+		},
+	},
+	{
+		// the counters are set from the libraries
+		title:      "Totals",
+		collectors: []string{"libraries"},
+		counters:   true,
+		panels: []panelSpec{
+			{"Transcodes per day", "timeseries", 12, "none", []query{
+				{`sum by (library_name) (increase(tdarr_library_transcodes_total{` + library + `}[1d]))`, "{{library_name}}"},
+			}},
+			{"Space saved per day", "timeseries", 12, "decgbytes", []query{
+				{`sum by (library_name) (increase(tdarr_library_size_diff_total{` + library + `}[1d]))`, "{{library_name}}"},
+			}},
+		},
+	},
+}
+
+var metricName = regexp.MustCompile(`tdarr_[a-z0-9_]+`)
+
+// enabled reports whether all the collectors of the row are enabled, and
+// the counters if it shows them.
+func enabled(opts Options, r row) bool {
+	if r.counters && !opts.Counters {
+		return false
+	}
+	for _, c := range r.collectors {
+		if !opts.Collectors[c] {
+			return false
+		}
+	}
+	return true
+}
+
+// check returns an error if a query of any row, enabled or not,
+// references a metric which isn't defined.
+func check() error {
+	for _, r := range rows {
+		for _, ps := range r.panels {
+			for _, q := range ps.queries {
+				for _, m := range metricName.FindAllString(q.expr, -1) {
+					if _, ok := prom.Lookup(m); !ok {
+						return fmt.Errorf("panel %q of row %q references undefined metric %s", ps.title, r.title, m)
+					}
+				}
+			}
+		}
+	}
+	return nil
+}
+
+var datasource = map[string]string{"type": "prometheus", "uid": "${datasource}"}
+
+// Generate builds the dashboard JSON. It fails if a query references a
+// metric which isn't defined in the prom package, so a renamed metric can't
+// silently break the dashboard.
+func Generate(opts Options) ([]byte, error) {
+	if err := check(); err != nil {
+		return nil, err
+	}
+	var panels []panel
+	id := 1
+	y := 0
+	for _, r := range rows {
+		if !enabled(opts, r) {
+			continue
+		}
+		panels = append(panels, panel{
+			ID:      id,
+			Type:    "row",
+			Title:   r.title,
+			GridPos: gridPos{H: 1, W: 24, X: 0, Y: y},
+			Panels:  []panel{},
+		})
+		id++
+		y++
+		x := 0
+		for _, ps := range r.panels {
+			var targets []target
+			for i, q := range ps.queries {
+				targets = append(targets, target{
+					Expr:         q.expr,
+					LegendFormat: q.legend,
+					RefID:        string(rune('A' + i)),
+					Datasource:   datasource,
+				})
+			}
+			if x+ps.width > 24 {
+				x = 0
+				y += 8
+			}
+			panels = append(panels, panel{
+				ID:         id,
+				Type:       ps.kind,
+				Title:      ps.title,
+				GridPos:    gridPos{H: 8, W: ps.width, X: x, Y: y},
+				Datasource: datasource,
+				Targets:    targets,
+				FieldConfig: map[string]any{
+					"defaults":  map[string]any{"unit": ps.unit},
+					"overrides": []any{},
+				},
+				Options: map[string]any{},
+			})
+			id++
+			x += ps.width
+		}
+		y += 8
+	}
+	d := map[string]any{
+		"uid":           opts.UID,
+		"title":         opts.Title,
+		"tags":          []string{"tdarr"},
+		"timezone":      "browser",
+		"schemaVersion": 38,
+		"editable":      true,
+		"refresh":       "1m",
+		"time":          map[string]string{"from": "now-24h", "to": "now"},
+		"templating": map[string]any{
+			"list": []map[string]any{
+				{
+					"name":  "datasource",
+					"label": "Data source",
+					"type":  "datasource",
+					"query": "prometheus",
+				},
+				{
+					"name":       "server",
+					"label":      "Server",
+					"type":       "query",
+					"datasource": datasource,
+					"query":      "label_values(tdarr_total_file_count, instance)",
+					"refresh":    2,
+					"multi":      true,
+					"includeAll": true,
+				},
+				{
+					"name":       "library",
+					"label":      "Library",
+					"type":       "query",
+					"datasource": datasource,
+					"query":      `label_values(tdarr_library_total_file_count{instance=~"$server"}, library_name)`,
+					"refresh":    2,
+					"multi":      true,
+					"includeAll": true,
+				},
+			},
+		},
+		"panels": panels,
+	}
+	return json.MarshalIndent(d, "", "  ")
+}
@@ -0,0 +1,123 @@
+package dashboard
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/robertlestak/tdarr_exporter/internal/collector"
+)
+
+// allCollectors enables every collector, and defines their metrics by
+// importing the collector package.
+func allCollectors() map[string]bool {
+	enabled := make(map[string]bool)
+	for _, name := range collector.Names() {
+		enabled[name] = true
+	}
+	return enabled
+}
+
+type dashboardJSON struct {
+	Panels []struct {
+		ID      int    `json:"id"`
+		Type    string `json:"type"`
+		Title   string `json:"title"`
+		Targets []struct {
+			Expr string `json:"expr"`
+		} `json:"targets"`
+	} `json:"panels"`
+}
+
+func generate(t *testing.T, opts Options) dashboardJSON {
+	t.Helper()
+	bd, err := Generate(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var d dashboardJSON
+	if err := json.Unmarshal(bd, &d); err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+func rowTitles(d dashboardJSON) []string {
+	var titles []string
+	for _, p := range d.Panels {
+		if p.Type == "row" {
+			titles = append(titles, p.Title)
+		}
+	}
+	return titles
+}
+
+func TestGenerate(t *testing.T) {
+	d := generate(t, Options{Title: "Tdarr", UID: "tdarr", Collectors: allCollectors(), Counters: true})
+	if got := len(rowTitles(d)); got != len(rows) {
+		t.Errorf("got %d rows, want %d", got, len(rows))
+	}
+	ids := make(map[int]bool)
+	for _, p := range d.Panels {
+		if ids[p.ID] {
+			t.Errorf("panel id %d is repeated", p.ID)
+		}
+		ids[p.ID] = true
+		if p.Type != "row" && len(p.Targets) == 0 {
+			t.Errorf("panel %q has no queries", p.Title)
+		}
+	}
+}
+
+func TestRowCollectorsExist(t *testing.T) {
+	names := allCollectors()
+	for _, r := range rows {
+		for _, c := range r.collectors {
+			if !names[c] {
+				t.Errorf("row %q requires unknown collector %q", r.title, c)
+			}
+		}
+	}
+}
+
+func TestGenerateDisabledCollector(t *testing.T) {
+	enabled := allCollectors()
+	enabled["nodes"] = false
+	titles := rowTitles(generate(t, Options{Collectors: enabled, Counters: true}))
+	for _, title := range titles {
+		if title == "Nodes" {
+			t.Errorf("got a Nodes row with the nodes collector disabled: %v", titles)
+		}
+	}
+	if len(titles) != len(rows)-1 {
+		t.Errorf("got rows %v, want all but Nodes", titles)
+	}
+}
+
+func TestGenerateWithoutCounters(t *testing.T) {
+	titles := rowTitles(generate(t, Options{Collectors: allCollectors()}))
+	for _, title := range titles {
+		if title == "Totals" {
+			t.Errorf("got a Totals row without the counters: %v", titles)
+		}
+	}
+	if len(titles) != len(rows)-1 {
+		t.Errorf("got rows %v, want all but Totals", titles)
+	}
+}
+
+func TestGenerateUndefinedMetric(t *testing.T) {
+	defer func(r []row) { rows = r }(rows)
+	rows = append(append([]row(nil), rows...), row{
+		title: "Renamed",
+		// a disabled row is checked too
+		collectors: []string{"disabled"},
+		panels: []panelSpec{
+			{"Renamed", "stat", 24, "none", []query{{`tdarr_no_such_metric`, ""}}},
+		},
+	})
+	_, err := Generate(Options{Collectors: allCollectors()})
+	if err == nil || !strings.Contains(err.Error(), "tdarr_no_such_metric") {
+		t.Errorf("got error %v, want one about tdarr_no_such_metric", err)
+	}
+}
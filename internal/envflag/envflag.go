@@ -0,0 +1,55 @@
+package envflag
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// The exporter is configured from the environment, and each package reads
+// its own variables. The flags defined here set an environment variable
+// when they're parsed, so that every option can also be passed as a flag
+// without threading flag values through the packages. Flags must be parsed
+// before the configuration is read.
+
+// Name returns the flag of an environment variable. Its first word is the
+// namespace of the flag and the rest its name, as in
+// TDARR_MAX_CONCURRENT_REQUESTS to tdarr.max-concurrent-requests.
+func Name(env string) string {
+	ns, rest, ok := strings.Cut(strings.ToLower(env), "_")
+	if !ok {
+		return ns
+	}
+	return ns + "." + strings.ReplaceAll(rest, "_", "-")
+}
+
+type value struct {
+	env  string
+	bool bool
+}
+
+// String returns no default for the usage, which would otherwise show the
+// value of the variable, such as a password or token. The defaults are
+// given in the usage text instead.
+func (v *value) String() string {
+	return ""
+}
+
+func (v *value) Set(s string) error {
+	return os.Setenv(v.env, s)
+}
+
+func (v *value) IsBoolFlag() bool {
+	return v.bool
+}
+
+// Var defines a flag which sets env.
+func Var(fs *flag.FlagSet, name, env, usage string) {
+	fs.Var(&value{env: env}, name, fmt.Sprintf("%s (env %s)", usage, env))
+}
+
+// BoolVar defines a flag which sets env to true, or to the value given.
+func BoolVar(fs *flag.FlagSet, name, env, usage string) {
+	fs.Var(&value{env: env, bool: true}, name, fmt.Sprintf("%s (env %s)", usage, env))
+}
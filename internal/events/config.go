@@ -0,0 +1,116 @@
+package events
+
+import (
+	"fmt"
+	"os"
+	"text/template"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	FormatGeneric = "generic"
+	FormatDiscord = "discord"
+	FormatNtfy    = "ntfy"
+)
+
+type Config struct {
+	// DedupWindow suppresses an identical event sent again within the window
+	DedupWindow time.Duration `yaml:"dedup_window"`
+	Receivers   []Receiver    `yaml:"receivers"`
+}
+
+type Receiver struct {
+	Name string `yaml:"name"`
+	URL  string `yaml:"url"`
+	// Format is one of generic, discord or ntfy. Ignored if Template is set.
+	Format string `yaml:"format"`
+	// Topic is the ntfy topic to publish to
+	Topic string `yaml:"topic"`
+	// Events limits the receiver to the given event types. All events are
+	// sent if empty.
+	Events []Type `yaml:"events"`
+	// Template is a go text/template rendered with the event to produce the
+	// request body
+	Template string            `yaml:"template"`
+	Headers  map[string]string `yaml:"headers"`
+	Timeout  time.Duration     `yaml:"timeout"`
+	// Retries is the number of retries of a failed delivery, defaulting to
+	// 3. Set to -1 to disable retries.
+	Retries int `yaml:"retries"`
+
+	tmpl *template.Template
+}
+
+// wants reports whether the receiver is subscribed to the event type.
+func (r *Receiver) wants(t Type) bool {
+	if len(r.Events) == 0 {
+		return true
+	}
+	for _, e := range r.Events {
+		if e == t {
+			return true
+		}
+	}
+	return false
+}
+
+func LoadConfig(path string) (*Config, error) {
+	bd, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	c := &Config{}
+	if err := yaml.Unmarshal(bd, c); err != nil {
+		return nil, err
+	}
+	if c.DedupWindow == 0 {
+		c.DedupWindow = time.Hour
+	}
+	known := make(map[Type]bool, len(Types))
+	for _, t := range Types {
+		known[t] = true
+	}
+	for i := range c.Receivers {
+		r := &c.Receivers[i]
+		if r.Name == "" {
+			r.Name = fmt.Sprintf("receiver-%d", i)
+		}
+		if r.URL == "" {
+			return nil, fmt.Errorf("receiver %s: url is required", r.Name)
+		}
+		switch r.Format {
+		case "":
+			r.Format = FormatGeneric
+		case FormatGeneric, FormatDiscord:
+		case FormatNtfy:
+			if r.Topic == "" && r.Template == "" {
+				return nil, fmt.Errorf("receiver %s: topic is required for ntfy", r.Name)
+			}
+		default:
+			return nil, fmt.Errorf("receiver %s: unknown format %q", r.Name, r.Format)
+		}
+		for _, t := range r.Events {
+			if !known[t] {
+				return nil, fmt.Errorf("receiver %s: unknown event %q", r.Name, t)
+			}
+		}
+		if r.Template != "" {
+			t, err := template.New(r.Name).Parse(r.Template)
+			if err != nil {
+				return nil, fmt.Errorf("receiver %s: %w", r.Name, err)
+			}
+			r.tmpl = t
+		}
+		if r.Timeout == 0 {
+			r.Timeout = time.Second * 10
+		}
+		if r.Retries == 0 {
+			r.Retries = 3
+		} else if r.Retries < 0 {
+			r.Retries = 0
+		}
+	}
+	return c, nil
+}
@@ -0,0 +1,257 @@
+package events
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/robertlestak/tdarr_exporter/internal/tdarr"
+	log "github.com/sirupsen/logrus"
+)
+
+// Engine diffs successive snapshots of a server and delivers the resulting
+// events to the configured webhook receivers.
+type Engine struct {
+	cfg    Config
+	server string
+	client *http.Client
+
+	mu   sync.Mutex
+	prev *tdarr.TdarrStatsResponse
+	// sent holds the last delivery time of each event key, per receiver
+	sent map[string]time.Time
+	// unreachable is set while tdarr is unreachable, so that the event is
+	// only sent once per outage
+	unreachable bool
+	wg          sync.WaitGroup
+}
+
+func NewEngine(cfg Config, s tdarr.Server) *Engine {
+	return &Engine{
+		cfg:    cfg,
+		server: s.Host,
+		client: &http.Client{},
+		sent:   make(map[string]time.Time),
+	}
+}
+
+// NewEngineFromEnv creates an event engine from the config file named by
+// EVENTS_CONFIG. It returns nil if no config file is set.
+func NewEngineFromEnv(s tdarr.Server) (*Engine, error) {
+	path := os.Getenv("EVENTS_CONFIG")
+	if path == "" {
+		return nil, nil
+	}
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		return nil, err
+	}
+	return NewEngine(*cfg, s), nil
+}
+
+func (e *Engine) Name() string {
+	return "events"
+}
+
+func (e *Engine) Publish(ctx context.Context, stats *tdarr.TdarrStatsResponse) error {
+	e.mu.Lock()
+	prev := e.prev
+	e.prev = stats
+	e.unreachable = false
+	e.mu.Unlock()
+	for _, ev := range Diff(e.server, prev, stats) {
+		e.Dispatch(ctx, ev)
+	}
+	return nil
+}
+
+func (e *Engine) PublishFailure(ctx context.Context, err error) error {
+	e.mu.Lock()
+	already := e.unreachable
+	e.unreachable = true
+	e.mu.Unlock()
+	if already {
+		return nil
+	}
+	e.Dispatch(ctx, Event{
+		Type:    TdarrUnreachable,
+		Time:    time.Now(),
+		Server:  e.server,
+		Message: fmt.Sprintf("Tdarr at %s is unreachable: %s", e.server, err),
+	})
+	return nil
+}
+
+// Dispatch delivers an event to every subscribed receiver in the
+// background, skipping receivers which were sent the same event within the
+// dedup window.
+func (e *Engine) Dispatch(ctx context.Context, ev Event) {
+	l := log.WithFields(log.Fields{
+		"app":   "tdarr_exporter",
+		"fn":    "Dispatch",
+		"event": ev.Type,
+	})
+	l.Info(ev.Message)
+	e.mu.Lock()
+	e.prune()
+	e.mu.Unlock()
+	for i := range e.cfg.Receivers {
+		r := &e.cfg.Receivers[i]
+		if !r.wants(ev.Type) {
+			continue
+		}
+		key := r.Name + "/" + ev.key()
+		e.mu.Lock()
+		last, ok := e.sent[key]
+		if ok && time.Since(last) < e.cfg.DedupWindow {
+			e.mu.Unlock()
+			l.WithField("receiver", r.Name).Debug("skipping duplicate event")
+			continue
+		}
+		e.sent[key] = time.Now()
+		e.mu.Unlock()
+		e.wg.Add(1)
+		// deliveries outlive the collection cycle that triggered them, so
+		// that they can still complete while Close waits for them
+		dctx := context.WithoutCancel(ctx)
+		go func() {
+			defer e.wg.Done()
+			if err := e.deliver(dctx, r, ev); err != nil {
+				l.WithField("receiver", r.Name).WithError(err).Error("error delivering event")
+			}
+		}()
+	}
+}
+
+// prune forgets the deliveries older than the dedup window, which no
+// longer suppress anything, so that sent doesn't grow with every event key
+// seen. e.mu must be held.
+func (e *Engine) prune() {
+	for key, last := range e.sent {
+		if time.Since(last) >= e.cfg.DedupWindow {
+			delete(e.sent, key)
+		}
+	}
+}
+
+// deliver sends an event to a receiver, retrying failed requests with
+// exponential backoff.
+func (e *Engine) deliver(ctx context.Context, r *Receiver, ev Event) error {
+	body, err := render(r, ev)
+	if err != nil {
+		return err
+	}
+	backoff := time.Second
+	for attempt := 0; ; attempt++ {
+		err = e.send(ctx, r, body)
+		if err == nil || attempt >= r.Retries {
+			return err
+		}
+		log.WithFields(log.Fields{
+			"app":      "tdarr_exporter",
+			"fn":       "deliver",
+			"receiver": r.Name,
+			"attempt":  attempt + 1,
+		}).WithError(err).Warn("retrying event delivery")
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+func (e *Engine) send(ctx context.Context, r *Receiver, body []byte) error {
+	ctx, cancel := context.WithTimeout(ctx, r.Timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, r.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("content-type", "application/json")
+	for k, v := range r.Headers {
+		req.Header.Set(k, v)
+	}
+	res, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+		return fmt.Errorf("receiver returned %s: %s", res.Status, bytes.TrimSpace(msg))
+	}
+	return nil
+}
+
+// render produces the request body of an event for a receiver.
+func render(r *Receiver, ev Event) ([]byte, error) {
+	if r.tmpl != nil {
+		var b bytes.Buffer
+		if err := r.tmpl.Execute(&b, ev); err != nil {
+			return nil, err
+		}
+		return b.Bytes(), nil
+	}
+	switch r.Format {
+	case FormatDiscord:
+		return json.Marshal(map[string]any{
+			"username": "Tdarr",
+			"content":  ev.Message,
+		})
+	case FormatNtfy:
+		return json.Marshal(map[string]any{
+			"topic":    r.Topic,
+			"title":    "Tdarr: " + string(ev.Type),
+			"message":  ev.Message,
+			"tags":     []string{ntfyTag(ev.Type)},
+			"priority": ntfyPriority(ev.Type),
+		})
+	default:
+		return json.Marshal(ev)
+	}
+}
+
+func ntfyTag(t Type) string {
+	switch t {
+	case QueueDrained:
+		return "white_check_mark"
+	case NodeOffline, TdarrUnreachable:
+		return "rotating_light"
+	default:
+		return "warning"
+	}
+}
+
+func ntfyPriority(t Type) int {
+	switch t {
+	case QueueDrained:
+		return 2
+	case NodeOffline, TdarrUnreachable:
+		return 4
+	default:
+		return 3
+	}
+}
+
+// Close waits for in-flight deliveries to finish.
+func (e *Engine) Close(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		e.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
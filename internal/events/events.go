@@ -0,0 +1,153 @@
+package events
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/robertlestak/tdarr_exporter/internal/tdarr"
+)
+
+type Type string
+
+const (
+	TranscodeErrorsIncreased   Type = "transcode_errors_increased"
+	HealthCheckErrorsIncreased Type = "health_check_errors_increased"
+	NodeOffline                Type = "node_offline"
+	QueueDrained               Type = "queue_drained"
+	TdarrUnreachable           Type = "tdarr_unreachable"
+)
+
+// Types lists every event type, in the order they are documented.
+var Types = []Type{
+	TranscodeErrorsIncreased,
+	HealthCheckErrorsIncreased,
+	NodeOffline,
+	QueueDrained,
+	TdarrUnreachable,
+}
+
+type Event struct {
+	Type      Type      `json:"type"`
+	Time      time.Time `json:"time"`
+	Server    string    `json:"server"`
+	Library   string    `json:"library,omitempty"`
+	LibraryID string    `json:"library_id,omitempty"`
+	Node      string    `json:"node,omitempty"`
+	NodeID    string    `json:"node_id,omitempty"`
+	Queue     string    `json:"queue,omitempty"`
+	Previous  int       `json:"previous"`
+	Current   int       `json:"current"`
+	Message   string    `json:"message"`
+}
+
+// key identifies an event for deduplication. Events with the same key are
+// the same occurrence reported again.
+func (e Event) key() string {
+	return fmt.Sprintf("%s/%s/%s/%s/%d", e.Type, e.LibraryID, e.NodeID, e.Queue, e.Current)
+}
+
+// errorCount sums the entries of a pie whose name mentions an error, eg
+// "Transcode error" or "Error".
+func errorCount(infos []tdarr.TranscodeInfo) int {
+	n := 0
+	for _, i := range infos {
+		if strings.Contains(strings.ToLower(i.Name), "error") {
+			n += i.Value
+		}
+	}
+	return n
+}
+
+// Diff compares two successive snapshots of the same server and returns the
+// events which happened in between.
+func Diff(server string, prev, cur *tdarr.TdarrStatsResponse) []Event {
+	if prev == nil || cur == nil {
+		return nil
+	}
+	now := cur.FetchedAt
+	if now.IsZero() {
+		now = time.Now()
+	}
+	var events []Event
+	prevLibs := make(map[string]tdarr.CategoryInfo, len(prev.ParsedPies))
+	for _, c := range prev.ParsedPies {
+		prevLibs[c.ID] = c
+	}
+	for _, c := range cur.ParsedPies {
+		p, ok := prevLibs[c.ID]
+		if !ok {
+			continue
+		}
+		if was, is := errorCount(p.TranscodeStatus), errorCount(c.TranscodeStatus); is > was {
+			events = append(events, Event{
+				Type:      TranscodeErrorsIncreased,
+				Time:      now,
+				Server:    server,
+				Library:   c.Library,
+				LibraryID: c.ID,
+				Previous:  was,
+				Current:   is,
+				Message:   fmt.Sprintf("Transcode errors in library %s increased from %d to %d", c.Library, was, is),
+			})
+		}
+		if was, is := errorCount(p.Health), errorCount(c.Health); is > was {
+			events = append(events, Event{
+				Type:      HealthCheckErrorsIncreased,
+				Time:      now,
+				Server:    server,
+				Library:   c.Library,
+				LibraryID: c.ID,
+				Previous:  was,
+				Current:   is,
+				Message:   fmt.Sprintf("Health check errors in library %s increased from %d to %d", c.Library, was, is),
+			})
+		}
+	}
+	// nodes are only compared when both snapshots know them
+	if prev.Nodes != nil && cur.Nodes != nil {
+		ids := make([]string, 0, len(prev.Nodes))
+		for id := range prev.Nodes {
+			ids = append(ids, id)
+		}
+		sort.Strings(ids)
+		for _, id := range ids {
+			if _, ok := cur.Nodes[id]; ok {
+				continue
+			}
+			n := prev.Nodes[id]
+			events = append(events, Event{
+				Type:     NodeOffline,
+				Time:     now,
+				Server:   server,
+				Node:     n.Name(),
+				NodeID:   id,
+				Previous: 1,
+				Current:  0,
+				Message:  fmt.Sprintf("Node %s went offline", n.Name()),
+			})
+		}
+	}
+	queues := []struct {
+		name      string
+		prev, cur int
+	}{
+		{"transcode", prev.Table0Count, cur.Table0Count},
+		{"health_check", prev.Table3Count, cur.Table3Count},
+	}
+	for _, q := range queues {
+		if q.prev > 0 && q.cur == 0 {
+			events = append(events, Event{
+				Type:     QueueDrained,
+				Time:     now,
+				Server:   server,
+				Queue:    q.name,
+				Previous: q.prev,
+				Current:  q.cur,
+				Message:  fmt.Sprintf("The %s queue has drained", strings.ReplaceAll(q.name, "_", " ")),
+			})
+		}
+	}
+	return events
+}
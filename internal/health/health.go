@@ -0,0 +1,181 @@
+package health
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// CollectorStatus is the outcome of the recent runs of a collector.
+type CollectorStatus struct {
+	// Required collectors must be succeeding for the exporter to be ready
+	Required            bool       `json:"required"`
+	LastSuccess         *time.Time `json:"last_success"`
+	LastError           string     `json:"last_error,omitempty"`
+	LastErrorTime       *time.Time `json:"last_error_time,omitempty"`
+	ConsecutiveFailures int        `json:"consecutive_failures"`
+
+	// maxAge is how old the last success of a required collector may be
+	maxAge time.Duration
+}
+
+// Report is the body of the /livez and /readyz responses.
+type Report struct {
+	Status     string                      `json:"status"`
+	Reason     string                      `json:"reason,omitempty"`
+	Collectors map[string]*CollectorStatus `json:"collectors"`
+}
+
+// Tracker records the success and failure of each collector. The exporter
+// is ready once every required collector has succeeded, for as long as
+// their last success is no older than Intervals times their interval.
+type Tracker struct {
+	Intervals int
+
+	mu         sync.Mutex
+	collectors map[string]*CollectorStatus
+}
+
+func NewTracker(intervals int) *Tracker {
+	return &Tracker{
+		Intervals:  intervals,
+		collectors: make(map[string]*CollectorStatus),
+	}
+}
+
+// NewTrackerFromEnv creates a tracker allowing READYZ_MAX_INTERVALS
+// (default 3) intervals since the last success.
+func NewTrackerFromEnv() (*Tracker, error) {
+	n := 3
+	if v := os.Getenv("READYZ_MAX_INTERVALS"); v != "" {
+		i, err := strconv.Atoi(v)
+		if err != nil || i < 1 {
+			return nil, fmt.Errorf("invalid READYZ_MAX_INTERVALS %q", v)
+		}
+		n = i
+	}
+	return NewTracker(n), nil
+}
+
+// Register adds a collector, so that it is reported before its first run.
+func (t *Tracker) Register(name string, required bool, interval time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.collectors[name] = &CollectorStatus{
+		Required: required,
+		maxAge:   time.Duration(t.Intervals) * interval,
+	}
+}
+
+func (t *Tracker) status(name string) *CollectorStatus {
+	c, ok := t.collectors[name]
+	if !ok {
+		c = &CollectorStatus{}
+		t.collectors[name] = c
+	}
+	return c
+}
+
+func (t *Tracker) Success(name string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	c := t.status(name)
+	now := time.Now()
+	c.LastSuccess = &now
+	c.ConsecutiveFailures = 0
+}
+
+func (t *Tracker) Failure(name string, err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	c := t.status(name)
+	now := time.Now()
+	c.LastError = err.Error()
+	c.LastErrorTime = &now
+	c.ConsecutiveFailures++
+}
+
+// Report returns a copy of the collector statuses, with the status set to
+// "ok" if the exporter is ready and "unavailable" with a reason otherwise.
+func (t *Tracker) Report() Report {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	r := Report{
+		Status:     "ok",
+		Collectors: make(map[string]*CollectorStatus, len(t.collectors)),
+	}
+	names := make([]string, 0, len(t.collectors))
+	for name, c := range t.collectors {
+		cp := *c
+		r.Collectors[name] = &cp
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	// the reason is that of the first failing required collector
+	for _, name := range names {
+		c := t.collectors[name]
+		if !c.Required {
+			continue
+		}
+		if reason := c.unready(name); reason != "" {
+			r.Status = "unavailable"
+			r.Reason = reason
+			return r
+		}
+	}
+	return r
+}
+
+// unready returns why a collector makes the exporter unready, or "" if it
+// doesn't.
+func (c *CollectorStatus) unready(name string) string {
+	switch {
+	case c.LastSuccess == nil:
+		return fmt.Sprintf("%s has not succeeded yet", name)
+	case c.maxAge > 0 && time.Since(*c.LastSuccess) > c.maxAge:
+		return fmt.Sprintf("%s last succeeded %s ago", name, time.Since(*c.LastSuccess).Round(time.Second))
+	}
+	return ""
+}
+
+// LivezHandler always responds 200 while the process is serving, with the
+// collector statuses as the body.
+func (t *Tracker) LivezHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rep := t.Report()
+		rep.Status = "ok"
+		rep.Reason = ""
+		write(w, http.StatusOK, rep)
+	})
+}
+
+// ReadyzHandler responds 503 until every required collector has succeeded,
+// and whenever one of them last succeeded too long ago.
+func (t *Tracker) ReadyzHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rep := t.Report()
+		code := http.StatusOK
+		if rep.Status != "ok" {
+			code = http.StatusServiceUnavailable
+		}
+		write(w, code, rep)
+	})
+}
+
+func write(w http.ResponseWriter, code int, rep Report) {
+	w.Header().Set("content-type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(rep); err != nil {
+		log.WithFields(log.Fields{
+			"app": "tdarr_exporter",
+			"fn":  "write",
+		}).WithError(err).Warn("error writing health report")
+	}
+}
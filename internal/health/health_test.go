@@ -0,0 +1,102 @@
+package health
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// get serves a request with h and returns the status code and report.
+func get(t *testing.T, h http.Handler) (int, Report) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	var rep Report
+	if err := json.NewDecoder(rec.Body).Decode(&rep); err != nil {
+		t.Fatal(err)
+	}
+	return rec.Code, rep
+}
+
+func TestReadyz(t *testing.T) {
+	tr := NewTracker(2)
+	tr.Register("statistics", true, 50*time.Millisecond)
+	tr.Register("nodes", false, time.Hour)
+	ready, live := tr.ReadyzHandler(), tr.LivezHandler()
+
+	check := func(step string, want int, reason string) {
+		t.Helper()
+		code, rep := get(t, ready)
+		if code != want || rep.Reason != reason {
+			t.Errorf("%s: got %d %q, want %d %q", step, code, rep.Reason, want, reason)
+		}
+		// the exporter is live whether or not it's ready
+		if code, rep := get(t, live); code != http.StatusOK || rep.Status != "ok" {
+			t.Errorf("%s: got livez %d %q, want 200 ok", step, code, rep.Status)
+		}
+	}
+	check("before the first run", http.StatusServiceUnavailable, "statistics has not succeeded yet")
+	tr.Failure("statistics", errors.New("connection refused"))
+	check("after a failure", http.StatusServiceUnavailable, "statistics has not succeeded yet")
+	tr.Success("statistics")
+	check("after a success", http.StatusOK, "")
+	// optional collectors don't affect readiness
+	tr.Failure("nodes", errors.New("connection refused"))
+	check("after an optional failure", http.StatusOK, "")
+	tr.Failure("statistics", errors.New("connection refused"))
+	check("after a failure within the max age", http.StatusOK, "")
+	time.Sleep(150 * time.Millisecond)
+	code, rep := get(t, ready)
+	if code != http.StatusServiceUnavailable || rep.Status != "unavailable" {
+		t.Errorf("after the max age: got %d %q, want 503 unavailable", code, rep.Status)
+	}
+	if got := rep.Collectors["statistics"].ConsecutiveFailures; got != 1 {
+		t.Errorf("got %d consecutive failures, want 1", got)
+	}
+	tr.Success("statistics")
+	check("after recovering", http.StatusOK, "")
+}
+
+func TestReportReason(t *testing.T) {
+	tr := NewTracker(3)
+	for _, name := range []string{"statistics", "libraries", "nodes", "cruddb"} {
+		tr.Register(name, name != "cruddb", time.Hour)
+	}
+	// the reason names the first failing required collector by name, not
+	// the first to fail
+	for _, step := range []struct {
+		success string
+		want    string
+	}{
+		{"", "libraries has not succeeded yet"},
+		{"libraries", "nodes has not succeeded yet"},
+		{"statistics", "nodes has not succeeded yet"},
+		{"nodes", ""},
+	} {
+		if step.success != "" {
+			tr.Success(step.success)
+		}
+		if got := tr.Report().Reason; got != step.want {
+			t.Errorf("after %q succeeded: got reason %q, want %q", step.success, got, step.want)
+		}
+	}
+}
+
+func TestNewTrackerFromEnv(t *testing.T) {
+	for v, want := range map[string]int{"": 3, "5": 5, "0": 0, "x": 0} {
+		t.Setenv("READYZ_MAX_INTERVALS", v)
+		tr, err := NewTrackerFromEnv()
+		if want == 0 {
+			if err == nil {
+				t.Errorf("%q: no error", v)
+			}
+			continue
+		}
+		if err != nil || tr.Intervals != want {
+			t.Errorf("%q: got %v, %v, want %d intervals", v, tr, err, want)
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package history
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/robertlestak/tdarr_exporter/internal/tdarr"
+	log "github.com/sirupsen/logrus"
+)
+
+type historyResponse struct {
+	From   time.Time `json:"from"`
+	To     time.Time `json:"to"`
+	Step   string    `json:"step,omitempty"`
+	Points []Record  `json:"points"`
+}
+
+// parseTime accepts RFC3339 or unix seconds.
+func parseTime(s string) (time.Time, error) {
+	if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Unix(n, 0), nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
+
+// bucket returns the step slot of t. The month step follows calendar
+// months rather than a fixed duration.
+func bucket(t time.Time, step string, d time.Duration) int64 {
+	if step == "month" {
+		t = t.UTC()
+		return int64(t.Year())*12 + int64(t.Month())
+	}
+	return t.UnixNano() / int64(d)
+}
+
+// resample keeps the last record of each step.
+func resample(records []Record, step string, d time.Duration) []Record {
+	var out []Record
+	for i, r := range records {
+		if i+1 < len(records) && bucket(records[i+1].Time, step, d) == bucket(r.Time, step, d) {
+			continue
+		}
+		out = append(out, r)
+	}
+	return out
+}
+
+// filterLibrary limits the library breakdown of each record to the library
+// with the given ID or name.
+func filterLibrary(records []Record, lib string) {
+	for i := range records {
+		var pies []tdarr.CategoryInfo
+		for _, c := range records[i].Stats.ParsedPies {
+			if c.ID == lib || c.Library == lib {
+				pies = append(pies, c)
+			}
+		}
+		records[i].Stats.ParsedPies = pies
+	}
+}
+
+// Handler serves /api/v1/history. The from and to parameters take RFC3339
+// times or unix seconds and default to the last day. step thins the result
+// to the last snapshot per step, and accepts durations such as 1h or 7d, or
+// month for calendar months. library limits the breakdown to one library.
+func (s *Store) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		l := log.WithFields(log.Fields{
+			"app": "tdarr_exporter",
+			"fn":  "Handler",
+		})
+		q := r.URL.Query()
+		res := historyResponse{
+			To:   time.Now(),
+			Step: q.Get("step"),
+		}
+		res.From = res.To.Add(-time.Hour * 24)
+		var err error
+		if v := q.Get("from"); v != "" {
+			if res.From, err = parseTime(v); err != nil {
+				http.Error(w, fmt.Sprintf("invalid from: %s", err), http.StatusBadRequest)
+				return
+			}
+		}
+		if v := q.Get("to"); v != "" {
+			if res.To, err = parseTime(v); err != nil {
+				http.Error(w, fmt.Sprintf("invalid to: %s", err), http.StatusBadRequest)
+				return
+			}
+		}
+		var step time.Duration
+		if res.Step != "" && res.Step != "month" {
+			if step, err = ParseDuration(res.Step); err != nil || step <= 0 {
+				http.Error(w, fmt.Sprintf("invalid step %q", res.Step), http.StatusBadRequest)
+				return
+			}
+		}
+		res.Points, err = s.Query(res.From, res.To)
+		if err != nil {
+			l.WithError(err).Error("error querying history")
+			http.Error(w, "error querying history", http.StatusInternalServerError)
+			return
+		}
+		if res.Step != "" {
+			res.Points = resample(res.Points, res.Step, step)
+		}
+		if lib := q.Get("library"); lib != "" {
+			filterLibrary(res.Points, lib)
+		}
+		if res.Points == nil {
+			res.Points = []Record{}
+		}
+		w.Header().Set("content-type", "application/json")
+		if err := json.NewEncoder(w).Encode(res); err != nil {
+			l.WithError(err).Error("error encoding response")
+		}
+	})
+}
@@ -0,0 +1,296 @@
+package history
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/robertlestak/tdarr_exporter/internal/tdarr"
+	log "github.com/sirupsen/logrus"
+	bolt "go.etcd.io/bbolt"
+)
+
+var snapshotsBucket = []byte("snapshots")
+
+// Tier thins out records older than Age to one per Step.
+type Tier struct {
+	Age  time.Duration
+	Step time.Duration
+}
+
+type Config struct {
+	Path string
+	// Resolution is the minimum time between two stored snapshots
+	Resolution time.Duration
+	// Retention deletes snapshots older than it. Zero keeps them forever.
+	Retention time.Duration
+	Tiers     []Tier
+}
+
+// ConfigFromEnv reads the history configuration. It returns nil if no
+// HISTORY_PATH is set, which disables the history store.
+func ConfigFromEnv() (*Config, error) {
+	c := &Config{
+		Path:       os.Getenv("HISTORY_PATH"),
+		Resolution: time.Minute * 5,
+		Tiers: []Tier{
+			{Age: time.Hour * 24 * 7, Step: time.Hour},
+			{Age: time.Hour * 24 * 90, Step: time.Hour * 24},
+		},
+	}
+	if c.Path == "" {
+		return nil, nil
+	}
+	if v := os.Getenv("HISTORY_RESOLUTION"); v != "" {
+		d, err := ParseDuration(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid HISTORY_RESOLUTION: %w", err)
+		}
+		c.Resolution = d
+	}
+	if v := os.Getenv("HISTORY_RETENTION"); v != "" {
+		d, err := ParseDuration(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid HISTORY_RETENTION: %w", err)
+		}
+		c.Retention = d
+	}
+	if v, ok := os.LookupEnv("HISTORY_DOWNSAMPLE"); ok {
+		tiers, err := parseTiers(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid HISTORY_DOWNSAMPLE: %w", err)
+		}
+		c.Tiers = tiers
+	}
+	return c, nil
+}
+
+// ParseDuration extends time.ParseDuration with d (day) and w (week) units.
+func ParseDuration(s string) (time.Duration, error) {
+	unit := time.Duration(0)
+	switch {
+	case strings.HasSuffix(s, "d"):
+		unit = time.Hour * 24
+	case strings.HasSuffix(s, "w"):
+		unit = time.Hour * 24 * 7
+	default:
+		return time.ParseDuration(s)
+	}
+	n, err := strconv.Atoi(strings.TrimSuffix(strings.TrimSuffix(s, "d"), "w"))
+	if err != nil {
+		return 0, fmt.Errorf("invalid duration %q", s)
+	}
+	return time.Duration(n) * unit, nil
+}
+
+// parseTiers parses a comma separated list of age:step pairs, eg
+// "7d:1h,90d:1d".
+func parseTiers(s string) ([]Tier, error) {
+	var tiers []Tier
+	for _, t := range strings.Split(s, ",") {
+		if strings.TrimSpace(t) == "" {
+			continue
+		}
+		a, st, ok := strings.Cut(strings.TrimSpace(t), ":")
+		if !ok {
+			return nil, fmt.Errorf("expected age:step, got %q", t)
+		}
+		age, err := ParseDuration(a)
+		if err != nil {
+			return nil, err
+		}
+		step, err := ParseDuration(st)
+		if err != nil {
+			return nil, err
+		}
+		tiers = append(tiers, Tier{Age: age, Step: step})
+	}
+	sort.Slice(tiers, func(i, j int) bool { return tiers[i].Age < tiers[j].Age })
+	return tiers, nil
+}
+
+// Record is a stored snapshot of the statistics document.
+type Record struct {
+	Time  time.Time                `json:"time"`
+	Stats tdarr.TdarrStatsResponse `json:"stats"`
+}
+
+// Store persists snapshots in a bolt database, thinning out old snapshots
+// according to the downsampling tiers.
+type Store struct {
+	cfg Config
+	db  *bolt.DB
+
+	mu             sync.Mutex
+	lastStored     time.Time
+	lastDownsample time.Time
+}
+
+func Open(cfg Config) (*Store, error) {
+	l := log.WithFields(log.Fields{
+		"app": "tdarr_exporter",
+		"fn":  "Open",
+	})
+	l.WithField("path", cfg.Path).Debug("opening history store")
+	db, err := bolt.Open(cfg.Path, 0600, &bolt.Options{Timeout: time.Second * 5})
+	if err != nil {
+		l.WithError(err).Error("error opening history store")
+		return nil, err
+	}
+	s := &Store{cfg: cfg, db: db}
+	err = db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(snapshotsBucket)
+		if err != nil {
+			return err
+		}
+		if k, _ := b.Cursor().Last(); k != nil {
+			s.lastStored = keyTime(k)
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// OpenFromEnv opens the history store configured in the environment. It
+// returns nil if the store is not configured.
+func OpenFromEnv() (*Store, error) {
+	cfg, err := ConfigFromEnv()
+	if err != nil || cfg == nil {
+		return nil, err
+	}
+	return Open(*cfg)
+}
+
+func timeKey(t time.Time) []byte {
+	k := make([]byte, 8)
+	binary.BigEndian.PutUint64(k, uint64(t.UnixNano()))
+	return k
+}
+
+func keyTime(k []byte) time.Time {
+	return time.Unix(0, int64(binary.BigEndian.Uint64(k)))
+}
+
+func (s *Store) Name() string {
+	return "history"
+}
+
+// Publish stores the snapshot, unless one was stored less than the
+// resolution ago.
+func (s *Store) Publish(ctx context.Context, stats *tdarr.TdarrStatsResponse) error {
+	l := log.WithFields(log.Fields{
+		"app": "tdarr_exporter",
+		"fn":  "Publish",
+	})
+	t := stats.FetchedAt
+	if t.IsZero() {
+		t = time.Now()
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if t.Sub(s.lastStored) < s.cfg.Resolution {
+		return nil
+	}
+	r := Record{Time: t, Stats: *stats}
+	// the raw pies duplicate ParsedPies
+	r.Stats.Pies = nil
+	bd, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(snapshotsBucket).Put(timeKey(t), bd)
+	})
+	if err != nil {
+		l.WithError(err).Error("error storing snapshot")
+		return err
+	}
+	s.lastStored = t
+	// downsampling walks the older records, once an hour is plenty
+	if time.Since(s.lastDownsample) > time.Hour {
+		if err := s.downsample(time.Now()); err != nil {
+			l.WithError(err).Error("error downsampling history")
+			return err
+		}
+		s.lastDownsample = time.Now()
+	}
+	return nil
+}
+
+// downsample deletes records past the retention, and keeps only the last
+// record of each step for records older than a tier's age.
+func (s *Store) downsample(now time.Time) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(snapshotsBucket)
+		var del [][]byte
+		var prevKey []byte
+		var prevStep time.Duration
+		var prevSlot int64
+		c := b.Cursor()
+		for k, _ := c.First(); k != nil; k, _ = c.Next() {
+			t := keyTime(k)
+			age := now.Sub(t)
+			if s.cfg.Retention > 0 && age > s.cfg.Retention {
+				del = append(del, append([]byte(nil), k...))
+				continue
+			}
+			var step time.Duration
+			for _, tier := range s.cfg.Tiers {
+				if age > tier.Age {
+					step = tier.Step
+				}
+			}
+			if step == 0 {
+				// records are ordered, the rest are too recent to thin out
+				break
+			}
+			slot := t.UnixNano() / int64(step)
+			if prevKey != nil && step == prevStep && slot == prevSlot {
+				// a later record in the same slot supersedes the previous one
+				del = append(del, prevKey)
+			}
+			prevKey = append([]byte(nil), k...)
+			prevStep = step
+			prevSlot = slot
+		}
+		for _, k := range del {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Query returns the records between from and to, inclusive, in time order.
+func (s *Store) Query(from, to time.Time) ([]Record, error) {
+	var records []Record
+	err := s.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(snapshotsBucket).Cursor()
+		max := timeKey(to)
+		for k, v := c.Seek(timeKey(from)); k != nil && string(k) <= string(max); k, v = c.Next() {
+			var r Record
+			if err := json.Unmarshal(v, &r); err != nil {
+				return err
+			}
+			records = append(records, r)
+		}
+		return nil
+	})
+	return records, err
+}
+
+func (s *Store) Close(ctx context.Context) error {
+	return s.db.Close()
+}
@@ -0,0 +1,151 @@
+package influx
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/robertlestak/tdarr_exporter/internal/tdarr"
+	log "github.com/sirupsen/logrus"
+)
+
+type Config struct {
+	// URL of an InfluxDB v2 server to write to. Writing is disabled if empty.
+	URL    string
+	Org    string
+	Bucket string
+	Token  string
+	// Serve enables the /metrics.influx endpoint for telegraf.
+	Serve   bool
+	Timeout time.Duration
+}
+
+// ConfigFromEnv reads the influx configuration. It returns nil if neither
+// writing nor serving line protocol is enabled.
+func ConfigFromEnv() (*Config, error) {
+	c := &Config{
+		URL:     os.Getenv("INFLUX_URL"),
+		Org:     os.Getenv("INFLUX_ORG"),
+		Bucket:  os.Getenv("INFLUX_BUCKET"),
+		Token:   os.Getenv("INFLUX_TOKEN"),
+		Serve:   os.Getenv("INFLUX_SERVE") == "true",
+		Timeout: time.Second * 10,
+	}
+	if c.URL == "" && !c.Serve {
+		return nil, nil
+	}
+	if c.URL != "" && c.Bucket == "" {
+		return nil, fmt.Errorf("INFLUX_BUCKET is required when INFLUX_URL is set")
+	}
+	return c, nil
+}
+
+// Sink writes stats as line protocol to InfluxDB and keeps the latest
+// payload for the /metrics.influx endpoint.
+type Sink struct {
+	cfg    Config
+	host   string
+	client *http.Client
+
+	mu     sync.RWMutex
+	latest []byte
+}
+
+func NewSink(cfg Config, s tdarr.Server) *Sink {
+	return &Sink{
+		cfg:    cfg,
+		host:   s.Host,
+		client: &http.Client{Timeout: cfg.Timeout},
+	}
+}
+
+// NewSinkFromEnv creates an influx sink from the environment. It returns nil
+// if the sink is not configured.
+func NewSinkFromEnv(s tdarr.Server) (*Sink, error) {
+	cfg, err := ConfigFromEnv()
+	if err != nil || cfg == nil {
+		return nil, err
+	}
+	return NewSink(*cfg, s), nil
+}
+
+func (s *Sink) Name() string {
+	return "influx"
+}
+
+func (s *Sink) Publish(ctx context.Context, stats *tdarr.TdarrStatsResponse) error {
+	body := Encode(s.host, stats)
+	s.mu.Lock()
+	s.latest = body
+	s.mu.Unlock()
+	if s.cfg.URL == "" {
+		return nil
+	}
+	return s.write(ctx, body)
+}
+
+func (s *Sink) write(ctx context.Context, body []byte) error {
+	l := log.WithFields(log.Fields{
+		"app": "tdarr_exporter",
+		"fn":  "write",
+	})
+	q := url.Values{}
+	q.Set("org", s.cfg.Org)
+	q.Set("bucket", s.cfg.Bucket)
+	q.Set("precision", "ns")
+	u := strings.TrimSuffix(s.cfg.URL, "/") + "/api/v2/write?" + q.Encode()
+	l.WithField("url", u).Debug("writing line protocol")
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u, bytes.NewReader(body))
+	if err != nil {
+		l.WithError(err).Error("error creating request")
+		return err
+	}
+	req.Header.Set("content-type", "text/plain; charset=utf-8")
+	if s.cfg.Token != "" {
+		req.Header.Set("authorization", "Token "+s.cfg.Token)
+	}
+	res, err := s.client.Do(req)
+	if err != nil {
+		l.WithError(err).Error("error making request")
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusNoContent && res.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+		return fmt.Errorf("influx write returned %s: %s", res.Status, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
+
+// Serve reports whether the /metrics.influx endpoint is enabled.
+func (s *Sink) Serve() bool {
+	return s.cfg.Serve
+}
+
+// Handler serves the latest stats as line protocol, for use with telegraf's
+// http input and data_format = "influx".
+func (s *Sink) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.RLock()
+		body := s.latest
+		s.mu.RUnlock()
+		if body == nil {
+			http.Error(w, "no stats collected yet", http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("content-type", "text/plain; charset=utf-8")
+		w.Write(body)
+	})
+}
+
+func (s *Sink) Close(ctx context.Context) error {
+	s.client.CloseIdleConnections()
+	return nil
+}
@@ -0,0 +1,172 @@
+package influx
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/robertlestak/tdarr_exporter/internal/tdarr"
+)
+
+var (
+	measurementEscaper = strings.NewReplacer(",", `\,`, " ", `\ `)
+	tagEscaper         = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `)
+)
+
+type field struct {
+	key   string
+	value string
+}
+
+func intField(k string, v int64) field {
+	return field{k, strconv.FormatInt(v, 10) + "i"}
+}
+
+var stringEscaper = strings.NewReplacer(`"`, `\"`, `\`, `\\`)
+
+func stringField(k, v string) field {
+	return field{k, `"` + stringEscaper.Replace(v) + `"`}
+}
+
+func floatField(k string, v float64) field {
+	return field{k, strconv.FormatFloat(v, 'f', -1, 64)}
+}
+
+// lineWriter builds a batch of line protocol points sharing a timestamp.
+type lineWriter struct {
+	sb   strings.Builder
+	tags map[string]string
+	ts   string
+}
+
+func (w *lineWriter) write(measurement string, tags map[string]string, fields ...field) {
+	if len(fields) == 0 {
+		return
+	}
+	w.sb.WriteString(measurementEscaper.Replace(measurement))
+	all := make(map[string]string, len(w.tags)+len(tags))
+	for k, v := range w.tags {
+		all[k] = v
+	}
+	for k, v := range tags {
+		all[k] = v
+	}
+	keys := make([]string, 0, len(all))
+	for k := range all {
+		keys = append(keys, k)
+	}
+	// tags are sorted as recommended for write performance
+	sort.Strings(keys)
+	for _, k := range keys {
+		// empty tag values are not valid line protocol
+		if all[k] == "" {
+			continue
+		}
+		w.sb.WriteByte(',')
+		w.sb.WriteString(tagEscaper.Replace(k))
+		w.sb.WriteByte('=')
+		w.sb.WriteString(tagEscaper.Replace(all[k]))
+	}
+	for i, f := range fields {
+		if i == 0 {
+			w.sb.WriteByte(' ')
+		} else {
+			w.sb.WriteByte(',')
+		}
+		w.sb.WriteString(tagEscaper.Replace(f.key))
+		w.sb.WriteByte('=')
+		w.sb.WriteString(f.value)
+	}
+	w.sb.WriteByte(' ')
+	w.sb.WriteString(w.ts)
+	w.sb.WriteByte('\n')
+}
+
+// Encode renders stats as InfluxDB line protocol. Every point carries a
+// host tag for the tdarr server and is timestamped with the fetch time, in
+// nanoseconds.
+func Encode(host string, stats *tdarr.TdarrStatsResponse) []byte {
+	ts := stats.FetchedAt
+	if ts.IsZero() {
+		ts = time.Now()
+	}
+	w := &lineWriter{
+		tags: map[string]string{"host": host},
+		ts:   strconv.FormatInt(ts.UnixNano(), 10),
+	}
+	fields := []field{
+		intField("total_file_count", int64(stats.TotalFileCount)),
+		intField("total_transcode_count", int64(stats.TotalTranscodeCount)),
+		intField("total_health_check_count", int64(stats.TotalHealthCheckCount)),
+		floatField("size_diff", stats.SizeDiff),
+		stringField("db_load_status", stats.LoadStatus()),
+		intField("db_queue", int64(stats.DBQueue)),
+		floatField("average_number_of_streams_in_video", stats.AvgNumberOfStreamsInVideo),
+		intField("stream_stats_duration_average", int64(stats.StreamStats.Duration.Average)),
+		intField("stream_stats_duration_highest", int64(stats.StreamStats.Duration.Highest)),
+		intField("stream_stats_duration_total", int64(stats.StreamStats.Duration.Total)),
+		intField("stream_stats_bitrate_average", int64(stats.StreamStats.BitRate.Average)),
+		intField("stream_stats_bitrate_highest", int64(stats.StreamStats.BitRate.Highest)),
+		intField("stream_stats_bitrate_total", stats.StreamStats.BitRate.Total),
+		intField("stream_stats_nb_frames_average", int64(stats.StreamStats.NbFrames.Average)),
+		intField("stream_stats_nb_frames_highest", int64(stats.StreamStats.NbFrames.Highest)),
+		intField("stream_stats_nb_frames_total", int64(stats.StreamStats.NbFrames.Total)),
+		intField("table_0_count", int64(stats.Table0Count)),
+		intField("table_1_count", int64(stats.Table1Count)),
+		intField("table_2_count", int64(stats.Table2Count)),
+		intField("table_3_count", int64(stats.Table3Count)),
+		intField("table_4_count", int64(stats.Table4Count)),
+		intField("table_5_count", int64(stats.Table5Count)),
+		intField("table_6_count", int64(stats.Table6Count)),
+		intField("table_0_viewable_count", int64(stats.Table0ViewableCount)),
+		intField("table_1_viewable_count", int64(stats.Table1ViewableCount)),
+		intField("table_2_viewable_count", int64(stats.Table2ViewableCount)),
+		intField("table_3_viewable_count", int64(stats.Table3ViewableCount)),
+		intField("table_4_viewable_count", int64(stats.Table4ViewableCount)),
+		intField("table_5_viewable_count", int64(stats.Table5ViewableCount)),
+		intField("table_6_viewable_count", int64(stats.Table6ViewableCount)),
+	}
+	// the remaining values are strings in the statistics document and are
+	// left out when they can't be parsed, matching the statistics collector
+	if d, err := time.ParseDuration(stats.DBFetchTime); err == nil {
+		fields = append(fields, floatField("db_fetch_time", d.Seconds()))
+	}
+	if f, err := strconv.ParseFloat(stats.TdarrScore, 64); err == nil {
+		fields = append(fields, floatField("tdarr_score", f))
+	}
+	if f, err := strconv.ParseFloat(stats.HealthCheckScore, 64); err == nil {
+		fields = append(fields, floatField("health_check_score", f))
+	}
+	w.write("tdarr", nil, fields...)
+	for k, n := range stats.NormalizedLanguages() {
+		w.write("tdarr_languages", map[string]string{"language": k}, intField("count", int64(n)))
+	}
+	for _, c := range stats.ParsedPies {
+		lib := map[string]string{"library": c.Library, "library_id": c.ID}
+		w.write("tdarr_library", lib,
+			intField("total_file_count", int64(c.TotalFileCount)),
+			intField("total_transcode_count", int64(c.TotalTranscodeCount)),
+			intField("total_health_check_count", int64(c.TotalHealthCheckCount)),
+			floatField("size_diff", c.SizeDiff),
+		)
+		writeInfos(w, "tdarr_library_transcode_status", lib, "status", c.TranscodeStatus)
+		writeInfos(w, "tdarr_library_health", lib, "health", c.Health)
+		writeInfos(w, "tdarr_library_video_codec", lib, "codec", c.VideoCodec)
+		writeInfos(w, "tdarr_library_video_container", lib, "container", c.Container)
+		writeInfos(w, "tdarr_library_video_resolution", lib, "resolution", c.Resolution)
+		writeInfos(w, "tdarr_library_audio_codec", lib, "codec", c.AudioCodec)
+		writeInfos(w, "tdarr_library_audio_container", lib, "container", c.AudioContainer)
+	}
+	return []byte(w.sb.String())
+}
+
+func writeInfos(w *lineWriter, measurement string, lib map[string]string, tag string, infos []tdarr.TranscodeInfo) {
+	for _, i := range infos {
+		tags := map[string]string{tag: i.Name}
+		for k, v := range lib {
+			tags[k] = v
+		}
+		w.write(measurement, tags, intField("count", int64(i.Value)))
+	}
+}
@@ -0,0 +1,105 @@
+package influx
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/robertlestak/tdarr_exporter/internal/tdarr"
+)
+
+func TestEncode(t *testing.T) {
+	stats := &tdarr.TdarrStatsResponse{
+		TotalFileCount:            10,
+		TotalTranscodeCount:       4,
+		TotalHealthCheckCount:     6,
+		SizeDiff:                  1.5,
+		DBFetchTime:               "0.5s",
+		DBLoadStatus:              "Stable",
+		DBQueue:                   2,
+		TdarrScore:                "97.50",
+		HealthCheckScore:          "n/a",
+		Table0Count:               3,
+		AvgNumberOfStreamsInVideo: 2,
+		Languages: map[string]tdarr.LanguageMetric{
+			"en":  {Count: 3},
+			"eng": {Count: 2},
+		},
+		ParsedPies: []tdarr.CategoryInfo{{
+			Library:               `Movies, 4K = "UHD"`,
+			ID:                    "lib 1",
+			TotalFileCount:        3,
+			TotalTranscodeCount:   1,
+			TotalHealthCheckCount: 2,
+			SizeDiff:              -0.25,
+			TranscodeStatus:       []tdarr.TranscodeInfo{{Name: "Transcode success", Value: 2}},
+		}, {
+			Library:        "TV",
+			AudioContainer: []tdarr.TranscodeInfo{{Name: "mkv", Value: 1}},
+		}},
+		FetchedAt: time.Unix(1700000000, 5),
+	}
+	stats.StreamStats.BitRate.Total = 5000000000
+	got := string(Encode("tdarr:8265", stats))
+
+	const ts = " 1700000000000000005\n"
+	want := strings.Join([]string{
+		// integers carry the i suffix, floats don't even when they're whole,
+		// and the scores which can't be parsed are left out
+		"tdarr,host=tdarr:8265 total_file_count=10i,total_transcode_count=4i,total_health_check_count=6i," +
+			`size_diff=1.5,db_load_status="Stable",db_queue=2i,average_number_of_streams_in_video=2,` +
+			"stream_stats_duration_average=0i,stream_stats_duration_highest=0i,stream_stats_duration_total=0i," +
+			"stream_stats_bitrate_average=0i,stream_stats_bitrate_highest=0i,stream_stats_bitrate_total=5000000000i," +
+			"stream_stats_nb_frames_average=0i,stream_stats_nb_frames_highest=0i,stream_stats_nb_frames_total=0i," +
+			"table_0_count=3i,table_1_count=0i,table_2_count=0i,table_3_count=0i,table_4_count=0i,table_5_count=0i,table_6_count=0i," +
+			"table_0_viewable_count=0i,table_1_viewable_count=0i,table_2_viewable_count=0i,table_3_viewable_count=0i," +
+			"table_4_viewable_count=0i,table_5_viewable_count=0i,table_6_viewable_count=0i," +
+			"db_fetch_time=0.5,tdarr_score=97.5" + ts,
+		// en and eng are the same language
+		"tdarr_languages,host=tdarr:8265,language=eng count=5i" + ts,
+		// spaces, commas and equals signs are escaped in tag values, quotes
+		// are not
+		`tdarr_library,host=tdarr:8265,library=Movies\,\ 4K\ \=\ "UHD",library_id=lib\ 1 ` +
+			"total_file_count=3i,total_transcode_count=1i,total_health_check_count=2i,size_diff=-0.25" + ts,
+		`tdarr_library_transcode_status,host=tdarr:8265,library=Movies\,\ 4K\ \=\ "UHD",library_id=lib\ 1,status=Transcode\ success count=2i` + ts,
+		// empty tag values are left out
+		"tdarr_library,host=tdarr:8265,library=TV total_file_count=0i,total_transcode_count=0i,total_health_check_count=0i,size_diff=0" + ts,
+		"tdarr_library_audio_container,container=mkv,host=tdarr:8265,library=TV count=1i" + ts,
+	}, "")
+	if got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestEncodeStringFields(t *testing.T) {
+	defer func(known []string) { tdarr.KnownLoadStatuses = known }(tdarr.KnownLoadStatuses)
+	tdarr.KnownLoadStatuses = []string{`Busy "rebuilding" C:\db`}
+	stats := &tdarr.TdarrStatsResponse{
+		DBLoadStatus: `Busy "rebuilding" C:\db`,
+		FetchedAt:    time.Unix(1, 0),
+	}
+	got := string(Encode("tdarr", stats))
+	// quotes and backslashes are escaped in string field values
+	if want := `db_load_status="Busy \"rebuilding\" C:\\db"`; !strings.Contains(got, want) {
+		t.Errorf("got %q, want it to contain %q", got, want)
+	}
+	if !strings.HasSuffix(got, " 1000000000\n") {
+		t.Errorf("got %q, want the fetch time as timestamp", got)
+	}
+}
+
+func TestEncodeWithoutFetchTime(t *testing.T) {
+	before := time.Now()
+	line := string(Encode("tdarr", &tdarr.TdarrStatsResponse{}))
+	after := time.Now()
+	// stats which weren't fetched by the client are timestamped now
+	fields := strings.Fields(line)
+	n, err := strconv.ParseInt(fields[len(fields)-1], 10, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := time.Unix(0, n); got.Before(before) || got.After(after) {
+		t.Errorf("got timestamp %v, want it between %v and %v", got, before, after)
+	}
+}
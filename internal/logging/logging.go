@@ -0,0 +1,117 @@
+package logging
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Log formats
+const (
+	FormatText   = "text"
+	FormatJSON   = "json"
+	FormatLogfmt = "logfmt"
+)
+
+var (
+	// bodyLimit is the number of bytes of a request or response body
+	// logged, 0 for no limit
+	bodyLimit = 4096
+	// bodyRedact replaces logged bodies with their length
+	bodyRedact bool
+
+	hook = &serverHook{}
+)
+
+// Init configures the standard logger from the environment:
+//
+//   - LOG_LEVEL, default info
+//   - LOG_FORMAT, one of text (default), json or logfmt
+//   - LOG_BODY_LIMIT, the bytes of request and response bodies logged at
+//     debug level, default 4096, 0 for no limit
+//   - LOG_BODY_REDACT, to log the length of bodies rather than their content
+//   - LOG_SAMPLE_INTERVAL, the interval at which repeated warnings are
+//     logged, default 1m, 0 to log every warning
+//
+// Every line is given a server field, set to TDARR_HOST until SetServer is
+// called.
+func Init() error {
+	ll, err := log.ParseLevel(os.Getenv("LOG_LEVEL"))
+	if err != nil {
+		ll = log.InfoLevel
+	}
+	log.SetLevel(ll)
+	switch f := os.Getenv("LOG_FORMAT"); f {
+	case "", FormatText:
+	case FormatJSON:
+		log.SetFormatter(&log.JSONFormatter{})
+	case FormatLogfmt:
+		// the text formatter without colors or padding is logfmt
+		log.SetFormatter(&log.TextFormatter{DisableColors: true, FullTimestamp: true})
+	default:
+		return fmt.Errorf("invalid LOG_FORMAT %q, must be text, json or logfmt", f)
+	}
+	if v := os.Getenv("LOG_BODY_LIMIT"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return fmt.Errorf("invalid LOG_BODY_LIMIT %q", v)
+		}
+		bodyLimit = n
+	}
+	bodyRedact = os.Getenv("LOG_BODY_REDACT") == "true"
+	if v := os.Getenv("LOG_SAMPLE_INTERVAL"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			return fmt.Errorf("invalid LOG_SAMPLE_INTERVAL %q", v)
+		}
+		Warnings.interval = d
+	}
+	SetServer(os.Getenv("TDARR_HOST"))
+	log.AddHook(hook)
+	return nil
+}
+
+// SetServer sets the server field added to every line.
+func SetServer(server string) {
+	hook.mu.Lock()
+	defer hook.mu.Unlock()
+	hook.server = server
+}
+
+// serverHook adds the tdarr server to every line, so that the logs of
+// exporters for several servers can be told apart once aggregated.
+type serverHook struct {
+	mu     sync.Mutex
+	server string
+}
+
+func (h *serverHook) Levels() []log.Level {
+	return log.AllLevels
+}
+
+func (h *serverHook) Fire(e *log.Entry) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := e.Data["server"]; !ok && h.server != "" {
+		e.Data["server"] = h.server
+	}
+	return nil
+}
+
+// Body returns a request or response body for logging, truncated to
+// LOG_BODY_LIMIT bytes or redacted with LOG_BODY_REDACT.
+func Body(b []byte) string {
+	if bodyRedact {
+		return fmt.Sprintf("<redacted %d bytes>", len(b))
+	}
+	if bodyLimit > 0 && len(b) > bodyLimit {
+		// without a rune cut in half
+		return fmt.Sprintf("%s... <truncated, %d bytes>", strings.ToValidUTF8(string(b[:bodyLimit]), ""), len(b))
+	}
+	return string(b)
+}
@@ -0,0 +1,75 @@
+package logging
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Warnings samples the warnings logged with Warn.
+var Warnings = NewSampler(time.Minute)
+
+// Sampler rate limits repeated log lines. The first line with a key is
+// logged, and further lines with the key are counted rather than logged
+// until the interval has passed.
+type Sampler struct {
+	interval time.Duration
+
+	mu   sync.Mutex
+	keys map[string]*sample
+}
+
+type sample struct {
+	last       time.Time
+	suppressed int
+}
+
+func NewSampler(interval time.Duration) *Sampler {
+	return &Sampler{interval: interval, keys: make(map[string]*sample)}
+}
+
+// Allow reports whether a line with key should be logged, and how many
+// were suppressed since the last one was.
+func (s *Sampler) Allow(key string) (bool, int) {
+	if s.interval == 0 {
+		return true, 0
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	sm, ok := s.keys[key]
+	if !ok {
+		s.keys[key] = &sample{last: now}
+		return true, 0
+	}
+	if now.Sub(sm.last) < s.interval {
+		sm.suppressed++
+		return false, 0
+	}
+	n := sm.suppressed
+	sm.last = now
+	sm.suppressed = 0
+	return true, n
+}
+
+// Warn logs msg at warning level, unless the same message was logged with
+// the same fields within the interval of Warnings. The number of lines
+// suppressed since is logged in the suppressed field.
+func Warn(l *log.Entry, msg string) {
+	ok, n := Warnings.Allow(key(l, msg))
+	if !ok {
+		return
+	}
+	if n > 0 {
+		l = l.WithField("suppressed", n)
+	}
+	l.Warn(msg)
+}
+
+// key identifies a line by its message and fields. fmt prints maps sorted
+// by key.
+func key(l *log.Entry, msg string) string {
+	return msg + fmt.Sprint(l.Data)
+}
@@ -0,0 +1,148 @@
+package mqtt
+
+import (
+	"github.com/robertlestak/tdarr_exporter/internal/tdarr"
+)
+
+// discoveryDevice groups all tdarr sensors under one home assistant device.
+type discoveryDevice struct {
+	Identifiers  []string `json:"identifiers"`
+	Name         string   `json:"name"`
+	Manufacturer string   `json:"manufacturer"`
+	Model        string   `json:"model"`
+	ConfigURL    string   `json:"configuration_url,omitempty"`
+}
+
+// discoveryConfig is a home assistant MQTT discovery payload.
+// See https://www.home-assistant.io/integrations/mqtt/#mqtt-discovery
+type discoveryConfig struct {
+	Name              string          `json:"name"`
+	UniqueID          string          `json:"unique_id"`
+	ObjectID          string          `json:"object_id"`
+	StateTopic        string          `json:"state_topic"`
+	ValueTemplate     string          `json:"value_template"`
+	AvailabilityTopic string          `json:"availability_topic"`
+	UnitOfMeasurement string          `json:"unit_of_measurement,omitempty"`
+	StateClass        string          `json:"state_class,omitempty"`
+	DeviceClass       string          `json:"device_class,omitempty"`
+	Icon              string          `json:"icon,omitempty"`
+	PayloadOn         string          `json:"payload_on,omitempty"`
+	PayloadOff        string          `json:"payload_off,omitempty"`
+	Device            discoveryDevice `json:"device"`
+}
+
+type sensor struct {
+	key        string
+	name       string
+	unit       string
+	stateClass string
+	icon       string
+}
+
+var statsSensors = []sensor{
+	{"total_file_count", "Files", "files", "measurement", "mdi:file-video"},
+	{"total_transcode_count", "Transcodes", "transcodes", "total_increasing", "mdi:swap-horizontal"},
+	{"total_health_check_count", "Health checks", "checks", "total_increasing", "mdi:heart-pulse"},
+	{"size_diff", "Space saved", "GB", "measurement", "mdi:harddisk"},
+	{"transcode_queue", "Transcode queue", "files", "measurement", "mdi:tray-full"},
+	{"transcode_errors", "Transcode errors", "files", "measurement", "mdi:alert-circle"},
+	{"health_check_queue", "Health check queue", "files", "measurement", "mdi:tray-full"},
+	{"health_check_errors", "Health check errors", "files", "measurement", "mdi:alert-circle"},
+	{"db_queue", "DB queue", "", "measurement", "mdi:database"},
+	{"db_load_status", "DB load status", "", "", "mdi:database"},
+	{"tdarr_score", "Tdarr score", "%", "measurement", "mdi:percent"},
+	{"health_check_score", "Health check score", "%", "measurement", "mdi:percent"},
+}
+
+var librarySensors = []sensor{
+	{"total_file_count", "files", "files", "measurement", "mdi:file-video"},
+	{"total_transcode_count", "transcodes", "transcodes", "total_increasing", "mdi:swap-horizontal"},
+	{"total_health_check_count", "health checks", "checks", "total_increasing", "mdi:heart-pulse"},
+	{"size_diff", "space saved", "GB", "measurement", "mdi:harddisk"},
+}
+
+func (s *Sink) device() discoveryDevice {
+	return discoveryDevice{
+		Identifiers:  []string{"tdarr_exporter_" + objectID(s.cfg.ClientID)},
+		Name:         "Tdarr",
+		Manufacturer: "Tdarr",
+		Model:        "tdarr_exporter",
+		ConfigURL:    s.host,
+	}
+}
+
+func (s *Sink) sensorConfig(id, name, topic string, sn sensor) discoveryConfig {
+	return discoveryConfig{
+		Name:              name,
+		UniqueID:          id,
+		ObjectID:          id,
+		StateTopic:        topic,
+		ValueTemplate:     "{{ value_json." + sn.key + " }}",
+		AvailabilityTopic: s.availabilityTopic(),
+		UnitOfMeasurement: sn.unit,
+		StateClass:        sn.stateClass,
+		Icon:              sn.icon,
+		Device:            s.device(),
+	}
+}
+
+// announce publishes the discovery configs for any entity which hasn't been
+// announced yet. Configs are retained, so they only need sending once per
+// entity.
+func (s *Sink) announce(stats *tdarr.TdarrStatsResponse) error {
+	if s.cfg.DiscoveryPrefix == "" {
+		return nil
+	}
+	prefix := "tdarr_" + objectID(s.cfg.ClientID)
+	for _, sn := range statsSensors {
+		id := prefix + "_" + sn.key
+		if err := s.announceOnce("sensor", id, s.sensorConfig(id, sn.name, s.statsTopic(), sn)); err != nil {
+			return err
+		}
+	}
+	for _, c := range stats.ParsedPies {
+		for _, sn := range librarySensors {
+			id := prefix + "_library_" + objectID(c.ID) + "_" + sn.key
+			name := c.Library + " " + sn.name
+			if err := s.announceOnce("sensor", id, s.sensorConfig(id, name, s.libraryTopic(c.ID), sn)); err != nil {
+				return err
+			}
+		}
+	}
+	for id, n := range stats.Nodes {
+		oid := prefix + "_node_" + objectID(id)
+		cfg := discoveryConfig{
+			Name:              n.Name(),
+			UniqueID:          oid,
+			ObjectID:          oid,
+			StateTopic:        s.nodeTopic(id),
+			ValueTemplate:     "{{ value_json.status }}",
+			AvailabilityTopic: s.availabilityTopic(),
+			DeviceClass:       "connectivity",
+			PayloadOn:         nodeOn,
+			PayloadOff:        nodeOff,
+			Device:            s.device(),
+		}
+		if err := s.announceOnce("binary_sensor", oid, cfg); err != nil {
+			return err
+		}
+		sn := sensor{"active_workers", "", "workers", "measurement", "mdi:cog"}
+		wid := oid + "_active_workers"
+		if err := s.announceOnce("sensor", wid, s.sensorConfig(wid, n.Name()+" active workers", s.nodeTopic(id), sn)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Sink) announceOnce(component, id string, cfg discoveryConfig) error {
+	topic := s.cfg.DiscoveryPrefix + "/" + component + "/" + id + "/config"
+	if s.announced[topic] {
+		return nil
+	}
+	if err := s.publishJSON(topic, cfg); err != nil {
+		return err
+	}
+	s.announced[topic] = true
+	return nil
+}
@@ -0,0 +1,331 @@
+package mqtt
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	paho "github.com/eclipse/paho.mqtt.golang"
+	"github.com/robertlestak/tdarr_exporter/internal/tdarr"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	payloadOnline  = "online"
+	payloadOffline = "offline"
+)
+
+type Config struct {
+	Broker   string
+	ClientID string
+	Username string
+	Password string
+	// TopicPrefix is the root of all state topics
+	TopicPrefix string
+	// DiscoveryPrefix is the home assistant discovery prefix. Discovery is
+	// disabled if empty.
+	DiscoveryPrefix    string
+	CAFile             string
+	CertFile           string
+	KeyFile            string
+	InsecureSkipVerify bool
+	Timeout            time.Duration
+}
+
+// ConfigFromEnv reads the MQTT configuration. It returns nil if no broker
+// is set, which disables the MQTT sink.
+func ConfigFromEnv() (*Config, error) {
+	c := &Config{
+		Broker:             os.Getenv("MQTT_BROKER"),
+		ClientID:           os.Getenv("MQTT_CLIENT_ID"),
+		Username:           os.Getenv("MQTT_USERNAME"),
+		Password:           os.Getenv("MQTT_PASSWORD"),
+		TopicPrefix:        os.Getenv("MQTT_TOPIC_PREFIX"),
+		DiscoveryPrefix:    os.Getenv("MQTT_DISCOVERY_PREFIX"),
+		CAFile:             os.Getenv("MQTT_CA_FILE"),
+		CertFile:           os.Getenv("MQTT_CERT_FILE"),
+		KeyFile:            os.Getenv("MQTT_KEY_FILE"),
+		InsecureSkipVerify: os.Getenv("MQTT_INSECURE_SKIP_VERIFY") == "true",
+		Timeout:            time.Second * 10,
+	}
+	if c.Broker == "" {
+		return nil, nil
+	}
+	if c.ClientID == "" {
+		c.ClientID = "tdarr_exporter"
+	}
+	if c.TopicPrefix == "" {
+		c.TopicPrefix = "tdarr"
+	}
+	if os.Getenv("MQTT_DISCOVERY") == "false" {
+		c.DiscoveryPrefix = ""
+	} else if c.DiscoveryPrefix == "" {
+		c.DiscoveryPrefix = "homeassistant"
+	}
+	if (c.CertFile == "") != (c.KeyFile == "") {
+		return nil, errors.New("MQTT_CERT_FILE and MQTT_KEY_FILE must be set together")
+	}
+	return c, nil
+}
+
+func (c Config) tlsConfig() (*tls.Config, error) {
+	tc := &tls.Config{
+		InsecureSkipVerify: c.InsecureSkipVerify,
+	}
+	if c.CAFile != "" {
+		pem, err := os.ReadFile(c.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", c.CAFile)
+		}
+		tc.RootCAs = pool
+	}
+	if c.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		tc.Certificates = []tls.Certificate{cert}
+	}
+	return tc, nil
+}
+
+// Sink publishes stats to MQTT after every collection cycle, along with home
+// assistant discovery configs for each sensor. The availability topic is
+// online while tdarr is reachable, and is set offline by the broker if the
+// exporter goes away.
+type Sink struct {
+	cfg    Config
+	host   string
+	client paho.Client
+
+	// mu serializes publishing, as stats can be published by several
+	// collector runs at once, and guards announced and nodes
+	mu sync.Mutex
+	// announced tracks the discovery configs already published
+	announced map[string]bool
+	// nodes tracks every node seen so that nodes which disappear from
+	// tdarr can be reported offline
+	nodes map[string]tdarr.Node
+}
+
+func NewSink(cfg Config, s tdarr.Server) (*Sink, error) {
+	l := log.WithFields(log.Fields{
+		"app": "tdarr_exporter",
+		"fn":  "NewSink",
+	})
+	l.WithField("broker", cfg.Broker).Debug("creating mqtt sink")
+	sk := &Sink{
+		cfg:       cfg,
+		host:      s.Host,
+		announced: make(map[string]bool),
+		nodes:     make(map[string]tdarr.Node),
+	}
+	opts := paho.NewClientOptions().
+		AddBroker(cfg.Broker).
+		SetClientID(cfg.ClientID).
+		SetUsername(cfg.Username).
+		SetPassword(cfg.Password).
+		SetAutoReconnect(true).
+		SetConnectRetry(true).
+		SetWill(sk.availabilityTopic(), payloadOffline, 1, true)
+	tc, err := cfg.tlsConfig()
+	if err != nil {
+		l.WithError(err).Error("error loading tls config")
+		return nil, err
+	}
+	opts.SetTLSConfig(tc)
+	opts.SetOnConnectHandler(func(paho.Client) {
+		l.Info("connected to mqtt broker")
+	})
+	opts.SetConnectionLostHandler(func(_ paho.Client, err error) {
+		l.WithError(err).Warn("lost connection to mqtt broker")
+	})
+	sk.client = paho.NewClient(opts)
+	// with connect retry enabled the token completes once the first
+	// attempt was made, later attempts happen in the background
+	t := sk.client.Connect()
+	if t.WaitTimeout(cfg.Timeout) && t.Error() != nil {
+		l.WithError(t.Error()).Error("error connecting to mqtt broker")
+		return nil, t.Error()
+	}
+	return sk, nil
+}
+
+// NewSinkFromEnv creates an MQTT sink from the environment. It returns nil if
+// the sink is not configured.
+func NewSinkFromEnv(s tdarr.Server) (*Sink, error) {
+	cfg, err := ConfigFromEnv()
+	if err != nil || cfg == nil {
+		return nil, err
+	}
+	return NewSink(*cfg, s)
+}
+
+func (s *Sink) Name() string {
+	return "mqtt"
+}
+
+func (s *Sink) availabilityTopic() string {
+	return s.cfg.TopicPrefix + "/availability"
+}
+
+func (s *Sink) statsTopic() string {
+	return s.cfg.TopicPrefix + "/stats"
+}
+
+func (s *Sink) libraryTopic(id string) string {
+	return s.cfg.TopicPrefix + "/library/" + objectID(id)
+}
+
+func (s *Sink) nodeTopic(id string) string {
+	return s.cfg.TopicPrefix + "/node/" + objectID(id)
+}
+
+type statsState struct {
+	TotalFileCount        int     `json:"total_file_count"`
+	TotalTranscodeCount   int     `json:"total_transcode_count"`
+	TotalHealthCheckCount int     `json:"total_health_check_count"`
+	SizeDiff              float64 `json:"size_diff"`
+	TranscodeQueue        int     `json:"transcode_queue"`
+	TranscodeErrors       int     `json:"transcode_errors"`
+	HealthCheckQueue      int     `json:"health_check_queue"`
+	HealthCheckErrors     int     `json:"health_check_errors"`
+	DBQueue               int     `json:"db_queue"`
+	DBLoadStatus          string  `json:"db_load_status"`
+	TdarrScore            string  `json:"tdarr_score"`
+	HealthCheckScore      string  `json:"health_check_score"`
+}
+
+type libraryState struct {
+	Name                  string  `json:"name"`
+	TotalFileCount        int     `json:"total_file_count"`
+	TotalTranscodeCount   int     `json:"total_transcode_count"`
+	TotalHealthCheckCount int     `json:"total_health_check_count"`
+	SizeDiff              float64 `json:"size_diff"`
+}
+
+type nodeState struct {
+	Name          string `json:"name"`
+	Status        string `json:"status"`
+	Paused        bool   `json:"paused"`
+	ActiveWorkers int    `json:"active_workers"`
+}
+
+const (
+	nodeOn  = "ON"
+	nodeOff = "OFF"
+)
+
+func (s *Sink) Publish(ctx context.Context, stats *tdarr.TdarrStatsResponse) error {
+	l := log.WithFields(log.Fields{
+		"app": "tdarr_exporter",
+		"fn":  "Publish",
+	})
+	l.Debug("publishing stats to mqtt")
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.announce(stats); err != nil {
+		return err
+	}
+	if err := s.publishJSON(s.statsTopic(), statsState{
+		TotalFileCount:        stats.TotalFileCount,
+		TotalTranscodeCount:   stats.TotalTranscodeCount,
+		TotalHealthCheckCount: stats.TotalHealthCheckCount,
+		SizeDiff:              stats.SizeDiff,
+		TranscodeQueue:        stats.Table0Count,
+		TranscodeErrors:       stats.Table2Count,
+		HealthCheckQueue:      stats.Table3Count,
+		HealthCheckErrors:     stats.Table5Count,
+		DBQueue:               stats.DBQueue,
+		DBLoadStatus:          stats.DBLoadStatus,
+		TdarrScore:            stats.TdarrScore,
+		HealthCheckScore:      stats.HealthCheckScore,
+	}); err != nil {
+		return err
+	}
+	for _, c := range stats.ParsedPies {
+		if err := s.publishJSON(s.libraryTopic(c.ID), libraryState{
+			Name:                  c.Library,
+			TotalFileCount:        c.TotalFileCount,
+			TotalTranscodeCount:   c.TotalTranscodeCount,
+			TotalHealthCheckCount: c.TotalHealthCheckCount,
+			SizeDiff:              c.SizeDiff,
+		}); err != nil {
+			return err
+		}
+	}
+	if stats.Nodes != nil {
+		for id, n := range stats.Nodes {
+			s.nodes[id] = n
+		}
+		for id, n := range s.nodes {
+			st := nodeState{
+				Name:   n.Name(),
+				Status: nodeOff,
+			}
+			if cur, ok := stats.Nodes[id]; ok {
+				st.Status = nodeOn
+				st.Paused = cur.NodePaused
+				for _, w := range cur.Workers {
+					if !w.Idle {
+						st.ActiveWorkers++
+					}
+				}
+			}
+			if err := s.publishJSON(s.nodeTopic(id), st); err != nil {
+				return err
+			}
+		}
+	}
+	return s.publish(s.availabilityTopic(), payloadOnline)
+}
+
+// PublishFailure marks tdarr unavailable.
+func (s *Sink) PublishFailure(ctx context.Context, err error) error {
+	return s.publish(s.availabilityTopic(), payloadOffline)
+}
+
+func (s *Sink) publishJSON(topic string, v any) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return s.publish(topic, string(b))
+}
+
+// publish sends a retained message, so that subscribers see the last state
+// as soon as they connect.
+func (s *Sink) publish(topic, payload string) error {
+	t := s.client.Publish(topic, 1, true, payload)
+	if !t.WaitTimeout(s.cfg.Timeout) {
+		return fmt.Errorf("timed out publishing to %s", topic)
+	}
+	return t.Error()
+}
+
+func (s *Sink) Close(ctx context.Context) error {
+	// the will is not sent on a clean disconnect, so mark tdarr
+	// unavailable ourselves
+	err := s.publish(s.availabilityTopic(), payloadOffline)
+	s.client.Disconnect(uint(s.cfg.Timeout.Milliseconds()))
+	return err
+}
+
+var invalidObjectIDChars = regexp.MustCompile(`[^a-zA-Z0-9_-]+`)
+
+// objectID sanitizes an ID for use in topics and home assistant object IDs.
+func objectID(id string) string {
+	return strings.Trim(invalidObjectIDChars.ReplaceAllString(strings.ToLower(id), "_"), "_")
+}
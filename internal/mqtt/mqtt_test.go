@@ -0,0 +1,233 @@
+package mqtt
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"sync"
+	"testing"
+	"time"
+
+	paho "github.com/eclipse/paho.mqtt.golang"
+	mochi "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/hooks/auth"
+	"github.com/mochi-mqtt/server/v2/listeners"
+	"github.com/robertlestak/tdarr_exporter/internal/tdarr"
+)
+
+// startBroker runs an in-process broker and returns its address.
+func startBroker(t *testing.T) string {
+	t.Helper()
+	srv := mochi.New(&mochi.Options{
+		Logger: slog.New(slog.NewTextHandler(io.Discard, nil)),
+	})
+	if err := srv.AddHook(new(auth.AllowHook), nil); err != nil {
+		t.Fatal(err)
+	}
+	tcp := listeners.NewTCP("tcp", "127.0.0.1:0", nil)
+	if err := srv.AddListener(tcp); err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.Serve(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { srv.Close() })
+	return "tcp://" + tcp.Address()
+}
+
+// subscriber records the messages of every topic, and the availability
+// payloads in the order they arrive.
+type subscriber struct {
+	mu           sync.Mutex
+	messages     map[string]paho.Message
+	availability []string
+}
+
+func subscribe(t *testing.T, broker, id string) *subscriber {
+	t.Helper()
+	sub := &subscriber{messages: make(map[string]paho.Message)}
+	c := paho.NewClient(paho.NewClientOptions().AddBroker(broker).SetClientID(id))
+	if tk := c.Connect(); !tk.WaitTimeout(5*time.Second) || tk.Error() != nil {
+		t.Fatalf("error connecting subscriber: %v", tk.Error())
+	}
+	t.Cleanup(func() { c.Disconnect(0) })
+	tk := c.Subscribe("#", 1, func(_ paho.Client, m paho.Message) {
+		sub.mu.Lock()
+		defer sub.mu.Unlock()
+		sub.messages[m.Topic()] = m
+		if m.Topic() == "tdarr/availability" {
+			sub.availability = append(sub.availability, string(m.Payload()))
+		}
+	})
+	if !tk.WaitTimeout(5*time.Second) || tk.Error() != nil {
+		t.Fatalf("error subscribing: %v", tk.Error())
+	}
+	return sub
+}
+
+// wait waits for a message on topic and returns it.
+func (sub *subscriber) wait(t *testing.T, topic string) paho.Message {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		sub.mu.Lock()
+		m, ok := sub.messages[topic]
+		sub.mu.Unlock()
+		if ok {
+			return m
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("timed out waiting for a message on %s", topic)
+	return nil
+}
+
+// waitAvailability waits for the availability payloads to be want.
+func (sub *subscriber) waitAvailability(t *testing.T, want ...string) {
+	t.Helper()
+	var got []string
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		sub.mu.Lock()
+		got = append([]string(nil), sub.availability...)
+		sub.mu.Unlock()
+		if len(got) >= len(want) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got availability %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("got availability %v, want %v", got, want)
+		}
+	}
+}
+
+var testStats = &tdarr.TdarrStatsResponse{
+	TotalFileCount: 120,
+	Table0Count:    4,
+	DBLoadStatus:   "Stable",
+	ParsedPies: []tdarr.CategoryInfo{
+		{ID: "lib1", Library: "Movies", TotalFileCount: 100},
+	},
+	Nodes: map[string]tdarr.Node{
+		"node1": {ID: "node1", NodeName: "gpu", Workers: map[string]tdarr.Worker{
+			"w1": {ID: "w1"},
+			"w2": {ID: "w2", Idle: true},
+		}},
+	},
+}
+
+func TestSink(t *testing.T) {
+	broker := startBroker(t)
+	s, err := NewSink(Config{
+		Broker:          broker,
+		ClientID:        "tdarr_exporter",
+		TopicPrefix:     "tdarr",
+		DiscoveryPrefix: "homeassistant",
+		Timeout:         5 * time.Second,
+	}, tdarr.Server{Host: "http://tdarr:8265"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Publish(context.Background(), testStats); err != nil {
+		t.Fatal(err)
+	}
+
+	// subscribing afterwards only sees the retained messages
+	sub := subscribe(t, broker, "retained")
+	var stats statsState
+	unmarshal(t, sub.wait(t, "tdarr/stats"), &stats)
+	if stats.TotalFileCount != 120 || stats.TranscodeQueue != 4 || stats.DBLoadStatus != "Stable" {
+		t.Errorf("got stats state %+v", stats)
+	}
+	var lib libraryState
+	unmarshal(t, sub.wait(t, "tdarr/library/lib1"), &lib)
+	if lib.Name != "Movies" || lib.TotalFileCount != 100 {
+		t.Errorf("got library state %+v", lib)
+	}
+	var node nodeState
+	unmarshal(t, sub.wait(t, "tdarr/node/node1"), &node)
+	if node.Name != "gpu" || node.Status != nodeOn || node.ActiveWorkers != 1 {
+		t.Errorf("got node state %+v", node)
+	}
+
+	for topic, want := range map[string]string{
+		"homeassistant/sensor/tdarr_tdarr_exporter_total_file_count/config":              "tdarr/stats",
+		"homeassistant/sensor/tdarr_tdarr_exporter_library_lib1_total_file_count/config": "tdarr/library/lib1",
+		"homeassistant/binary_sensor/tdarr_tdarr_exporter_node_node1/config":             "tdarr/node/node1",
+		"homeassistant/sensor/tdarr_tdarr_exporter_node_node1_active_workers/config":     "tdarr/node/node1",
+	} {
+		var cfg discoveryConfig
+		unmarshal(t, sub.wait(t, topic), &cfg)
+		if cfg.StateTopic != want {
+			t.Errorf("%s: got state topic %q, want %q", topic, cfg.StateTopic, want)
+		}
+		if cfg.AvailabilityTopic != "tdarr/availability" {
+			t.Errorf("%s: got availability topic %q", topic, cfg.AvailabilityTopic)
+		}
+		if cfg.Device.ConfigURL != "http://tdarr:8265" {
+			t.Errorf("%s: got device %+v", topic, cfg.Device)
+		}
+	}
+
+	sub.waitAvailability(t, payloadOnline)
+	if err := s.PublishFailure(context.Background(), nil); err != nil {
+		t.Fatal(err)
+	}
+	sub.waitAvailability(t, payloadOnline, payloadOffline)
+	if err := s.Publish(context.Background(), testStats); err != nil {
+		t.Fatal(err)
+	}
+	sub.waitAvailability(t, payloadOnline, payloadOffline, payloadOnline)
+	if err := s.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	sub.waitAvailability(t, payloadOnline, payloadOffline, payloadOnline, payloadOffline)
+
+	// the offline state is retained for clients connecting later
+	late := subscribe(t, broker, "late")
+	late.waitAvailability(t, payloadOffline)
+}
+
+// unmarshal decodes a retained JSON message.
+func unmarshal(t *testing.T, m paho.Message, v any) {
+	t.Helper()
+	if !m.Retained() {
+		t.Errorf("message on %s is not retained", m.Topic())
+	}
+	if err := json.Unmarshal(m.Payload(), v); err != nil {
+		t.Fatalf("error decoding message on %s: %v", m.Topic(), err)
+	}
+}
+
+func TestConcurrentPublish(t *testing.T) {
+	broker := startBroker(t)
+	s, err := NewSink(Config{
+		Broker:          broker,
+		ClientID:        "tdarr_exporter",
+		TopicPrefix:     "tdarr",
+		DiscoveryPrefix: "homeassistant",
+		Timeout:         5 * time.Second,
+	}, tdarr.Server{Host: "http://tdarr:8265"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close(context.Background())
+	// as the outputs are given the stats of scrapes arriving together
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := s.Publish(context.Background(), testStats); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+}
@@ -0,0 +1,153 @@
+package otlp
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	colmetricspb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+// client is the transport used to deliver a batch to the receiver.
+type client interface {
+	export(ctx context.Context, req *colmetricspb.ExportMetricsServiceRequest) error
+	close() error
+}
+
+// permanentError is returned by a client when the receiver rejected a batch
+// in a way that retrying it will not fix.
+type permanentError struct {
+	err error
+}
+
+func (e permanentError) Error() string {
+	return e.err.Error()
+}
+
+func (e permanentError) Unwrap() error {
+	return e.err
+}
+
+type grpcClient struct {
+	conn    *grpc.ClientConn
+	svc     colmetricspb.MetricsServiceClient
+	headers metadata.MD
+}
+
+func newGRPCClient(cfg Config) (*grpcClient, error) {
+	target := cfg.Endpoint
+	insec := cfg.Insecure
+	// the endpoint may be given as a URL, in which case the scheme decides
+	// whether to use TLS
+	if u, err := url.Parse(cfg.Endpoint); err == nil && u.Host != "" {
+		target = u.Host
+		if u.Scheme == "http" {
+			insec = true
+		}
+	}
+	creds := credentials.NewTLS(&tls.Config{})
+	if insec {
+		creds = insecure.NewCredentials()
+	}
+	conn, err := grpc.Dial(target, grpc.WithTransportCredentials(creds))
+	if err != nil {
+		return nil, err
+	}
+	return &grpcClient{
+		conn:    conn,
+		svc:     colmetricspb.NewMetricsServiceClient(conn),
+		headers: metadata.New(cfg.Headers),
+	}, nil
+}
+
+func (c *grpcClient) export(ctx context.Context, req *colmetricspb.ExportMetricsServiceRequest) error {
+	ctx = metadata.NewOutgoingContext(ctx, c.headers)
+	_, err := c.svc.Export(ctx, req)
+	if err == nil {
+		return nil
+	}
+	switch status.Code(err) {
+	case codes.Canceled, codes.DeadlineExceeded, codes.ResourceExhausted,
+		codes.Aborted, codes.OutOfRange, codes.Unavailable, codes.DataLoss:
+		return err
+	default:
+		return permanentError{err}
+	}
+}
+
+func (c *grpcClient) close() error {
+	return c.conn.Close()
+}
+
+type httpClient struct {
+	url     string
+	headers map[string]string
+	client  *http.Client
+}
+
+func newHTTPClient(cfg Config) (*httpClient, error) {
+	u, err := url.Parse(cfg.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme == "" {
+		u.Scheme = "https"
+		if cfg.Insecure {
+			u.Scheme = "http"
+		}
+	}
+	return &httpClient{
+		url:     u.String(),
+		headers: cfg.Headers,
+		client:  &http.Client{},
+	}, nil
+}
+
+func (c *httpClient) export(ctx context.Context, req *colmetricspb.ExportMetricsServiceRequest) error {
+	body, err := proto.Marshal(req)
+	if err != nil {
+		return permanentError{err}
+	}
+	r, err := http.NewRequestWithContext(ctx, http.MethodPost, c.url, bytes.NewReader(body))
+	if err != nil {
+		return permanentError{err}
+	}
+	r.Header.Set("content-type", "application/x-protobuf")
+	for k, v := range c.headers {
+		r.Header.Set(k, v)
+	}
+	res, err := c.client.Do(r)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode >= 200 && res.StatusCode < 300 {
+		return nil
+	}
+	msg, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+	err = fmt.Errorf("otlp receiver returned %s: %s", res.Status, strings.TrimSpace(string(msg)))
+	switch res.StatusCode {
+	case http.StatusTooManyRequests, http.StatusBadGateway,
+		http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return err
+	default:
+		return permanentError{err}
+	}
+}
+
+func (c *httpClient) close() error {
+	c.client.CloseIdleConnections()
+	return nil
+}
@@ -0,0 +1,74 @@
+package otlp
+
+import (
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	metricspb "go.opentelemetry.io/proto/otlp/metrics/v1"
+	resourcepb "go.opentelemetry.io/proto/otlp/resource/v1"
+)
+
+// convert translates gathered prometheus metric families into OTLP resource
+// metrics. Gauges map to OTLP gauges and counters to cumulative monotonic
+// sums starting at start.
+func convert(mfs []*dto.MetricFamily, res *resourcepb.Resource, start, now time.Time) []*metricspb.ResourceMetrics {
+	sm := &metricspb.ScopeMetrics{
+		Scope: &commonpb.InstrumentationScope{
+			Name: "github.com/robertlestak/tdarr_exporter",
+		},
+	}
+	for _, mf := range mfs {
+		var points []*metricspb.NumberDataPoint
+		for _, m := range mf.GetMetric() {
+			var v float64
+			switch mf.GetType() {
+			case dto.MetricType_GAUGE:
+				v = m.GetGauge().GetValue()
+			case dto.MetricType_COUNTER:
+				v = m.GetCounter().GetValue()
+			case dto.MetricType_UNTYPED:
+				v = m.GetUntyped().GetValue()
+			default:
+				continue
+			}
+			points = append(points, &metricspb.NumberDataPoint{
+				Attributes:        labelAttributes(m.GetLabel()),
+				StartTimeUnixNano: uint64(start.UnixNano()),
+				TimeUnixNano:      uint64(now.UnixNano()),
+				Value:             &metricspb.NumberDataPoint_AsDouble{AsDouble: v},
+			})
+		}
+		if len(points) == 0 {
+			continue
+		}
+		m := &metricspb.Metric{
+			Name:        mf.GetName(),
+			Description: mf.GetHelp(),
+		}
+		if mf.GetType() == dto.MetricType_COUNTER {
+			m.Data = &metricspb.Metric_Sum{Sum: &metricspb.Sum{
+				DataPoints:             points,
+				AggregationTemporality: metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_CUMULATIVE,
+				IsMonotonic:            true,
+			}}
+		} else {
+			m.Data = &metricspb.Metric_Gauge{Gauge: &metricspb.Gauge{
+				DataPoints: points,
+			}}
+		}
+		sm.Metrics = append(sm.Metrics, m)
+	}
+	return []*metricspb.ResourceMetrics{{
+		Resource:     res,
+		ScopeMetrics: []*metricspb.ScopeMetrics{sm},
+	}}
+}
+
+func labelAttributes(labels []*dto.LabelPair) []*commonpb.KeyValue {
+	attrs := make([]*commonpb.KeyValue, 0, len(labels))
+	for _, lp := range labels {
+		attrs = append(attrs, stringAttribute(lp.GetName(), lp.GetValue()))
+	}
+	return attrs
+}
@@ -0,0 +1,346 @@
+package otlp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/robertlestak/tdarr_exporter/internal/prom"
+	"github.com/robertlestak/tdarr_exporter/internal/tdarr"
+	log "github.com/sirupsen/logrus"
+	colmetricspb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	resourcepb "go.opentelemetry.io/proto/otlp/resource/v1"
+)
+
+const (
+	ProtocolGRPC = "grpc"
+	ProtocolHTTP = "http/protobuf"
+)
+
+type Config struct {
+	// Endpoint is the address of the receiver for grpc, and the URL
+	// metrics are posted to for http/protobuf
+	Endpoint   string
+	Protocol   string
+	Insecure   bool
+	Headers    map[string]string
+	Timeout    time.Duration
+	BufferSize int
+	Retries    int
+	// ResourceAttributes are added to the resource of every export, on top
+	// of the attributes describing the tdarr server.
+	ResourceAttributes map[string]string
+}
+
+// ConfigFromEnv reads the OTLP configuration using the standard
+// OTEL_EXPORTER_OTLP_* variables. It returns nil if no endpoint is set,
+// which disables the OTLP sink.
+func ConfigFromEnv() (*Config, error) {
+	c := &Config{
+		Endpoint:           os.Getenv("OTEL_EXPORTER_OTLP_METRICS_ENDPOINT"),
+		Protocol:           os.Getenv("OTEL_EXPORTER_OTLP_PROTOCOL"),
+		Insecure:           os.Getenv("OTEL_EXPORTER_OTLP_INSECURE") == "true",
+		Headers:            parseKeyValues(os.Getenv("OTEL_EXPORTER_OTLP_HEADERS")),
+		Timeout:            time.Second * 10,
+		BufferSize:         10,
+		Retries:            3,
+		ResourceAttributes: parseKeyValues(os.Getenv("OTEL_RESOURCE_ATTRIBUTES")),
+	}
+	if c.Protocol == "" {
+		c.Protocol = ProtocolGRPC
+	}
+	if c.Endpoint == "" {
+		c.Endpoint = os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT")
+		// the spec has the signal path appended to the base endpoint over
+		// http, while the metrics endpoint is used as it is
+		if c.Endpoint != "" && c.Protocol == ProtocolHTTP {
+			c.Endpoint = strings.TrimSuffix(c.Endpoint, "/") + "/v1/metrics"
+		}
+	}
+	if c.Endpoint == "" {
+		return nil, nil
+	}
+	if c.Protocol != ProtocolGRPC && c.Protocol != ProtocolHTTP {
+		return nil, fmt.Errorf("unsupported OTEL_EXPORTER_OTLP_PROTOCOL %q", c.Protocol)
+	}
+	if v := os.Getenv("OTEL_EXPORTER_OTLP_TIMEOUT"); v != "" {
+		// the spec defines the timeout in milliseconds
+		ms, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid OTEL_EXPORTER_OTLP_TIMEOUT: %w", err)
+		}
+		c.Timeout = time.Duration(ms) * time.Millisecond
+	}
+	if v := os.Getenv("OTLP_BUFFER_SIZE"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("invalid OTLP_BUFFER_SIZE %q", v)
+		}
+		c.BufferSize = n
+	}
+	if v := os.Getenv("OTLP_RETRIES"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid OTLP_RETRIES %q", v)
+		}
+		c.Retries = n
+	}
+	return c, nil
+}
+
+// parseKeyValues parses the comma separated key=value lists used by the
+// OTEL_* environment variables.
+func parseKeyValues(s string) map[string]string {
+	m := make(map[string]string)
+	for _, kv := range strings.Split(s, ",") {
+		k, v, ok := strings.Cut(kv, "=")
+		if !ok {
+			continue
+		}
+		m[strings.TrimSpace(k)] = strings.TrimSpace(v)
+	}
+	return m
+}
+
+// Sink pushes the tdarr metrics registered with prometheus to an OTLP
+// receiver. Publish only buffers a batch, which is exported in the
+// background so that a slow receiver doesn't hold up the collectors.
+// Batches which fail to export are kept in a bounded buffer and retried on
+// the next cycle, oldest first.
+type Sink struct {
+	cfg      Config
+	client   client
+	gatherer prometheus.Gatherer
+	resource *resourcepb.Resource
+	start    time.Time
+	// backoff is the delay before the first retry of a batch
+	backoff time.Duration
+
+	mu     sync.Mutex
+	buffer []*colmetricspb.ExportMetricsServiceRequest
+
+	// wake signals the flush loop that a batch was buffered
+	wake chan struct{}
+	stop context.CancelFunc
+	done chan struct{}
+}
+
+func NewSink(cfg Config, s tdarr.Server) (*Sink, error) {
+	l := log.WithFields(log.Fields{
+		"app": "tdarr_exporter",
+		"fn":  "NewSink",
+	})
+	l.WithFields(log.Fields{
+		"endpoint": cfg.Endpoint,
+		"protocol": cfg.Protocol,
+	}).Debug("creating otlp sink")
+	var c client
+	var err error
+	switch cfg.Protocol {
+	case ProtocolHTTP:
+		c, err = newHTTPClient(cfg)
+	default:
+		c, err = newGRPCClient(cfg)
+	}
+	if err != nil {
+		return nil, err
+	}
+	ctx, stop := context.WithCancel(context.Background())
+	sk := &Sink{
+		cfg:      cfg,
+		client:   c,
+		gatherer: prom.Gatherer,
+		resource: newResource(cfg, s),
+		start:    time.Now(),
+		backoff:  time.Second,
+		wake:     make(chan struct{}, 1),
+		stop:     stop,
+		done:     make(chan struct{}),
+	}
+	go sk.run(ctx)
+	return sk, nil
+}
+
+// NewSinkFromEnv creates an OTLP sink from the environment. It returns nil
+// if OTLP export is not configured.
+func NewSinkFromEnv(s tdarr.Server) (*Sink, error) {
+	cfg, err := ConfigFromEnv()
+	if err != nil || cfg == nil {
+		return nil, err
+	}
+	return NewSink(*cfg, s)
+}
+
+func newResource(cfg Config, s tdarr.Server) *resourcepb.Resource {
+	attrs := map[string]string{
+		"service.name": "tdarr_exporter",
+		"tdarr.host":   s.Host,
+	}
+	for k, v := range cfg.ResourceAttributes {
+		attrs[k] = v
+	}
+	r := &resourcepb.Resource{}
+	for k, v := range attrs {
+		r.Attributes = append(r.Attributes, stringAttribute(k, v))
+	}
+	return r
+}
+
+func stringAttribute(k, v string) *commonpb.KeyValue {
+	return &commonpb.KeyValue{
+		Key: k,
+		Value: &commonpb.AnyValue{
+			Value: &commonpb.AnyValue_StringValue{StringValue: v},
+		},
+	}
+}
+
+func (s *Sink) Name() string {
+	return "otlp"
+}
+
+// Publish snapshots the current tdarr metrics and buffers them for the
+// flush loop, which exports them along with any previously failed batches.
+func (s *Sink) Publish(ctx context.Context, stats *tdarr.TdarrStatsResponse) error {
+	l := log.WithFields(log.Fields{
+		"app": "tdarr_exporter",
+		"fn":  "Publish",
+	})
+	mfs, err := s.gatherer.Gather()
+	if err != nil {
+		l.WithError(err).Error("error gathering metrics")
+		return err
+	}
+	req := &colmetricspb.ExportMetricsServiceRequest{
+		ResourceMetrics: convert(mfs, s.resource, s.start, time.Now()),
+	}
+	s.enqueue(req)
+	select {
+	case s.wake <- struct{}{}:
+	default:
+		// a flush is already pending, and will pick up the batch
+	}
+	return nil
+}
+
+// run flushes the buffer every time a batch is published, until ctx is
+// cancelled by Close.
+func (s *Sink) run(ctx context.Context) {
+	defer close(s.done)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-s.wake:
+			s.flush(ctx)
+		}
+	}
+}
+
+func (s *Sink) enqueue(req *colmetricspb.ExportMetricsServiceRequest) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.buffer) >= s.cfg.BufferSize {
+		log.WithFields(log.Fields{
+			"app": "tdarr_exporter",
+			"fn":  "enqueue",
+		}).Warn("otlp buffer full, dropping oldest batch")
+		s.buffer = s.buffer[1:]
+	}
+	s.buffer = append(s.buffer, req)
+}
+
+// flush exports the buffered batches in order. It stops at the first batch
+// that cannot be exported so that ordering is preserved. Only one flush
+// runs at a time: the flush loop's, or Close's once the loop has stopped.
+func (s *Sink) flush(ctx context.Context) error {
+	l := log.WithFields(log.Fields{
+		"app": "tdarr_exporter",
+		"fn":  "flush",
+	})
+	for {
+		// the lock isn't held while exporting, so that Publish doesn't
+		// wait on the receiver
+		s.mu.Lock()
+		if len(s.buffer) == 0 {
+			s.mu.Unlock()
+			return nil
+		}
+		req := s.buffer[0]
+		s.mu.Unlock()
+		err := s.export(ctx, req)
+		var perr permanentError
+		if errors.As(err, &perr) {
+			l.WithError(err).Error("otlp receiver rejected batch, dropping it")
+		} else if err != nil {
+			if ctx.Err() != nil {
+				// stopped by Close, which flushes again
+				return err
+			}
+			l.WithField("buffered", s.buffered()).WithError(err).Error("error exporting metrics")
+			return err
+		}
+		s.mu.Lock()
+		// the batch may have been evicted by enqueue while it was exported
+		if len(s.buffer) > 0 && s.buffer[0] == req {
+			s.buffer = s.buffer[1:]
+		}
+		s.mu.Unlock()
+	}
+}
+
+func (s *Sink) buffered() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.buffer)
+}
+
+// export sends a single batch, retrying retryable errors with exponential
+// backoff.
+func (s *Sink) export(ctx context.Context, req *colmetricspb.ExportMetricsServiceRequest) error {
+	l := log.WithFields(log.Fields{
+		"app": "tdarr_exporter",
+		"fn":  "export",
+	})
+	backoff := s.backoff
+	var err error
+	for attempt := 0; attempt <= s.cfg.Retries; attempt++ {
+		if attempt > 0 {
+			l.WithField("attempt", attempt).WithError(err).Warn("retrying otlp export")
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(backoff):
+			}
+			backoff *= 2
+		}
+		ectx, cancel := context.WithTimeout(ctx, s.cfg.Timeout)
+		err = s.client.export(ectx, req)
+		cancel()
+		var perr permanentError
+		if err == nil || errors.As(err, &perr) {
+			return err
+		}
+	}
+	return err
+}
+
+// Close stops the flush loop, abandoning an export in progress, attempts a
+// final flush of the buffer within ctx and closes the connection to the
+// receiver.
+func (s *Sink) Close(ctx context.Context) error {
+	s.stop()
+	<-s.done
+	ferr := s.flush(ctx)
+	if err := s.client.close(); err != nil {
+		return err
+	}
+	return ferr
+}
@@ -0,0 +1,273 @@
+package otlp
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/robertlestak/tdarr_exporter/internal/tdarr"
+	colmetricspb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	metricspb "go.opentelemetry.io/proto/otlp/metrics/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+// receiver is an OTLP receiver stub which fails the first failures
+// exports, and all of them while down is set.
+type receiver struct {
+	colmetricspb.UnimplementedMetricsServiceServer
+	failures atomic.Int32
+	down     atomic.Bool
+	calls    atomic.Int32
+	reqs     chan *colmetricspb.ExportMetricsServiceRequest
+}
+
+func newReceiver(failures int32) *receiver {
+	r := &receiver{reqs: make(chan *colmetricspb.ExportMetricsServiceRequest, 16)}
+	r.failures.Store(failures)
+	return r
+}
+
+// accept reports whether an export should succeed, and records it if so.
+func (r *receiver) accept(req *colmetricspb.ExportMetricsServiceRequest) bool {
+	r.calls.Add(1)
+	if r.down.Load() || r.failures.Add(-1) >= 0 {
+		return false
+	}
+	r.reqs <- req
+	return true
+}
+
+func (r *receiver) Export(_ context.Context, req *colmetricspb.ExportMetricsServiceRequest) (*colmetricspb.ExportMetricsServiceResponse, error) {
+	if !r.accept(req) {
+		return nil, status.Error(codes.Unavailable, "unavailable")
+	}
+	return &colmetricspb.ExportMetricsServiceResponse{}, nil
+}
+
+func (r *receiver) ServeHTTP(w http.ResponseWriter, hr *http.Request) {
+	if hr.URL.Path != "/base/v1/metrics" {
+		http.NotFound(w, hr)
+		return
+	}
+	body, _ := io.ReadAll(hr.Body)
+	req := &colmetricspb.ExportMetricsServiceRequest{}
+	if err := proto.Unmarshal(body, req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !r.accept(req) {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("content-type", "application/x-protobuf")
+}
+
+// next returns the next batch the receiver accepted.
+func (r *receiver) next(t *testing.T) *colmetricspb.ExportMetricsServiceRequest {
+	t.Helper()
+	select {
+	case req := <-r.reqs:
+		return req
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for an export")
+		return nil
+	}
+}
+
+func startGRPC(t *testing.T, r *receiver) string {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := grpc.NewServer()
+	colmetricspb.RegisterMetricsServiceServer(srv, r)
+	go srv.Serve(lis)
+	t.Cleanup(srv.Stop)
+	return lis.Addr().String()
+}
+
+// newTestSink returns a sink gathering the gauge it returns, rather than
+// the exporter's metrics.
+func newTestSink(t *testing.T, cfg Config) (*Sink, *prometheus.GaugeVec) {
+	t.Helper()
+	if cfg.Timeout == 0 {
+		cfg.Timeout = 5 * time.Second
+	}
+	files := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "tdarr_files",
+		Help: "Number of files in tdarr library",
+	}, []string{"library_name"})
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(files)
+	s, err := NewSink(cfg, tdarr.Server{Host: "http://tdarr:8265"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.gatherer = reg
+	s.backoff = time.Millisecond
+	t.Cleanup(func() { s.Close(context.Background()) })
+	return s, files
+}
+
+// gauge returns the value of a gauge in a batch, and whether it's there.
+func gauge(req *colmetricspb.ExportMetricsServiceRequest, name string) (float64, bool) {
+	for _, rm := range req.GetResourceMetrics() {
+		for _, sm := range rm.GetScopeMetrics() {
+			for _, m := range sm.GetMetrics() {
+				if m.GetName() == name && len(m.GetGauge().GetDataPoints()) > 0 {
+					return m.GetGauge().GetDataPoints()[0].GetAsDouble(), true
+				}
+			}
+		}
+	}
+	return 0, false
+}
+
+func checkBatch(t *testing.T, req *colmetricspb.ExportMetricsServiceRequest, want float64) {
+	t.Helper()
+	if len(req.GetResourceMetrics()) != 1 {
+		t.Fatalf("got %d resource metrics, want 1", len(req.GetResourceMetrics()))
+	}
+	attrs := make(map[string]string)
+	for _, kv := range req.GetResourceMetrics()[0].GetResource().GetAttributes() {
+		attrs[kv.GetKey()] = kv.GetValue().GetStringValue()
+	}
+	for k, v := range map[string]string{
+		"service.name":           "tdarr_exporter",
+		"tdarr.host":             "http://tdarr:8265",
+		"deployment.environment": "test",
+	} {
+		if attrs[k] != v {
+			t.Errorf("resource attribute %s = %q, want %q", k, attrs[k], v)
+		}
+	}
+	var m *metricspb.Metric
+	for _, sm := range req.GetResourceMetrics()[0].GetScopeMetrics() {
+		for _, metric := range sm.GetMetrics() {
+			if metric.GetName() == "tdarr_files" {
+				m = metric
+			}
+		}
+	}
+	if m == nil {
+		t.Fatal("tdarr_files not exported")
+	}
+	dps := m.GetGauge().GetDataPoints()
+	if len(dps) != 1 {
+		t.Fatalf("got %d data points, want 1", len(dps))
+	}
+	if v := dps[0].GetAsDouble(); v != want {
+		t.Errorf("tdarr_files = %v, want %v", v, want)
+	}
+	if a := dps[0].GetAttributes(); len(a) != 1 || a[0].GetKey() != "library_name" || a[0].GetValue().GetStringValue() != "Movies" {
+		t.Errorf("tdarr_files attributes = %v, want library_name=Movies", a)
+	}
+}
+
+func TestGRPCRetries(t *testing.T) {
+	r := newReceiver(2)
+	s, files := newTestSink(t, Config{
+		Endpoint:           startGRPC(t, r),
+		Protocol:           ProtocolGRPC,
+		Insecure:           true,
+		BufferSize:         10,
+		Retries:            3,
+		ResourceAttributes: map[string]string{"deployment.environment": "test"},
+	})
+	files.WithLabelValues("Movies").Set(42)
+	if err := s.Publish(context.Background(), nil); err != nil {
+		t.Fatal(err)
+	}
+	checkBatch(t, r.next(t), 42)
+	if n := r.calls.Load(); n != 3 {
+		t.Errorf("got %d exports, want 2 failures and a success", n)
+	}
+}
+
+func TestHTTPRetries(t *testing.T) {
+	r := newReceiver(1)
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+	t.Setenv("OTEL_EXPORTER_OTLP_ENDPOINT", srv.URL+"/base/")
+	t.Setenv("OTEL_EXPORTER_OTLP_PROTOCOL", ProtocolHTTP)
+	t.Setenv("OTEL_RESOURCE_ATTRIBUTES", "deployment.environment=test")
+	cfg, err := ConfigFromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, files := newTestSink(t, *cfg)
+	files.WithLabelValues("Movies").Set(7)
+	if err := s.Publish(context.Background(), nil); err != nil {
+		t.Fatal(err)
+	}
+	checkBatch(t, r.next(t), 7)
+	if n := r.calls.Load(); n != 2 {
+		t.Errorf("got %d exports, want a failure and a success", n)
+	}
+}
+
+func TestBufferEviction(t *testing.T) {
+	r := newReceiver(0)
+	r.down.Store(true)
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+	s, files := newTestSink(t, Config{
+		Endpoint:   srv.URL + "/base/v1/metrics",
+		Protocol:   ProtocolHTTP,
+		BufferSize: 2,
+		Retries:    0,
+	})
+	for i := 1; i <= 3; i++ {
+		files.WithLabelValues("Movies").Set(float64(i))
+		if err := s.Publish(context.Background(), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	r.down.Store(false)
+	// the oldest batch was evicted, and the others are flushed in order
+	if err := s.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []float64{2, 3} {
+		if v, _ := gauge(r.next(t), "tdarr_files"); v != want {
+			t.Errorf("got batch with tdarr_files %v, want %v", v, want)
+		}
+	}
+	select {
+	case req := <-r.reqs:
+		v, _ := gauge(req, "tdarr_files")
+		t.Errorf("got unexpected batch with tdarr_files %v", v)
+	default:
+	}
+}
+
+func TestConfigFromEnvEndpoint(t *testing.T) {
+	for _, tc := range []struct {
+		endpoint, metricsEndpoint, protocol, want string
+	}{
+		{"http://collector:4318", "", ProtocolHTTP, "http://collector:4318/v1/metrics"},
+		{"http://collector:4318/otlp/", "", ProtocolHTTP, "http://collector:4318/otlp/v1/metrics"},
+		{"http://collector:4318", "http://collector:4318/custom", ProtocolHTTP, "http://collector:4318/custom"},
+		{"collector:4317", "", ProtocolGRPC, "collector:4317"},
+	} {
+		t.Setenv("OTEL_EXPORTER_OTLP_ENDPOINT", tc.endpoint)
+		t.Setenv("OTEL_EXPORTER_OTLP_METRICS_ENDPOINT", tc.metricsEndpoint)
+		t.Setenv("OTEL_EXPORTER_OTLP_PROTOCOL", tc.protocol)
+		cfg, err := ConfigFromEnv()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cfg.Endpoint != tc.want {
+			t.Errorf("endpoint %q, metrics endpoint %q: got %q, want %q", tc.endpoint, tc.metricsEndpoint, cfg.Endpoint, tc.want)
+		}
+	}
+}
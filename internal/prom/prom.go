@@ -1,236 +1,320 @@
 package prom
 
 import (
+	"strings"
+
 	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
 )
 
+// Metric describes a metric defined by the exporter.
+type Metric struct {
+	Name   string
+	Help   string
+	Type   string
+	Labels []string
+
+	collector prometheus.Collector
+}
+
+// defined holds every metric in order of definition. The constructors below
+// add to it, so that a metric can't be defined without being registered.
+// They are used by the collectors to define their own metrics.
+var defined []Metric
+
+func NewGauge(opts prometheus.GaugeOpts) prometheus.Gauge {
+	g := prometheus.NewGauge(opts)
+	defined = append(defined, Metric{Name: opts.Name, Help: opts.Help, Type: "gauge", collector: g})
+	return g
+}
+
+func NewCounter(opts prometheus.CounterOpts) prometheus.Counter {
+	c := prometheus.NewCounter(opts)
+	defined = append(defined, Metric{Name: opts.Name, Help: opts.Help, Type: "counter", collector: c})
+	return c
+}
+
+func NewGaugeVec(opts prometheus.GaugeOpts, labels []string) *prometheus.GaugeVec {
+	g := prometheus.NewGaugeVec(opts, labels)
+	defined = append(defined, Metric{Name: opts.Name, Help: opts.Help, Type: "gauge", Labels: labels, collector: g})
+	return g
+}
+
+func NewCounterVec(opts prometheus.CounterOpts, labels []string) *prometheus.CounterVec {
+	c := prometheus.NewCounterVec(opts, labels)
+	defined = append(defined, Metric{Name: opts.Name, Help: opts.Help, Type: "counter", Labels: labels, collector: c})
+	return c
+}
+
+// Metrics returns every metric defined by the exporter.
+func Metrics() []Metric {
+	return append([]Metric(nil), defined...)
+}
+
+// Lookup returns the metric with the given name.
+func Lookup(name string) (Metric, bool) {
+	for _, m := range defined {
+		if m.Name == name {
+			return m, true
+		}
+	}
+	return Metric{}, false
+}
+
 var (
-	TotalFileCount = prometheus.NewGauge(prometheus.GaugeOpts{
+	Up = NewGauge(prometheus.GaugeOpts{
+		Name: "tdarr_up",
+		Help: "Whether the last fetch of stats from tdarr succeeded",
+	})
+	UpstreamRequestsInFlight = NewGauge(prometheus.GaugeOpts{
+		Name: "tdarr_exporter_upstream_requests_in_flight",
+		Help: "Number of requests to tdarr in flight",
+	})
+	UpstreamRequestsWaiting = NewGauge(prometheus.GaugeOpts{
+		Name: "tdarr_exporter_upstream_requests_waiting",
+		Help: "Number of requests to tdarr waiting for the concurrency limit",
+	})
+	UpstreamRequestsThrottled = NewCounter(prometheus.CounterOpts{
+		Name: "tdarr_exporter_upstream_requests_throttled_total",
+		Help: "Requests to tdarr delayed by the rate limit",
+	})
+	UpstreamRequestsCoalesced = NewCounter(prometheus.CounterOpts{
+		Name: "tdarr_exporter_upstream_requests_coalesced_total",
+		Help: "Requests to tdarr answered by an identical request already in flight",
+	})
+	CircuitBreakerState = NewGaugeVec(prometheus.GaugeOpts{
+		Name: "tdarr_exporter_circuit_breaker_state",
+		Help: "State of the circuit breaker around the tdarr API, 1 for the current state",
+	}, []string{"state"})
+	TotalFileCount = NewGauge(prometheus.GaugeOpts{
 		Name: "tdarr_total_file_count",
 		Help: "Total number of files in tdarr",
 	})
-	TotalTranscodeCount = prometheus.NewGauge(prometheus.GaugeOpts{
+	TotalTranscodeCount = NewGauge(prometheus.GaugeOpts{
 		Name: "tdarr_total_transcode_count",
 		Help: "Total number of transcodes in tdarr",
 	})
-	TotalHealthCheckCount = prometheus.NewGauge(prometheus.GaugeOpts{
+	TotalHealthCheckCount = NewGauge(prometheus.GaugeOpts{
 		Name: "tdarr_total_health_check_count",
 		Help: "Total number of health checks in tdarr",
 	})
-	SizeDiff = prometheus.NewGauge(prometheus.GaugeOpts{
+	SizeDiff = NewGauge(prometheus.GaugeOpts{
 		Name: "tdarr_size_diff",
 		Help: "Size difference in tdarr",
 	})
-	DBFetchTime = prometheus.NewGauge(prometheus.GaugeOpts{
+	DBFetchTime = NewGauge(prometheus.GaugeOpts{
 		Name: "tdarr_db_fetch_time",
 		Help: "DB fetch time in tdarr",
 	})
-	DBLoadStatus = prometheus.NewGauge(prometheus.GaugeOpts{
+	DBLoadStatus = NewGaugeVec(prometheus.GaugeOpts{
 		Name: "tdarr_db_load_status",
-		Help: "DB load status in tdarr",
-	})
-	DBQueue = prometheus.NewGauge(prometheus.GaugeOpts{
+		Help: "DB load status in tdarr, 1 for the current status",
+	}, []string{"status"})
+	DBLoadStatusTransitions = NewCounterVec(prometheus.CounterOpts{
+		Name: "tdarr_db_load_status_transitions_total",
+		Help: "Number of DB load status changes in tdarr",
+	}, []string{"from", "to"})
+	DBQueue = NewGauge(prometheus.GaugeOpts{
 		Name: "tdarr_db_queue",
 		Help: "DB queue in tdarr",
 	})
-	TdarrScore = prometheus.NewGauge(prometheus.GaugeOpts{
+	TdarrScore = NewGauge(prometheus.GaugeOpts{
 		Name: "tdarr_score",
 		Help: "Tdarr score",
 	})
-	HealthCheckScore = prometheus.NewGauge(prometheus.GaugeOpts{
+	HealthCheckScore = NewGauge(prometheus.GaugeOpts{
 		Name: "tdarr_health_check_score",
 		Help: "Health check score",
 	})
-	AverageNumberOfStreamsInVideo = prometheus.NewGauge(prometheus.GaugeOpts{
+	AverageNumberOfStreamsInVideo = NewGauge(prometheus.GaugeOpts{
 		Name: "tdarr_average_number_of_streams_in_video",
 		Help: "Average number of streams in video",
 	})
-	Languages = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Languages = NewGaugeVec(prometheus.GaugeOpts{
 		Name: "tdarr_languages",
 		Help: "Languages",
 	}, []string{"language"})
-	StreamStatsDurationAverage = prometheus.NewGauge(prometheus.GaugeOpts{
+	StreamStatsDurationAverage = NewGauge(prometheus.GaugeOpts{
 		Name: "tdarr_stream_stats_duration_average",
 		Help: "Average duration of streams",
 	})
-	StreamStatsDurationHighest = prometheus.NewGauge(prometheus.GaugeOpts{
+	StreamStatsDurationHighest = NewGauge(prometheus.GaugeOpts{
 		Name: "tdarr_stream_stats_duration_highest",
 		Help: "Highest duration of streams",
 	})
-	StreamStatsDurationTotal = prometheus.NewGauge(prometheus.GaugeOpts{
+	StreamStatsDurationTotal = NewGauge(prometheus.GaugeOpts{
 		Name: "tdarr_stream_stats_duration_total",
 		Help: "Total duration of streams",
 	})
-	StreamStatsBitrateAverage = prometheus.NewGauge(prometheus.GaugeOpts{
+	StreamStatsBitrateAverage = NewGauge(prometheus.GaugeOpts{
 		Name: "tdarr_stream_stats_bitrate_average",
 		Help: "Average bitrate of streams",
 	})
-	StreamStatsBitrateHighest = prometheus.NewGauge(prometheus.GaugeOpts{
+	StreamStatsBitrateHighest = NewGauge(prometheus.GaugeOpts{
 		Name: "tdarr_stream_stats_bitrate_highest",
 		Help: "Highest bitrate of streams",
 	})
-	StreamStatsBitrateTotal = prometheus.NewGauge(prometheus.GaugeOpts{
+	StreamStatsBitrateTotal = NewGauge(prometheus.GaugeOpts{
 		Name: "tdarr_stream_stats_bitrate_total",
 		Help: "Total bitrate of streams",
 	})
-	StreamStatsNbFramesAverage = prometheus.NewGauge(prometheus.GaugeOpts{
+	StreamStatsNbFramesAverage = NewGauge(prometheus.GaugeOpts{
 		Name: "tdarr_stream_stats_nb_frames_average",
 		Help: "Average number of frames in streams",
 	})
-	StreamStatsNbFramesHighest = prometheus.NewGauge(prometheus.GaugeOpts{
+	StreamStatsNbFramesHighest = NewGauge(prometheus.GaugeOpts{
 		Name: "tdarr_stream_stats_nb_frames_highest",
 		Help: "Highest number of frames in streams",
 	})
-	StreamStatsNbFramesTotal = prometheus.NewGauge(prometheus.GaugeOpts{
+	StreamStatsNbFramesTotal = NewGauge(prometheus.GaugeOpts{
 		Name: "tdarr_stream_stats_nb_frames_total",
 		Help: "Total number of frames in streams",
 	})
-	Table0Count = prometheus.NewGauge(prometheus.GaugeOpts{
+	Table0Count = NewGauge(prometheus.GaugeOpts{
 		Name: "tdarr_table_0_count",
 		Help: "Table 0 count",
 	})
-	Table1Count = prometheus.NewGauge(prometheus.GaugeOpts{
+	Table1Count = NewGauge(prometheus.GaugeOpts{
 		Name: "tdarr_table_1_count",
 		Help: "Table 1 count",
 	})
-	Table2Count = prometheus.NewGauge(prometheus.GaugeOpts{
+	Table2Count = NewGauge(prometheus.GaugeOpts{
 		Name: "tdarr_table_2_count",
 		Help: "Table 2 count",
 	})
-	Table3Count = prometheus.NewGauge(prometheus.GaugeOpts{
+	Table3Count = NewGauge(prometheus.GaugeOpts{
 		Name: "tdarr_table_3_count",
 		Help: "Table 3 count",
 	})
-	Table4Count = prometheus.NewGauge(prometheus.GaugeOpts{
+	Table4Count = NewGauge(prometheus.GaugeOpts{
 		Name: "tdarr_table_4_count",
 		Help: "Table 4 count",
 	})
-	Table5Count = prometheus.NewGauge(prometheus.GaugeOpts{
+	Table5Count = NewGauge(prometheus.GaugeOpts{
 		Name: "tdarr_table_5_count",
 		Help: "Table 5 count",
 	})
-	Table6Count = prometheus.NewGauge(prometheus.GaugeOpts{
+	Table6Count = NewGauge(prometheus.GaugeOpts{
 		Name: "tdarr_table_6_count",
 		Help: "Table 6 count",
 	})
-	Table0ViewableCount = prometheus.NewGauge(prometheus.GaugeOpts{
+	Table0ViewableCount = NewGauge(prometheus.GaugeOpts{
 		Name: "tdarr_table_0_viewable_count",
 		Help: "Table 0 viewable count",
 	})
-	Table1ViewableCount = prometheus.NewGauge(prometheus.GaugeOpts{
+	Table1ViewableCount = NewGauge(prometheus.GaugeOpts{
 		Name: "tdarr_table_1_viewable_count",
 		Help: "Table 1 viewable count",
 	})
-	Table2ViewableCount = prometheus.NewGauge(prometheus.GaugeOpts{
+	Table2ViewableCount = NewGauge(prometheus.GaugeOpts{
 		Name: "tdarr_table_2_viewable_count",
 		Help: "Table 2 viewable count",
 	})
-	Table3ViewableCount = prometheus.NewGauge(prometheus.GaugeOpts{
+	Table3ViewableCount = NewGauge(prometheus.GaugeOpts{
 		Name: "tdarr_table_3_viewable_count",
 		Help: "Table 3 viewable count",
 	})
-	Table4ViewableCount = prometheus.NewGauge(prometheus.GaugeOpts{
+	Table4ViewableCount = NewGauge(prometheus.GaugeOpts{
 		Name: "tdarr_table_4_viewable_count",
 		Help: "Table 4 viewable count",
 	})
-	Table5ViewableCount = prometheus.NewGauge(prometheus.GaugeOpts{
+	Table5ViewableCount = NewGauge(prometheus.GaugeOpts{
 		Name: "tdarr_table_5_viewable_count",
 		Help: "Table 5 viewable count",
 	})
-	Table6ViewableCount = prometheus.NewGauge(prometheus.GaugeOpts{
+	Table6ViewableCount = NewGauge(prometheus.GaugeOpts{
 		Name: "tdarr_table_6_viewable_count",
 		Help: "Table 6 viewable count",
 	})
-	LibraryTotalFileCount = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	LibraryTotalFileCount = NewGaugeVec(prometheus.GaugeOpts{
 		Name: "tdarr_library_total_file_count",
 		Help: "Total number of files in tdarr library",
 	}, []string{"library_name", "library_id"})
-	LibraryTotalTranscodeCount = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	LibraryTotalTranscodeCount = NewGaugeVec(prometheus.GaugeOpts{
 		Name: "tdarr_library_total_transcode_count",
 		Help: "Total number of transcodes in tdarr library",
 	}, []string{"library_name", "library_id"})
-	LibraryTotalHealthCheckCount = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	LibraryTotalHealthCheckCount = NewGaugeVec(prometheus.GaugeOpts{
 		Name: "tdarr_library_total_health_check_count",
 		Help: "Total number of health checks in tdarr library",
 	}, []string{"library_name", "library_id"})
-	LibrarySizeDiff = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	LibrarySizeDiff = NewGaugeVec(prometheus.GaugeOpts{
 		Name: "tdarr_library_size_diff",
 		Help: "Size difference in tdarr library",
 	}, []string{"library_name", "library_id"})
-	LibraryTranscodeStatus = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	LibraryTranscodeStatus = NewGaugeVec(prometheus.GaugeOpts{
 		Name: "tdarr_library_transcode_status",
 		Help: "Transcode status in tdarr library",
 	}, []string{"library_name", "library_id", "status"})
-	LibraryHealth = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	LibraryHealth = NewGaugeVec(prometheus.GaugeOpts{
 		Name: "tdarr_library_health",
 		Help: "Health in tdarr library",
 	}, []string{"library_name", "library_id", "health"})
-	LibraryVideoCodec = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	LibraryVideoCodec = NewGaugeVec(prometheus.GaugeOpts{
 		Name: "tdarr_library_video_codec",
 		Help: "Video codec in tdarr library",
 	}, []string{"library_name", "library_id", "codec"})
-	LibraryVideoContainer = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	LibraryVideoContainer = NewGaugeVec(prometheus.GaugeOpts{
 		Name: "tdarr_library_video_container",
 		Help: "Video container in tdarr library",
 	}, []string{"library_name", "library_id", "container"})
-	LibraryVideoResolution = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	LibraryVideoResolution = NewGaugeVec(prometheus.GaugeOpts{
 		Name: "tdarr_library_video_resolution",
 		Help: "Video resolution in tdarr library",
 	}, []string{"library_name", "library_id", "resolution"})
-	LibraryAudioCodec = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	LibraryAudioCodec = NewGaugeVec(prometheus.GaugeOpts{
 		Name: "tdarr_library_audio_codec",
 		Help: "Audio codec in tdarr library",
 	}, []string{"library_name", "library_id", "codec"})
-	LibraryAudioContainer = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	LibraryAudioContainer = NewGaugeVec(prometheus.GaugeOpts{
 		Name: "tdarr_library_audio_container",
 		Help: "Audio container in tdarr library",
 	}, []string{"library_name", "library_id", "container"})
+	TranscodesTotal = NewCounterVec(prometheus.CounterOpts{
+		Name: "tdarr_transcodes_total",
+		Help: "Transcodes in tdarr, preserved across stats resets and exporter restarts",
+	}, nil)
+	HealthChecksTotal = NewCounterVec(prometheus.CounterOpts{
+		Name: "tdarr_health_checks_total",
+		Help: "Health checks in tdarr, preserved across stats resets and exporter restarts",
+	}, nil)
+	SizeDiffTotal = NewCounterVec(prometheus.CounterOpts{
+		Name: "tdarr_size_diff_total",
+		Help: "Size difference in tdarr, preserved across stats resets and exporter restarts",
+	}, nil)
+	LibraryTranscodesTotal = NewCounterVec(prometheus.CounterOpts{
+		Name: "tdarr_library_transcodes_total",
+		Help: "Transcodes in tdarr library, preserved across stats resets and exporter restarts",
+	}, []string{"library_name", "library_id"})
+	LibraryHealthChecksTotal = NewCounterVec(prometheus.CounterOpts{
+		Name: "tdarr_library_health_checks_total",
+		Help: "Health checks in tdarr library, preserved across stats resets and exporter restarts",
+	}, []string{"library_name", "library_id"})
+	LibrarySizeDiffTotal = NewCounterVec(prometheus.CounterOpts{
+		Name: "tdarr_library_size_diff_total",
+		Help: "Size difference in tdarr library, preserved across stats resets and exporter restarts",
+	}, []string{"library_name", "library_id"})
+	CounterResets = NewCounterVec(prometheus.CounterOpts{
+		Name: "tdarr_counter_resets_total",
+		Help: "Number of times a tdarr counter was seen going backwards",
+	}, []string{"counter", "library_id"})
 )
 
 func InitMetrics() {
-	prometheus.MustRegister(TotalFileCount)
-	prometheus.MustRegister(TotalTranscodeCount)
-	prometheus.MustRegister(TotalHealthCheckCount)
-	prometheus.MustRegister(SizeDiff)
-	prometheus.MustRegister(DBFetchTime)
-	prometheus.MustRegister(DBLoadStatus)
-	prometheus.MustRegister(DBQueue)
-	prometheus.MustRegister(TdarrScore)
-	prometheus.MustRegister(HealthCheckScore)
-	prometheus.MustRegister(AverageNumberOfStreamsInVideo)
-	prometheus.MustRegister(Languages)
-	prometheus.MustRegister(StreamStatsDurationAverage)
-	prometheus.MustRegister(StreamStatsDurationHighest)
-	prometheus.MustRegister(StreamStatsDurationTotal)
-	prometheus.MustRegister(StreamStatsBitrateAverage)
-	prometheus.MustRegister(StreamStatsBitrateHighest)
-	prometheus.MustRegister(StreamStatsBitrateTotal)
-	prometheus.MustRegister(StreamStatsNbFramesAverage)
-	prometheus.MustRegister(StreamStatsNbFramesHighest)
-	prometheus.MustRegister(StreamStatsNbFramesTotal)
-	prometheus.MustRegister(Table0Count)
-	prometheus.MustRegister(Table1Count)
-	prometheus.MustRegister(Table2Count)
-	prometheus.MustRegister(Table3Count)
-	prometheus.MustRegister(Table4Count)
-	prometheus.MustRegister(Table5Count)
-	prometheus.MustRegister(Table6Count)
-	prometheus.MustRegister(Table0ViewableCount)
-	prometheus.MustRegister(Table1ViewableCount)
-	prometheus.MustRegister(Table2ViewableCount)
-	prometheus.MustRegister(Table3ViewableCount)
-	prometheus.MustRegister(Table4ViewableCount)
-	prometheus.MustRegister(Table5ViewableCount)
-	prometheus.MustRegister(Table6ViewableCount)
-	prometheus.MustRegister(LibraryTotalFileCount)
-	prometheus.MustRegister(LibraryTotalTranscodeCount)
-	prometheus.MustRegister(LibraryTotalHealthCheckCount)
-	prometheus.MustRegister(LibrarySizeDiff)
-	prometheus.MustRegister(LibraryTranscodeStatus)
-	prometheus.MustRegister(LibraryHealth)
-	prometheus.MustRegister(LibraryVideoCodec)
-	prometheus.MustRegister(LibraryVideoContainer)
-	prometheus.MustRegister(LibraryVideoResolution)
-	prometheus.MustRegister(LibraryAudioCodec)
-	prometheus.MustRegister(LibraryAudioContainer)
+	for _, m := range defined {
+		prometheus.MustRegister(m.collector)
+	}
 }
+
+// Gatherer gathers the tdarr metrics only, leaving out the go and process
+// collectors of the default registry. It is used by the push style outputs.
+var Gatherer = prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+	mfs, err := prometheus.DefaultGatherer.Gather()
+	var out []*dto.MetricFamily
+	for _, mf := range mfs {
+		if strings.HasPrefix(mf.GetName(), "tdarr_") {
+			out = append(out, mf)
+		}
+	}
+	return out, err
+})
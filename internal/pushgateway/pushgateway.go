@@ -0,0 +1,105 @@
+package pushgateway
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/push"
+	"github.com/robertlestak/tdarr_exporter/internal/prom"
+	log "github.com/sirupsen/logrus"
+)
+
+type Config struct {
+	URL      string
+	Job      string
+	Grouping map[string]string
+	Username string
+	Password string
+	// DeleteOnFailure deletes the group from the pushgateway when tdarr
+	// could not be reached, instead of leaving the last pushed values.
+	DeleteOnFailure bool
+	Timeout         time.Duration
+}
+
+func ConfigFromEnv() (Config, error) {
+	c := Config{
+		URL:             os.Getenv("PUSHGATEWAY_URL"),
+		Job:             os.Getenv("PUSHGATEWAY_JOB"),
+		Grouping:        make(map[string]string),
+		Username:        os.Getenv("PUSHGATEWAY_USERNAME"),
+		Password:        os.Getenv("PUSHGATEWAY_PASSWORD"),
+		DeleteOnFailure: os.Getenv("PUSHGATEWAY_DELETE_ON_FAILURE") == "true",
+		Timeout:         time.Second * 10,
+	}
+	if c.URL == "" {
+		return c, errors.New("PUSHGATEWAY_URL is required")
+	}
+	if c.Job == "" {
+		c.Job = "tdarr_exporter"
+	}
+	if v := os.Getenv("PUSHGATEWAY_GROUPING"); v != "" {
+		for _, kv := range strings.Split(v, ",") {
+			k, v, ok := strings.Cut(kv, "=")
+			if !ok {
+				return c, fmt.Errorf("invalid PUSHGATEWAY_GROUPING entry %q, expected key=value", kv)
+			}
+			c.Grouping[strings.TrimSpace(k)] = strings.TrimSpace(v)
+		}
+	}
+	return c, nil
+}
+
+func (c Config) pusher() *push.Pusher {
+	p := push.New(c.URL, c.Job).
+		Gatherer(prom.Gatherer).
+		Client(&http.Client{Timeout: c.Timeout})
+	// the order of the grouping labels in the URL varies, but the
+	// pushgateway identifies the group by the labels alone
+	for k, v := range c.Grouping {
+		p = p.Grouping(k, v)
+	}
+	if c.Username != "" {
+		p = p.BasicAuth(c.Username, c.Password)
+	}
+	return p
+}
+
+// Push replaces the metrics of the configured group with the current tdarr
+// metrics.
+func Push(ctx context.Context, c Config) error {
+	l := log.WithFields(log.Fields{
+		"app": "tdarr_exporter",
+		"fn":  "Push",
+	})
+	l.WithFields(log.Fields{
+		"url": c.URL,
+		"job": c.Job,
+	}).Debug("pushing metrics")
+	if err := c.pusher().PushContext(ctx); err != nil {
+		l.WithError(err).Error("error pushing metrics")
+		return err
+	}
+	return nil
+}
+
+// Delete removes the configured group from the pushgateway.
+func Delete(c Config) error {
+	l := log.WithFields(log.Fields{
+		"app": "tdarr_exporter",
+		"fn":  "Delete",
+	})
+	l.WithFields(log.Fields{
+		"url": c.URL,
+		"job": c.Job,
+	}).Debug("deleting metrics group")
+	if err := c.pusher().Delete(); err != nil {
+		l.WithError(err).Error("error deleting metrics group")
+		return err
+	}
+	return nil
+}
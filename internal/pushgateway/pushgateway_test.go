@@ -0,0 +1,104 @@
+package pushgateway
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/robertlestak/tdarr_exporter/internal/prom"
+)
+
+// request is a request received by the fake pushgateway.
+type request struct {
+	method, path, user, pass, body string
+}
+
+// group returns the job and grouping labels of the request path, which the
+// pushgateway identifies the group by whatever their order.
+func (r request) group() map[string]string {
+	g := make(map[string]string)
+	parts := strings.Split(strings.TrimPrefix(r.path, "/metrics/"), "/")
+	for i := 0; i+1 < len(parts); i += 2 {
+		g[parts[i]] = parts[i+1]
+	}
+	return g
+}
+
+func pushgateway(t *testing.T) (string, chan request) {
+	t.Helper()
+	reqs := make(chan request, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		bd, _ := io.ReadAll(r.Body)
+		user, pass, _ := r.BasicAuth()
+		reqs <- request{r.Method, r.URL.Path, user, pass, string(bd)}
+		// as the pushgateway does
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	t.Cleanup(srv.Close)
+	return srv.URL, reqs
+}
+
+func TestConfigFromEnv(t *testing.T) {
+	t.Setenv("PUSHGATEWAY_URL", "http://pushgateway:9091")
+	t.Setenv("PUSHGATEWAY_GROUPING", "instance=nas, site = home")
+	t.Setenv("PUSHGATEWAY_DELETE_ON_FAILURE", "true")
+	c, err := ConfigFromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Job != "tdarr_exporter" || !c.DeleteOnFailure {
+		t.Errorf("got config %+v", c)
+	}
+	if c.Grouping["instance"] != "nas" || c.Grouping["site"] != "home" {
+		t.Errorf("got grouping %v", c.Grouping)
+	}
+
+	t.Setenv("PUSHGATEWAY_GROUPING", "instance")
+	if _, err := ConfigFromEnv(); err == nil {
+		t.Error("got no error for a grouping without a value")
+	}
+	t.Setenv("PUSHGATEWAY_URL", "")
+	if _, err := ConfigFromEnv(); err == nil {
+		t.Error("got no error without PUSHGATEWAY_URL")
+	}
+}
+
+func TestPushDelete(t *testing.T) {
+	g := prom.NewGaugeVec(prometheus.GaugeOpts{Name: "tdarr_test_pushed", Help: "test"}, []string{"library_name"})
+	prometheus.MustRegister(g)
+	defer prometheus.Unregister(g)
+	g.WithLabelValues("Movies").Set(3)
+
+	url, reqs := pushgateway(t)
+	c := Config{
+		URL:      url,
+		Job:      "tdarr_exporter",
+		Grouping: map[string]string{"site": "home", "instance": "nas"},
+		Username: "user",
+		Password: "pass",
+	}
+	group := map[string]string{"job": "tdarr_exporter", "instance": "nas", "site": "home"}
+	if err := Push(context.Background(), c); err != nil {
+		t.Fatal(err)
+	}
+	r := <-reqs
+	if r.method != http.MethodPut || !reflect.DeepEqual(r.group(), group) || r.user != "user" || r.pass != "pass" {
+		t.Errorf("got push %s %s as %s:%s", r.method, r.path, r.user, r.pass)
+	}
+	// only the tdarr metrics are pushed
+	if !strings.Contains(r.body, "tdarr_test_pushed") || strings.Contains(r.body, "go_goroutines") {
+		t.Errorf("got pushed body %q", r.body)
+	}
+	if err := Delete(c); err != nil {
+		t.Fatal(err)
+	}
+	// the group pushed to is deleted
+	if r := <-reqs; r.method != http.MethodDelete || !reflect.DeepEqual(r.group(), group) {
+		t.Errorf("got delete %s %s", r.method, r.path)
+	}
+}
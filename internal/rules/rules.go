@@ -0,0 +1,302 @@
+package rules
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/robertlestak/tdarr_exporter/internal/prom"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	FormatRules          = "rules"
+	FormatPrometheusRule = "prometheusrule"
+)
+
+// Options holds the thresholds of the generated alerts.
+type Options struct {
+	Format    string
+	Name      string
+	Namespace string
+	// Job is the job label prometheus scrapes the exporter with
+	Job              string
+	UnreachableFor   time.Duration
+	ErrorWindow      time.Duration
+	ErrorThreshold   int
+	QueueStallWindow time.Duration
+	NodeOfflineFor   time.Duration
+	DBLoadStatusFor  time.Duration
+	// Collectors are the enabled collectors. Rules on the metrics of other
+	// collectors are left out.
+	Collectors map[string]bool
+}
+
+func DefaultOptions() Options {
+	return Options{
+		Format:           FormatRules,
+		Name:             "tdarr-exporter",
+		Job:              "tdarr_exporter",
+		UnreachableFor:   time.Minute * 5,
+		ErrorWindow:      time.Hour,
+		ErrorThreshold:   0,
+		QueueStallWindow: time.Hour * 6,
+		NodeOfflineFor:   time.Minute * 5,
+		DBLoadStatusFor:  time.Minute * 15,
+	}
+}
+
+type Rule struct {
+	Alert       string            `yaml:"alert,omitempty"`
+	Record      string            `yaml:"record,omitempty"`
+	Expr        string            `yaml:"expr"`
+	For         string            `yaml:"for,omitempty"`
+	Labels      map[string]string `yaml:"labels,omitempty"`
+	Annotations map[string]string `yaml:"annotations,omitempty"`
+}
+
+type Group struct {
+	Name  string `yaml:"name"`
+	Rules []Rule `yaml:"rules"`
+}
+
+type RuleFile struct {
+	Groups []Group `yaml:"groups"`
+}
+
+type prometheusRule struct {
+	APIVersion string `yaml:"apiVersion"`
+	Kind       string `yaml:"kind"`
+	Metadata   struct {
+		Name      string            `yaml:"name"`
+		Namespace string            `yaml:"namespace,omitempty"`
+		Labels    map[string]string `yaml:"labels,omitempty"`
+	} `yaml:"metadata"`
+	Spec RuleFile `yaml:"spec"`
+}
+
+// duration formats d in prometheus' duration syntax.
+func duration(d time.Duration) string {
+	switch {
+	case d%(time.Hour*24) == 0:
+		return fmt.Sprintf("%dd", d/(time.Hour*24))
+	case d%time.Hour == 0:
+		return fmt.Sprintf("%dh", d/time.Hour)
+	case d%time.Minute == 0:
+		return fmt.Sprintf("%dm", d/time.Minute)
+	default:
+		return fmt.Sprintf("%ds", d/time.Second)
+	}
+}
+
+// rule pairs a rule with the collectors setting its metrics. It's left out
+// unless they're all enabled.
+type rule struct {
+	collectors []string
+	Rule
+}
+
+func alerts(o Options) []rule {
+	errs := `status=~"(?i).*error.*"`
+	return []rule{
+		{collectors: []string{"statistics"}, Rule: Rule{
+			Alert:  "TdarrUnreachable",
+			Expr:   fmt.Sprintf(`up{job=%q} == 0 or tdarr_up{job=%q} == 0`, o.Job, o.Job),
+			For:    duration(o.UnreachableFor),
+			Labels: map[string]string{"severity": "critical"},
+			Annotations: map[string]string{
+				"summary":     "Tdarr is unreachable",
+				"description": "The exporter at {{ $labels.instance }} has not been able to fetch stats from Tdarr for " + duration(o.UnreachableFor) + ".",
+			},
+		}},
+		{collectors: []string{"libraries"}, Rule: Rule{
+			Alert: "TdarrTranscodeErrorsIncreasing",
+			Expr: fmt.Sprintf(`sum by (instance, library_name) (delta(tdarr_library_transcode_status{%s}[%s])) > %d`,
+				errs, duration(o.ErrorWindow), o.ErrorThreshold),
+			Labels: map[string]string{"severity": "warning"},
+			Annotations: map[string]string{
+				"summary":     "Transcode errors are increasing",
+				"description": "Library {{ $labels.library_name }} on {{ $labels.instance }} had {{ $value }} new transcode errors in the last " + duration(o.ErrorWindow) + ".",
+			},
+		}},
+		{collectors: []string{"libraries"}, Rule: Rule{
+			Alert: "TdarrHealthCheckErrorsIncreasing",
+			Expr: fmt.Sprintf(`sum by (instance, library_name) (delta(tdarr_library_health{%s}[%s])) > %d`,
+				strings.Replace(errs, "status", "health", 1), duration(o.ErrorWindow), o.ErrorThreshold),
+			Labels: map[string]string{"severity": "warning"},
+			Annotations: map[string]string{
+				"summary":     "Health check errors are increasing",
+				"description": "Library {{ $labels.library_name }} on {{ $labels.instance }} had {{ $value }} new health check errors in the last " + duration(o.ErrorWindow) + ".",
+			},
+		}},
+		{collectors: []string{"statistics"}, Rule: Rule{
+			Alert: "TdarrQueueNotDraining",
+			// the window is the range of the delta, so the alert has no
+			// for, which would double it
+			Expr: fmt.Sprintf(`tdarr_table_0_count > 0 and delta(tdarr_table_0_count[%s]) >= 0`,
+				duration(o.QueueStallWindow)),
+			Labels: map[string]string{"severity": "warning"},
+			Annotations: map[string]string{
+				"summary":     "Tdarr transcode queue is not draining",
+				"description": "The transcode queue on {{ $labels.instance }} has {{ $value }} files and has not shrunk in " + duration(o.QueueStallWindow) + ".",
+			},
+		}},
+		{collectors: []string{"nodes"}, Rule: Rule{
+			Alert:  "TdarrNodeOffline",
+			Expr:   `tdarr_node_online == 0`,
+			For:    duration(o.NodeOfflineFor),
+			Labels: map[string]string{"severity": "warning"},
+			Annotations: map[string]string{
+				"summary":     "Tdarr node is offline",
+				"description": "Node {{ $labels.node_name }} has been disconnected from {{ $labels.instance }} for " + duration(o.NodeOfflineFor) + ".",
+			},
+		}},
+		{collectors: []string{"statistics"}, Rule: Rule{
+			Alert:  "TdarrDBLoadStatusNotStable",
+			Expr:   `tdarr_db_load_status{status="Stable"} == 0`,
+			For:    duration(o.DBLoadStatusFor),
+			Labels: map[string]string{"severity": "warning"},
+			Annotations: map[string]string{
+				"summary":     "Tdarr DB load status is not Stable",
+				"description": "The DB load status of {{ $labels.instance }} has not been Stable for " + duration(o.DBLoadStatusFor) + ".",
+			},
+		}},
+	}
+}
+
+func records() []rule {
+	return []rule{
+		{collectors: []string{"statistics"}, Rule: Rule{
+			Record: "tdarr:size_diff:delta1d",
+			Expr:   `delta(tdarr_size_diff[1d])`,
+		}},
+		{collectors: []string{"libraries"}, Rule: Rule{
+			Record: "tdarr_library:size_diff:delta1d",
+			Expr:   `sum by (instance, library_name, library_id) (delta(tdarr_library_size_diff[1d]))`,
+		}},
+		// the counters are only populated when STATE_PATH is set, but unlike
+		// the gauges they survive tdarr stats resets
+		{collectors: []string{"statistics"}, Rule: Rule{
+			Record: "tdarr:size_diff:increase1d",
+			Expr:   `increase(tdarr_size_diff_total[1d])`,
+		}},
+		{collectors: []string{"libraries"}, Rule: Rule{
+			Record: "tdarr_library:size_diff:increase1d",
+			Expr:   `sum by (instance, library_name, library_id) (increase(tdarr_library_size_diff_total[1d]))`,
+		}},
+	}
+}
+
+var (
+	metricName   = regexp.MustCompile(`tdarr_[a-z0-9_]+`)
+	quoted       = regexp.MustCompile(`"[^"]*"`)
+	promDuration = regexp.MustCompile(`^([0-9]+(ms|s|m|h|d|w|y))+$`)
+)
+
+// enabled reports whether all the collectors are enabled.
+func enabled(o Options, collectors []string) bool {
+	for _, c := range collectors {
+		if !o.Collectors[c] {
+			return false
+		}
+	}
+	return true
+}
+
+func group(o Options, name string, rs []rule) Group {
+	g := Group{Name: name}
+	for _, r := range rs {
+		if enabled(o, r.collectors) {
+			g.Rules = append(g.Rules, r.Rule)
+		}
+	}
+	return g
+}
+
+// Generate renders the alerting and recording rules as a prometheus rules
+// file, or as a PrometheusRule resource for the prometheus operator. The
+// output is parsed back and validated before it's returned.
+func Generate(o Options) ([]byte, error) {
+	rf := RuleFile{Groups: []Group{
+		group(o, "tdarr.rules", records()),
+		group(o, "tdarr.alerts", alerts(o)),
+	}}
+	var v any = rf
+	switch o.Format {
+	case FormatRules:
+	case FormatPrometheusRule:
+		pr := prometheusRule{
+			APIVersion: "monitoring.coreos.com/v1",
+			Kind:       "PrometheusRule",
+			Spec:       rf,
+		}
+		pr.Metadata.Name = o.Name
+		pr.Metadata.Namespace = o.Namespace
+		pr.Metadata.Labels = map[string]string{"app": "tdarr-exporter"}
+		v = pr
+	default:
+		return nil, fmt.Errorf("unknown format %q", o.Format)
+	}
+	var b bytes.Buffer
+	enc := yaml.NewEncoder(&b)
+	enc.SetIndent(2)
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+	if err := Validate(b.Bytes()); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// Validate parses a rules file or PrometheusRule and checks that every rule
+// is well formed and only references metrics defined by the exporter.
+func Validate(bd []byte) error {
+	var doc struct {
+		Kind   string  `yaml:"kind"`
+		Groups []Group `yaml:"groups"`
+		Spec   struct {
+			Groups []Group `yaml:"groups"`
+		} `yaml:"spec"`
+	}
+	dec := yaml.NewDecoder(bytes.NewReader(bd))
+	dec.KnownFields(false)
+	if err := dec.Decode(&doc); err != nil {
+		return err
+	}
+	groups := doc.Groups
+	if doc.Kind == "PrometheusRule" {
+		groups = doc.Spec.Groups
+	}
+	if len(groups) == 0 {
+		return fmt.Errorf("no rule groups")
+	}
+	names := make(map[string]bool)
+	for _, g := range groups {
+		if g.Name == "" || names[g.Name] {
+			return fmt.Errorf("group name %q is empty or repeated", g.Name)
+		}
+		names[g.Name] = true
+		for _, r := range g.Rules {
+			if (r.Alert == "") == (r.Record == "") {
+				return fmt.Errorf("group %s: a rule needs exactly one of alert or record", g.Name)
+			}
+			if r.Expr == "" {
+				return fmt.Errorf("group %s: rule %s%s has no expr", g.Name, r.Alert, r.Record)
+			}
+			if r.For != "" && !promDuration.MatchString(r.For) {
+				return fmt.Errorf("group %s: rule %s has invalid for %q", g.Name, r.Alert, r.For)
+			}
+			// label values such as the job name aren't metric references
+			expr := quoted.ReplaceAllString(r.Expr, `""`)
+			for _, m := range metricName.FindAllString(expr, -1) {
+				if _, ok := prom.Lookup(m); !ok {
+					return fmt.Errorf("group %s: rule %s%s references undefined metric %s", g.Name, r.Alert, r.Record, m)
+				}
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,121 @@
+package rules
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/prometheus/prometheus/model/rulefmt"
+	"github.com/robertlestak/tdarr_exporter/internal/collector"
+	"gopkg.in/yaml.v3"
+)
+
+// options returns the default options with every collector enabled.
+func options() Options {
+	o := DefaultOptions()
+	o.Collectors = make(map[string]bool)
+	for _, name := range collector.Names() {
+		o.Collectors[name] = true
+	}
+	return o
+}
+
+// parse parses generated rules with prometheus' own parser, which also
+// parses the expressions and templates.
+func parse(t *testing.T, bd []byte) *rulefmt.RuleGroups {
+	t.Helper()
+	rgs, errs := rulefmt.Parse(bd)
+	for _, err := range errs {
+		t.Error(err)
+	}
+	if len(errs) > 0 {
+		t.FailNow()
+	}
+	return rgs
+}
+
+func checkGroups(t *testing.T, rgs *rulefmt.RuleGroups) {
+	t.Helper()
+	want := map[string]int{
+		"tdarr.rules":  len(records()),
+		"tdarr.alerts": len(alerts(options())),
+	}
+	if len(rgs.Groups) != len(want) {
+		t.Fatalf("got %d groups, want %d", len(rgs.Groups), len(want))
+	}
+	for _, g := range rgs.Groups {
+		if n, ok := want[g.Name]; !ok || len(g.Rules) != n {
+			t.Errorf("group %s has %d rules, want %d", g.Name, len(g.Rules), n)
+		}
+	}
+}
+
+func TestGenerateRules(t *testing.T) {
+	bd, err := Generate(options())
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkGroups(t, parse(t, bd))
+}
+
+func TestGenerateDisabledCollector(t *testing.T) {
+	o := options()
+	o.Collectors["nodes"] = false
+	bd, err := Generate(o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, g := range parse(t, bd).Groups {
+		for _, r := range g.Rules {
+			if r.Alert.Value == "TdarrNodeOffline" {
+				t.Error("got TdarrNodeOffline with the nodes collector disabled")
+			}
+		}
+	}
+}
+
+func TestGeneratePrometheusRule(t *testing.T) {
+	o := options()
+	o.Format = FormatPrometheusRule
+	o.Namespace = "monitoring"
+	bd, err := Generate(o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var pr struct {
+		APIVersion string `yaml:"apiVersion"`
+		Kind       string `yaml:"kind"`
+		Metadata   struct {
+			Name      string `yaml:"name"`
+			Namespace string `yaml:"namespace"`
+		} `yaml:"metadata"`
+		Spec yaml.Node `yaml:"spec"`
+	}
+	if err := yaml.Unmarshal(bd, &pr); err != nil {
+		t.Fatal(err)
+	}
+	if pr.APIVersion != "monitoring.coreos.com/v1" || pr.Kind != "PrometheusRule" {
+		t.Errorf("got %s %s, want a monitoring.coreos.com/v1 PrometheusRule", pr.APIVersion, pr.Kind)
+	}
+	if pr.Metadata.Name != o.Name || pr.Metadata.Namespace != o.Namespace {
+		t.Errorf("got metadata %+v", pr.Metadata)
+	}
+	// the spec of a PrometheusRule is a rules file
+	spec, err := yaml.Marshal(&pr.Spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkGroups(t, parse(t, spec))
+}
+
+func TestValidateUndefinedMetric(t *testing.T) {
+	bd := []byte(`groups:
+- name: test
+  rules:
+  - alert: Renamed
+    expr: tdarr_no_such_metric > 0
+`)
+	err := Validate(bd)
+	if err == nil || !strings.Contains(err.Error(), "tdarr_no_such_metric") {
+		t.Errorf("got error %v, want one about tdarr_no_such_metric", err)
+	}
+}
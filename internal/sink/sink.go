@@ -0,0 +1,70 @@
+package sink
+
+import (
+	"context"
+
+	"github.com/robertlestak/tdarr_exporter/internal/tdarr"
+	log "github.com/sirupsen/logrus"
+)
+
+// Sink is an output which receives the stats of every successful collection
+// cycle, in addition to the prometheus /metrics endpoint.
+type Sink interface {
+	Name() string
+	Publish(ctx context.Context, stats *tdarr.TdarrStatsResponse) error
+	Close(ctx context.Context) error
+}
+
+// FailureSink is implemented by sinks which report when a collection cycle
+// failed, for example because tdarr could not be reached.
+type FailureSink interface {
+	PublishFailure(ctx context.Context, err error) error
+}
+
+// PublishAll publishes stats to every sink. A failing sink is logged and
+// does not prevent the remaining sinks from receiving the stats.
+func PublishAll(ctx context.Context, sinks []Sink, stats *tdarr.TdarrStatsResponse) {
+	l := log.WithFields(log.Fields{
+		"app": "tdarr_exporter",
+		"fn":  "PublishAll",
+	})
+	for _, s := range sinks {
+		l.WithField("sink", s.Name()).Debug("publishing stats")
+		if err := s.Publish(ctx, stats); err != nil {
+			l.WithField("sink", s.Name()).WithError(err).Error("error publishing stats")
+		}
+	}
+}
+
+// PublishFailureAll reports a failed collection cycle to every sink
+// implementing FailureSink.
+func PublishFailureAll(ctx context.Context, sinks []Sink, cerr error) {
+	l := log.WithFields(log.Fields{
+		"app": "tdarr_exporter",
+		"fn":  "PublishFailureAll",
+	})
+	for _, s := range sinks {
+		fs, ok := s.(FailureSink)
+		if !ok {
+			continue
+		}
+		l.WithField("sink", s.Name()).Debug("publishing failure")
+		if err := fs.PublishFailure(ctx, cerr); err != nil {
+			l.WithField("sink", s.Name()).WithError(err).Error("error publishing failure")
+		}
+	}
+}
+
+// CloseAll closes every sink, flushing any buffered data.
+func CloseAll(ctx context.Context, sinks []Sink) {
+	l := log.WithFields(log.Fields{
+		"app": "tdarr_exporter",
+		"fn":  "CloseAll",
+	})
+	for _, s := range sinks {
+		l.WithField("sink", s.Name()).Debug("closing sink")
+		if err := s.Close(ctx); err != nil {
+			l.WithField("sink", s.Name()).WithError(err).Error("error closing sink")
+		}
+	}
+}
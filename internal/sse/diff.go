@@ -0,0 +1,173 @@
+package sse
+
+import (
+	"sort"
+	"time"
+
+	"github.com/robertlestak/tdarr_exporter/internal/tdarr"
+)
+
+type statsData struct {
+	Server                string    `json:"server"`
+	Time                  time.Time `json:"time"`
+	TotalFileCount        int       `json:"total_file_count"`
+	TotalTranscodeCount   int       `json:"total_transcode_count"`
+	TotalHealthCheckCount int       `json:"total_health_check_count"`
+	SizeDiff              float64   `json:"size_diff"`
+	TranscodeQueue        int       `json:"transcode_queue"`
+	HealthCheckQueue      int       `json:"health_check_queue"`
+	DBQueue               int       `json:"db_queue"`
+	DBLoadStatus          string    `json:"db_load_status"`
+}
+
+type libraryData struct {
+	Server                string                `json:"server"`
+	Library               string                `json:"library"`
+	LibraryID             string                `json:"library_id"`
+	TotalFileCount        int                   `json:"total_file_count"`
+	TotalTranscodeCount   int                   `json:"total_transcode_count"`
+	TotalHealthCheckCount int                   `json:"total_health_check_count"`
+	SizeDiff              float64               `json:"size_diff"`
+	TranscodeStatus       []tdarr.TranscodeInfo `json:"transcode_status"`
+	Health                []tdarr.TranscodeInfo `json:"health"`
+}
+
+type workerData struct {
+	Server     string  `json:"server"`
+	Node       string  `json:"node"`
+	NodeID     string  `json:"node_id"`
+	WorkerID   string  `json:"worker_id"`
+	WorkerType string  `json:"worker_type"`
+	File       string  `json:"file"`
+	Percentage float64 `json:"percentage"`
+	FPS        float64 `json:"fps"`
+	ETA        string  `json:"eta"`
+}
+
+type nodeData struct {
+	Server string `json:"server"`
+	Node   string `json:"node"`
+	NodeID string `json:"node_id"`
+}
+
+func libraryChanged(a, b tdarr.CategoryInfo) bool {
+	if a.TotalFileCount != b.TotalFileCount ||
+		a.TotalTranscodeCount != b.TotalTranscodeCount ||
+		a.TotalHealthCheckCount != b.TotalHealthCheckCount ||
+		a.SizeDiff != b.SizeDiff {
+		return true
+	}
+	return !infosEqual(a.TranscodeStatus, b.TranscodeStatus) || !infosEqual(a.Health, b.Health)
+}
+
+func infosEqual(a, b []tdarr.TranscodeInfo) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// diff derives the events of a collection cycle. Every cycle produces a
+// stats_updated event and progress for each busy worker; library and node
+// events are only produced for changes since the previous cycle.
+func diff(server string, prev, cur *tdarr.TdarrStatsResponse) []Event {
+	events := []Event{{
+		Type: StatsUpdated,
+		Data: statsData{
+			Server:                server,
+			Time:                  cur.FetchedAt,
+			TotalFileCount:        cur.TotalFileCount,
+			TotalTranscodeCount:   cur.TotalTranscodeCount,
+			TotalHealthCheckCount: cur.TotalHealthCheckCount,
+			SizeDiff:              cur.SizeDiff,
+			TranscodeQueue:        cur.Table0Count,
+			HealthCheckQueue:      cur.Table3Count,
+			DBQueue:               cur.DBQueue,
+			DBLoadStatus:          cur.DBLoadStatus,
+		},
+	}}
+	prevLibs := make(map[string]tdarr.CategoryInfo)
+	if prev != nil {
+		for _, c := range prev.ParsedPies {
+			prevLibs[c.ID] = c
+		}
+	}
+	for _, c := range cur.ParsedPies {
+		if p, ok := prevLibs[c.ID]; ok && !libraryChanged(p, c) {
+			continue
+		}
+		events = append(events, Event{
+			Type: LibraryCountsChanged,
+			Data: libraryData{
+				Server:                server,
+				Library:               c.Library,
+				LibraryID:             c.ID,
+				TotalFileCount:        c.TotalFileCount,
+				TotalTranscodeCount:   c.TotalTranscodeCount,
+				TotalHealthCheckCount: c.TotalHealthCheckCount,
+				SizeDiff:              c.SizeDiff,
+				TranscodeStatus:       c.TranscodeStatus,
+				Health:                c.Health,
+			},
+		})
+	}
+	if cur.Nodes == nil {
+		return events
+	}
+	var prevNodes map[string]tdarr.Node
+	if prev != nil {
+		prevNodes = prev.Nodes
+	}
+	for _, id := range sortedKeys(cur.Nodes) {
+		n := cur.Nodes[id]
+		if _, ok := prevNodes[id]; !ok {
+			events = append(events, Event{
+				Type: NodeOnline,
+				Data: nodeData{Server: server, Node: n.Name(), NodeID: id},
+			})
+		}
+		for _, wid := range sortedKeys(n.Workers) {
+			w := n.Workers[wid]
+			if w.Idle {
+				continue
+			}
+			events = append(events, Event{
+				Type: WorkerProgress,
+				Data: workerData{
+					Server:     server,
+					Node:       n.Name(),
+					NodeID:     id,
+					WorkerID:   wid,
+					WorkerType: w.WorkerType,
+					File:       w.File,
+					Percentage: w.Percentage,
+					FPS:        w.FPS,
+					ETA:        w.ETA,
+				},
+			})
+		}
+	}
+	for _, id := range sortedKeys(prevNodes) {
+		if _, ok := cur.Nodes[id]; !ok {
+			events = append(events, Event{
+				Type: NodeOffline,
+				Data: nodeData{Server: server, Node: prevNodes[id].Name(), NodeID: id},
+			})
+		}
+	}
+	return events
+}
@@ -0,0 +1,251 @@
+package sse
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/robertlestak/tdarr_exporter/internal/tdarr"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	StatsUpdated         = "stats_updated"
+	LibraryCountsChanged = "library_counts_changed"
+	WorkerProgress       = "worker_progress"
+	NodeOnline           = "node_online"
+	NodeOffline          = "node_offline"
+	// Reset is sent to a client whose resume token can't be honoured, and
+	// is followed by a snapshot of the current state
+	Reset = "reset"
+)
+
+type resetData struct {
+	Server string    `json:"server"`
+	Time   time.Time `json:"time"`
+}
+
+// Event is a typed message sent on the stream. ID is the resume token which
+// clients send back as Last-Event-ID when reconnecting.
+type Event struct {
+	ID   string
+	Type string
+	Data any
+}
+
+// Broker turns each collection cycle into events and fans them out to the
+// connected clients. The most recent events are kept in a ring buffer so
+// that reconnecting clients can resume where they left off.
+type Broker struct {
+	server string
+	// epoch distinguishes the IDs of this process from those of a previous
+	// run, whose resume tokens can't be honoured
+	epoch string
+	size  int
+
+	mu     sync.Mutex
+	seq    uint64
+	buffer []Event
+	subs   map[chan Event]struct{}
+	prev   *tdarr.TdarrStatsResponse
+}
+
+func NewBroker(s tdarr.Server, size int) *Broker {
+	return &Broker{
+		server: s.Host,
+		epoch:  strconv.FormatInt(time.Now().Unix(), 36),
+		size:   size,
+		subs:   make(map[chan Event]struct{}),
+	}
+}
+
+// NewBrokerFromEnv creates a broker if SSE_ENABLED is true, and returns nil
+// otherwise.
+func NewBrokerFromEnv(s tdarr.Server) (*Broker, error) {
+	if os.Getenv("SSE_ENABLED") != "true" {
+		return nil, nil
+	}
+	size := 1000
+	if v := os.Getenv("SSE_BUFFER_SIZE"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("invalid SSE_BUFFER_SIZE %q", v)
+		}
+		size = n
+	}
+	return NewBroker(s, size), nil
+}
+
+func (b *Broker) Name() string {
+	return "sse"
+}
+
+func (b *Broker) Publish(ctx context.Context, stats *tdarr.TdarrStatsResponse) error {
+	b.mu.Lock()
+	prev := b.prev
+	b.prev = stats
+	b.mu.Unlock()
+	for _, e := range diff(b.server, prev, stats) {
+		b.emit(e)
+	}
+	return nil
+}
+
+// emit assigns the next ID to an event, buffers it and sends it to every
+// subscriber. Subscribers which can't keep up are disconnected, they resume
+// from the buffer when they reconnect.
+func (b *Broker) emit(e Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.seq++
+	e.ID = b.id(b.seq)
+	if len(b.buffer) >= b.size {
+		b.buffer = b.buffer[1:]
+	}
+	b.buffer = append(b.buffer, e)
+	for ch := range b.subs {
+		select {
+		case ch <- e:
+		default:
+			delete(b.subs, ch)
+			close(ch)
+		}
+	}
+}
+
+func (b *Broker) id(seq uint64) string {
+	return b.epoch + "-" + strconv.FormatUint(seq, 10)
+}
+
+// subscribe registers a new client and returns the buffered events after
+// the given resume token. A token which can't be resumed from without a
+// gap, because it's from a previous run or its events were evicted from
+// the buffer, gets a reset event and a snapshot of the current state
+// instead.
+func (b *Broker) subscribe(lastID string) (chan Event, []Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	ch := make(chan Event, 64)
+	b.subs[ch] = struct{}{}
+	if lastID == "" {
+		return ch, nil
+	}
+	epoch, seq, ok := strings.Cut(lastID, "-")
+	n, err := strconv.ParseUint(seq, 10, 64)
+	// the buffer holds the events up to b.seq, and n+1 must be among them
+	first := b.seq + 1 - uint64(len(b.buffer))
+	if !ok || err != nil || epoch != b.epoch || n > b.seq || n+1 < first {
+		return ch, b.snapshot()
+	}
+	return ch, append([]Event(nil), b.buffer[len(b.buffer)-int(b.seq-n):]...)
+}
+
+// snapshot returns a reset event followed by the events describing the
+// current state from scratch. They carry the ID of the last event, so that
+// the client resumes from there. b.mu must be held.
+func (b *Broker) snapshot() []Event {
+	id := b.id(b.seq)
+	events := []Event{{
+		ID:   id,
+		Type: Reset,
+		Data: resetData{Server: b.server, Time: time.Now()},
+	}}
+	if b.prev == nil {
+		return events
+	}
+	for _, e := range diff(b.server, nil, b.prev) {
+		e.ID = id
+		events = append(events, e)
+	}
+	return events
+}
+
+func (b *Broker) unsubscribe(ch chan Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.subs[ch]; ok {
+		delete(b.subs, ch)
+		close(ch)
+	}
+}
+
+// Handler serves the event stream. Clients resume with the Last-Event-ID
+// header, or the last_event_id query parameter for clients which can't set
+// headers.
+func (b *Broker) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		l := log.WithFields(log.Fields{
+			"app": "tdarr_exporter",
+			"fn":  "Handler",
+		})
+		f, ok := w.(http.Flusher)
+		if !ok {
+			http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+			return
+		}
+		lastID := r.Header.Get("Last-Event-ID")
+		if lastID == "" {
+			lastID = r.URL.Query().Get("last_event_id")
+		}
+		ch, replay := b.subscribe(lastID)
+		defer b.unsubscribe(ch)
+		w.Header().Set("content-type", "text/event-stream")
+		w.Header().Set("cache-control", "no-cache")
+		w.Header().Set("connection", "keep-alive")
+		w.WriteHeader(http.StatusOK)
+		for _, e := range replay {
+			if err := write(w, e); err != nil {
+				return
+			}
+		}
+		f.Flush()
+		l.WithField("replayed", len(replay)).Debug("sse client connected")
+		heartbeat := time.NewTicker(time.Second * 15)
+		defer heartbeat.Stop()
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case <-heartbeat.C:
+				// comments keep proxies from closing an idle stream
+				if _, err := fmt.Fprint(w, ": heartbeat\n\n"); err != nil {
+					return
+				}
+			case e, ok := <-ch:
+				if !ok {
+					return
+				}
+				if err := write(w, e); err != nil {
+					return
+				}
+			}
+			f.Flush()
+		}
+	})
+}
+
+func write(w http.ResponseWriter, e Event) error {
+	data, err := json.Marshal(e.Data)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "id: %s\nevent: %s\ndata: %s\n\n", e.ID, e.Type, data)
+	return err
+}
+
+// Close disconnects every client.
+func (b *Broker) Close(ctx context.Context) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for ch := range b.subs {
+		delete(b.subs, ch)
+		close(ch)
+	}
+	return nil
+}
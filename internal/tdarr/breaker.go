@@ -0,0 +1,147 @@
+package tdarr
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/robertlestak/tdarr_exporter/internal/prom"
+	log "github.com/sirupsen/logrus"
+)
+
+// ErrCircuitOpen is returned for requests made while the circuit breaker is
+// open.
+var ErrCircuitOpen = errors.New("circuit breaker open, tdarr is failing")
+
+const (
+	BreakerClosed   = "closed"
+	BreakerOpen     = "open"
+	BreakerHalfOpen = "half_open"
+)
+
+// breakerTransport stops requests to tdarr after a run of failures, so that
+// a restarting tdarr isn't sent a request by every collector on every
+// interval. Once the backoff has passed a single probe request is let
+// through: the breaker closes if it succeeds, and opens again for twice as
+// long if it fails.
+type breakerTransport struct {
+	failures   int
+	backoff    time.Duration
+	maxBackoff time.Duration
+	next       http.RoundTripper
+
+	mu          sync.Mutex
+	state       string
+	consecutive int
+	wait        time.Duration
+	openUntil   time.Time
+	probing     bool
+}
+
+func newBreakerTransport(failures int, backoff, maxBackoff time.Duration, next http.RoundTripper) *breakerTransport {
+	t := &breakerTransport{
+		failures:   failures,
+		backoff:    backoff,
+		maxBackoff: max(maxBackoff, backoff),
+		next:       next,
+	}
+	t.setState(BreakerClosed)
+	return t
+}
+
+// setState exports the state set of the breaker. t.mu must be held.
+func (t *breakerTransport) setState(state string) {
+	if t.state != "" && t.state != state {
+		log.WithFields(log.Fields{
+			"app":  "tdarr_exporter",
+			"fn":   "setState",
+			"from": t.state,
+			"to":   state,
+		}).Info("circuit breaker state changed")
+	}
+	t.state = state
+	for _, st := range []string{BreakerClosed, BreakerOpen, BreakerHalfOpen} {
+		v := 0.0
+		if st == state {
+			v = 1
+		}
+		prom.CircuitBreakerState.WithLabelValues(st).Set(v)
+	}
+}
+
+// allow reports whether a request may be made, and whether it is the probe
+// of a half open breaker.
+func (t *breakerTransport) allow() (ok, probe bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	switch t.state {
+	case BreakerClosed:
+		return true, false
+	case BreakerOpen:
+		if time.Now().Before(t.openUntil) {
+			return false, false
+		}
+		t.setState(BreakerHalfOpen)
+	}
+	if t.probing {
+		return false, false
+	}
+	t.probing = true
+	return true, true
+}
+
+// record counts the outcome of a request. While the breaker is open or half
+// open only its probe changes the state: requests which were already in
+// flight when it opened neither close it nor extend its backoff.
+func (t *breakerTransport) record(probe, failed bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if probe {
+		t.probing = false
+	} else if t.state != BreakerClosed {
+		return
+	}
+	if !failed {
+		t.consecutive = 0
+		t.wait = 0
+		t.setState(BreakerClosed)
+		return
+	}
+	t.consecutive++
+	if probe || t.consecutive >= t.failures {
+		if t.wait == 0 {
+			t.wait = t.backoff
+		} else {
+			t.wait = min(t.wait*2, t.maxBackoff)
+		}
+		t.openUntil = time.Now().Add(t.wait)
+		t.setState(BreakerOpen)
+	}
+}
+
+func (t *breakerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ok, probe := t.allow()
+	if !ok {
+		return nil, ErrCircuitOpen
+	}
+	res, err := t.next.RoundTrip(req)
+	switch {
+	case err != nil && errors.Is(req.Context().Err(), context.Canceled):
+		// cancelled by the caller, which says nothing about tdarr. Timeouts
+		// are failures.
+		if probe {
+			t.mu.Lock()
+			t.probing = false
+			t.mu.Unlock()
+		}
+	case err != nil:
+		t.record(probe, true)
+	case res.StatusCode >= 500:
+		t.record(probe, true)
+	default:
+		t.record(probe, false)
+	}
+	return res, err
+}
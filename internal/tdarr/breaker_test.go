@@ -0,0 +1,135 @@
+package tdarr
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+)
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+// Steps of a breaker test.
+const (
+	stepOK     = "ok"     // a request tdarr answers
+	stepFail   = "fail"   // a request tdarr fails with a 500
+	stepError  = "error"  // a request which can't reach tdarr
+	stepCancel = "cancel" // a request cancelled by its caller
+	stepOpen   = "open"   // a request refused by the open breaker
+	stepElapse = "elapse" // the backoff passes
+	// replies to requests made before the breaker opened
+	stepLateOK   = "late ok"
+	stepLateFail = "late fail"
+)
+
+type breakerStep struct {
+	do    string
+	state string
+	wait  time.Duration
+}
+
+func TestBreaker(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		steps []breakerStep
+	}{
+		{"opens after the failures", []breakerStep{
+			{stepFail, BreakerClosed, 0},
+			{stepError, BreakerOpen, 10 * time.Second},
+			{stepOpen, BreakerOpen, 10 * time.Second},
+		}},
+		{"success resets the failures", []breakerStep{
+			{stepFail, BreakerClosed, 0},
+			{stepOK, BreakerClosed, 0},
+			{stepFail, BreakerClosed, 0},
+		}},
+		{"closes on probe success", []breakerStep{
+			{stepFail, BreakerClosed, 0},
+			{stepFail, BreakerOpen, 10 * time.Second},
+			{stepElapse, BreakerOpen, 10 * time.Second},
+			{stepOK, BreakerClosed, 0},
+			{stepFail, BreakerClosed, 0},
+		}},
+		{"probe failure doubles the backoff up to the max", []breakerStep{
+			{stepFail, BreakerClosed, 0},
+			{stepFail, BreakerOpen, 10 * time.Second},
+			{stepElapse, BreakerOpen, 10 * time.Second},
+			{stepFail, BreakerOpen, 20 * time.Second},
+			{stepOpen, BreakerOpen, 20 * time.Second},
+			{stepElapse, BreakerOpen, 20 * time.Second},
+			{stepError, BreakerOpen, 40 * time.Second},
+			{stepElapse, BreakerOpen, 40 * time.Second},
+			{stepFail, BreakerOpen, 40 * time.Second},
+		}},
+		{"cancelled requests don't count", []breakerStep{
+			{stepCancel, BreakerClosed, 0},
+			{stepCancel, BreakerClosed, 0},
+			{stepCancel, BreakerClosed, 0},
+			{stepFail, BreakerClosed, 0},
+			{stepCancel, BreakerClosed, 0},
+			{stepFail, BreakerOpen, 10 * time.Second},
+		}},
+		{"cancelled probe is retried", []breakerStep{
+			{stepFail, BreakerClosed, 0},
+			{stepFail, BreakerOpen, 10 * time.Second},
+			{stepElapse, BreakerOpen, 10 * time.Second},
+			{stepCancel, BreakerHalfOpen, 10 * time.Second},
+			{stepOK, BreakerClosed, 0},
+		}},
+		{"late replies don't change an open breaker", []breakerStep{
+			{stepFail, BreakerClosed, 0},
+			{stepFail, BreakerOpen, 10 * time.Second},
+			{stepLateOK, BreakerOpen, 10 * time.Second},
+			{stepLateFail, BreakerOpen, 10 * time.Second},
+			{stepOpen, BreakerOpen, 10 * time.Second},
+		}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			b := newBreakerTransport(2, 10*time.Second, 40*time.Second, roundTripFunc(func(req *http.Request) (*http.Response, error) {
+				if err := req.Context().Err(); err != nil {
+					return nil, err
+				}
+				switch req.Header.Get("step") {
+				case stepFail:
+					return &http.Response{StatusCode: http.StatusInternalServerError}, nil
+				case stepError:
+					return nil, errors.New("connection refused")
+				}
+				return &http.Response{StatusCode: http.StatusOK}, nil
+			}))
+			for i, st := range tc.steps {
+				var openUntil time.Time
+				switch st.do {
+				case stepElapse:
+					b.openUntil = time.Now()
+				case stepLateOK, stepLateFail:
+					openUntil = b.openUntil
+					b.record(false, st.do == stepLateFail)
+				default:
+					ctx, cancel := context.WithCancel(context.Background())
+					if st.do == stepCancel {
+						cancel()
+					}
+					req, _ := http.NewRequestWithContext(ctx, "GET", "http://tdarr", nil)
+					req.Header.Set("step", st.do)
+					_, err := b.RoundTrip(req)
+					cancel()
+					if open := errors.Is(err, ErrCircuitOpen); open != (st.do == stepOpen) {
+						t.Errorf("step %d %s: got error %v", i, st.do, err)
+					}
+				}
+				if b.state != st.state || b.wait != st.wait {
+					t.Errorf("step %d %s: breaker is %s with backoff %s, want %s with %s", i, st.do, b.state, b.wait, st.state, st.wait)
+				}
+				if !openUntil.IsZero() && !b.openUntil.Equal(openUntil) {
+					t.Errorf("step %d %s: backoff extended to %s", i, st.do, b.openUntil)
+				}
+			}
+		})
+	}
+}
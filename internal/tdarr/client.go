@@ -0,0 +1,288 @@
+package tdarr
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/robertlestak/tdarr_exporter/internal/prom"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sync/singleflight"
+)
+
+// parseHeaders parses a comma separated list of Name=value headers.
+func parseHeaders(s string) (map[string]string, error) {
+	headers := make(map[string]string)
+	for _, kv := range strings.Split(s, ",") {
+		k, v, ok := strings.Cut(kv, "=")
+		if !ok || strings.TrimSpace(k) == "" {
+			return nil, fmt.Errorf("invalid header %q, expected Name=value", kv)
+		}
+		headers[strings.TrimSpace(k)] = strings.TrimSpace(v)
+	}
+	return headers, nil
+}
+
+func (s *Server) tlsConfig() (*tls.Config, error) {
+	tc := &tls.Config{
+		ServerName: s.ServerName,
+	}
+	if !s.VerifySSL {
+		log.WithFields(log.Fields{
+			"app": "tdarr_exporter",
+			"fn":  "tlsConfig",
+		}).Warn("disabling SSL verification")
+		tc.InsecureSkipVerify = true
+	}
+	if s.CAFile != "" {
+		pem, err := os.ReadFile(s.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", s.CAFile)
+		}
+		tc.RootCAs = pool
+	}
+	if (s.CertFile == "") != (s.KeyFile == "") {
+		return nil, errors.New("client certificate requires both a cert and a key file")
+	}
+	if s.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(s.CertFile, s.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		tc.Certificates = []tls.Certificate{cert}
+	}
+	return tc, nil
+}
+
+// headerTransport adds the server's extra headers to every request.
+type headerTransport struct {
+	headers map[string]string
+	next    http.RoundTripper
+}
+
+func (t *headerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// a RoundTripper must not modify the caller's request
+	req = req.Clone(req.Context())
+	for k, v := range t.headers {
+		req.Header.Set(k, v)
+	}
+	return t.next.RoundTrip(req)
+}
+
+// newRequestID returns a random ID for a request to the server. It's sent
+// in the X-Request-ID header and logged as request_id, so that a request
+// can be matched with the logs of tdarr or of a reverse proxy in front of
+// it.
+func newRequestID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// BuildClient creates the HTTP client used for every request to the server,
+// from its TLS, proxy and header options. It's called by NewServerFromEnv,
+// and must be called again if the options of a server are changed.
+func (s *Server) BuildClient() error {
+	tc, err := s.tlsConfig()
+	if err != nil {
+		return err
+	}
+	connect := orDefault(s.ConnectTimeout, time.Second*5)
+	dialer := &net.Dialer{
+		Timeout:   connect,
+		KeepAlive: time.Second * 30,
+	}
+	// the client is reused for every cycle, so connections are kept alive
+	// in between rather than re-established each time
+	t := &http.Transport{
+		DialContext:           dialer.DialContext,
+		TLSClientConfig:       tc,
+		TLSHandshakeTimeout:   connect,
+		ResponseHeaderTimeout: s.ResponseHeaderTimeout,
+		MaxIdleConns:          10,
+		MaxIdleConnsPerHost:   10,
+		IdleConnTimeout:       time.Minute * 5,
+		ExpectContinueTimeout: time.Second,
+		// a custom TLS config or dialer otherwise disables HTTP/2
+		ForceAttemptHTTP2: true,
+	}
+	t.Proxy = http.ProxyFromEnvironment
+	if s.ProxyURL != "" {
+		u, err := url.Parse(s.ProxyURL)
+		if err != nil {
+			return fmt.Errorf("invalid proxy url: %w", err)
+		}
+		t.Proxy = http.ProxyURL(u)
+	}
+	var rt http.RoundTripper = t
+	if len(s.Headers) > 0 {
+		rt = &headerTransport{headers: s.Headers, next: rt}
+	}
+	// inside the limits, so that a request whose deadline passes while it
+	// waits for a slot or its turn isn't counted as a failure of tdarr
+	if s.BreakerFailures > 0 {
+		rt = newBreakerTransport(s.BreakerFailures, orDefault(s.BreakerBackoff, time.Second*30), s.BreakerMaxBackoff, rt)
+	}
+	if s.MaxConcurrentRequests > 0 {
+		rt = &limitTransport{slots: make(chan struct{}, s.MaxConcurrentRequests), next: rt}
+	}
+	if s.RateLimit > 0 {
+		rt = newRateTransport(s.RateLimit, max(s.RateBurst, 1), rt)
+	}
+	s.flight = &singleflight.Group{}
+	// requests are bounded by their context rather than a client wide
+	// timeout, so that a collector can be given longer than the others
+	s.httpClient = &http.Client{Transport: rt}
+	return nil
+}
+
+// requestContext bounds a request made with ctx by the server's Timeout,
+// unless ctx already has a deadline.
+func (s *Server) requestContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if _, ok := ctx.Deadline(); ok {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, orDefault(s.Timeout, time.Second*10))
+}
+
+// limitTransport caps the number of requests in flight, so that the
+// collectors running at once don't overload tdarr. Requests wait for a slot
+// until their context is done.
+type limitTransport struct {
+	slots chan struct{}
+	next  http.RoundTripper
+}
+
+func (t *limitTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	prom.UpstreamRequestsWaiting.Inc()
+	select {
+	case t.slots <- struct{}{}:
+		prom.UpstreamRequestsWaiting.Dec()
+	case <-req.Context().Done():
+		prom.UpstreamRequestsWaiting.Dec()
+		return nil, req.Context().Err()
+	}
+	prom.UpstreamRequestsInFlight.Inc()
+	res, err := t.next.RoundTrip(req)
+	if err != nil {
+		t.release()
+		return nil, err
+	}
+	// the slot is held until the body is read, as tdarr is still sending it
+	res.Body = &releaseBody{ReadCloser: res.Body, release: t.release}
+	return res, nil
+}
+
+func (t *limitTransport) release() {
+	prom.UpstreamRequestsInFlight.Dec()
+	<-t.slots
+}
+
+type releaseBody struct {
+	io.ReadCloser
+	once    sync.Once
+	release func()
+}
+
+func (b *releaseBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.release)
+	return err
+}
+
+// rateTransport is a token bucket, allowing rate requests per second with
+// bursts of up to burst requests. Requests over the rate wait for a token
+// until their context is done.
+type rateTransport struct {
+	rate  float64
+	burst float64
+	next  http.RoundTripper
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+func newRateTransport(rate float64, burst int, next http.RoundTripper) *rateTransport {
+	return &rateTransport{
+		rate:   rate,
+		burst:  float64(burst),
+		next:   next,
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// reserve takes a token and returns how long to wait until it is
+// available. The bucket goes negative while tokens are reserved.
+func (t *rateTransport) reserve() time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := time.Now()
+	t.tokens = min(t.burst, t.tokens+now.Sub(t.last).Seconds()*t.rate)
+	t.last = now
+	t.tokens--
+	if t.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-t.tokens / t.rate * float64(time.Second))
+}
+
+func (t *rateTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if wait := t.reserve(); wait > 0 {
+		prom.UpstreamRequestsThrottled.Inc()
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-req.Context().Done():
+			timer.Stop()
+			// give the token back to the requests behind
+			t.mu.Lock()
+			t.tokens++
+			t.mu.Unlock()
+			return nil, req.Context().Err()
+		}
+	}
+	return t.next.RoundTrip(req)
+}
+
+func orDefault(d, def time.Duration) time.Duration {
+	if d == 0 {
+		return def
+	}
+	return d
+}
+
+// client returns the server's HTTP client, building it on first use for
+// servers which weren't created by NewServerFromEnv.
+func (s *Server) client() *http.Client {
+	if s.httpClient == nil {
+		if err := s.BuildClient(); err != nil {
+			log.WithFields(log.Fields{
+				"app": "tdarr_exporter",
+				"fn":  "client",
+			}).WithError(err).Error("error creating http client, using defaults")
+			return &http.Client{}
+		}
+	}
+	return s.httpClient
+}
@@ -0,0 +1,203 @@
+package tdarr
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/robertlestak/tdarr_exporter/internal/logging"
+	"github.com/robertlestak/tdarr_exporter/internal/prom"
+	log "github.com/sirupsen/logrus"
+)
+
+// Tdarr's server isn't open source, so the documents below only declare
+// the fields the exporter uses, as seen in the responses of the cruddb API.
+// Unknown fields are ignored.
+
+type LibrarySettings struct {
+	ID             string `json:"_id"`
+	Name           string `json:"name"`
+	Folder         string `json:"folder"`
+	ProcessLibrary bool   `json:"processLibrary"`
+	ScanOnStart    bool   `json:"scanOnStart"`
+	FolderWatching bool   `json:"folderWatching"`
+	Priority       int    `json:"priority"`
+}
+
+type GlobalSettings struct {
+	PauseAllNodes bool `json:"pauseAllNodes"`
+}
+
+type StagedFile struct {
+	ID string `json:"_id"`
+	// DB is the ID of the library the file belongs to
+	DB string `json:"DB"`
+}
+
+type Job struct {
+	ID     string `json:"_id"`
+	Type   string `json:"type"`
+	Status string `json:"status"`
+}
+
+// File is a file of a library, with the streams ffprobe found in it.
+type File struct {
+	ID string `json:"_id"`
+	// DB is the ID of the library the file belongs to
+	DB          string `json:"DB"`
+	FFProbeData struct {
+		Streams []Stream `json:"streams"`
+	} `json:"ffProbeData"`
+}
+
+type Stream struct {
+	// CodecType is video, audio, subtitle, data or attachment
+	CodecType string `json:"codec_type"`
+	Tags      struct {
+		Language string `json:"language"`
+	} `json:"tags"`
+}
+
+// CrudDB posts a request to the cruddb API and decodes the response into
+// out. The request is cancelled when ctx is done. Identical requests made
+// while one is in flight share its response. The shared request isn't
+// cancelled with the context of the caller which made it, so that the
+// others don't fail with it: it runs until the later of that caller's
+// deadline and the server's Timeout, and each caller stops waiting for it
+// when its own context is done.
+func (s *Server) CrudDB(ctx context.Context, r TdarrStatsRequest, out any) error {
+	l := log.WithFields(log.Fields{
+		"app":        "tdarr_exporter",
+		"fn":         "CrudDB",
+		"collection": r.Collection,
+		"mode":       r.Mode,
+	})
+	reqJson, err := json.Marshal(TdarrStatsRequestData{Data: r})
+	if err != nil {
+		l.WithError(err).Error("error marshalling request")
+		return err
+	}
+	var bd []byte
+	c := s.client()
+	if s.flight == nil {
+		bd, err = s.post(ctx, c, reqJson, l)
+	} else {
+		leader := false
+		ch := s.flight.DoChan(string(reqJson), func() (any, error) {
+			leader = true
+			sctx, cancel := s.sharedContext(ctx)
+			defer cancel()
+			return s.post(sctx, c, reqJson, l)
+		})
+		select {
+		case res := <-ch:
+			if res.Shared && !leader {
+				l.Debug("coalesced request")
+				prom.UpstreamRequestsCoalesced.Inc()
+			}
+			bd, _ = res.Val.([]byte)
+			err = res.Err
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(bd, out); err != nil {
+		l.WithError(err).Error("error unmarshalling response body")
+		return err
+	}
+	return nil
+}
+
+// sharedContext returns the context of a request shared by the callers
+// making it, which keeps the values of ctx but not its cancellation.
+func (s *Server) sharedContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	timeout := orDefault(s.Timeout, time.Second*10)
+	if dl, ok := ctx.Deadline(); ok {
+		timeout = max(timeout, time.Until(dl))
+	}
+	return context.WithTimeout(context.WithoutCancel(ctx), timeout)
+}
+
+// post makes a cruddb request and returns the response body.
+func (s *Server) post(ctx context.Context, c *http.Client, reqJson []byte, l *log.Entry) ([]byte, error) {
+	u := s.Host + "/api/v2/cruddb"
+	id := newRequestID()
+	l = l.WithField("request_id", id)
+	l.WithField("url", u).Debug("making request")
+	ctx, cancel := s.requestContext(ctx)
+	defer cancel()
+	if log.GetLevel() == log.DebugLevel {
+		// log the request body
+		l.WithField("body", logging.Body(reqJson)).Debug("request body")
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", u, bytes.NewBuffer(reqJson))
+	if err != nil {
+		l.WithError(err).Error("error creating request")
+		return nil, err
+	}
+	req.Header.Add("content-type", "application/json")
+	req.Header.Set("X-Request-ID", id)
+	res, err := c.Do(req)
+	if err != nil {
+		l.WithError(err).Error("error making request")
+		return nil, err
+	}
+	defer res.Body.Close()
+	bd, err := io.ReadAll(res.Body)
+	if err != nil {
+		l.WithError(err).Error("error reading response body")
+		return nil, err
+	}
+	if log.GetLevel() == log.DebugLevel {
+		// log the response body
+		l.WithField("body", logging.Body(bd)).Debug("response body")
+	}
+	if res.StatusCode != http.StatusOK {
+		err := &StatusError{Code: res.StatusCode, Status: res.Status}
+		l.WithError(err).Error("error making request")
+		return nil, err
+	}
+	return bd, nil
+}
+
+func (s *Server) GetLibrarySettings(ctx context.Context) ([]LibrarySettings, error) {
+	var libs []LibrarySettings
+	err := s.CrudDB(ctx, TdarrStatsRequest{Collection: "LibrarySettingsJSONDB", Mode: "getAll"}, &libs)
+	return libs, err
+}
+
+func (s *Server) GetGlobalSettings(ctx context.Context) (GlobalSettings, error) {
+	var gs GlobalSettings
+	err := s.CrudDB(ctx, TdarrStatsRequest{Collection: "SettingsGlobalJSONDB", Mode: "getById", DocID: "globalsettings"}, &gs)
+	return gs, err
+}
+
+// GetStaged returns the files staged for processing.
+func (s *Server) GetStaged(ctx context.Context) ([]StagedFile, error) {
+	var staged []StagedFile
+	err := s.CrudDB(ctx, TdarrStatsRequest{Collection: "StagedJSONDB", Mode: "getAll"}, &staged)
+	return staged, err
+}
+
+// GetJobs returns the job history. It can be large, as tdarr keeps a job
+// for every transcode and health check it has run.
+func (s *Server) GetJobs(ctx context.Context) ([]Job, error) {
+	var jobs []Job
+	err := s.CrudDB(ctx, TdarrStatsRequest{Collection: "JobsJSONDB", Mode: "getAll"}, &jobs)
+	return jobs, err
+}
+
+// GetFiles returns every file of every library. The whole file DB is
+// fetched and held in memory while it's decoded, so it can take a while for
+// large libraries.
+func (s *Server) GetFiles(ctx context.Context) ([]File, error) {
+	var files []File
+	err := s.CrudDB(ctx, TdarrStatsRequest{Collection: "FileJSONDB", Mode: "getAll"}, &files)
+	return files, err
+}
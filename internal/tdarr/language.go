@@ -0,0 +1,84 @@
+package tdarr
+
+import "strings"
+
+// LanguageUndetermined is the language of streams without a language tag.
+const LanguageUndetermined = "und"
+
+// NormalizeLanguage returns the ISO 639-2/B code of a language tag, so that
+// en, eng and en-US are all reported as eng, and de, deu and ger as ger.
+// The bibliographic codes are used as they're the ones Matroska and ffmpeg
+// write. Tags which aren't known are lowercased and kept as they are.
+func NormalizeLanguage(tag string) string {
+	tag = strings.ToLower(strings.TrimSpace(tag))
+	// drop a region or script, as in en-US or zh_Hant
+	if i := strings.IndexAny(tag, "-_"); i > 0 {
+		tag = tag[:i]
+	}
+	if tag == "" {
+		return LanguageUndetermined
+	}
+	if b, ok := iso6391[tag]; ok {
+		return b
+	}
+	if b, ok := iso6392T[tag]; ok {
+		return b
+	}
+	return tag
+}
+
+// NormalizedLanguages returns the language counts of the statistics
+// document by normalized language, summing the counts of tags which
+// normalize to the same language.
+func (r *TdarrStatsResponse) NormalizedLanguages() map[string]int {
+	langs := make(map[string]int, len(r.Languages))
+	for k, v := range r.Languages {
+		langs[NormalizeLanguage(k)] += v.Count
+	}
+	return langs
+}
+
+// iso6391 maps ISO 639-1 codes, and a few deprecated ones, to ISO 639-2/B.
+var iso6391 = map[string]string{
+	"aa": "aar", "ab": "abk", "ae": "ave", "af": "afr", "ak": "aka", "am": "amh",
+	"an": "arg", "ar": "ara", "as": "asm", "av": "ava", "ay": "aym", "az": "aze",
+	"ba": "bak", "be": "bel", "bg": "bul", "bh": "bih", "bi": "bis", "bm": "bam",
+	"bn": "ben", "bo": "tib", "br": "bre", "bs": "bos", "ca": "cat", "ce": "che",
+	"ch": "cha", "co": "cos", "cr": "cre", "cs": "cze", "cu": "chu", "cv": "chv",
+	"cy": "wel", "da": "dan", "de": "ger", "dv": "div", "dz": "dzo", "ee": "ewe",
+	"el": "gre", "en": "eng", "eo": "epo", "es": "spa", "et": "est", "eu": "baq",
+	"fa": "per", "ff": "ful", "fi": "fin", "fj": "fij", "fo": "fao", "fr": "fre",
+	"fy": "fry", "ga": "gle", "gd": "gla", "gl": "glg", "gn": "grn", "gu": "guj",
+	"gv": "glv", "ha": "hau", "he": "heb", "hi": "hin", "ho": "hmo", "hr": "hrv",
+	"ht": "hat", "hu": "hun", "hy": "arm", "hz": "her", "ia": "ina", "id": "ind",
+	"ie": "ile", "ig": "ibo", "ii": "iii", "ik": "ipk", "io": "ido", "is": "ice",
+	"it": "ita", "iu": "iku", "ja": "jpn", "jv": "jav", "ka": "geo", "kg": "kon",
+	"ki": "kik", "kj": "kua", "kk": "kaz", "kl": "kal", "km": "khm", "kn": "kan",
+	"ko": "kor", "kr": "kau", "ks": "kas", "ku": "kur", "kv": "kom", "kw": "cor",
+	"ky": "kir", "la": "lat", "lb": "ltz", "lg": "lug", "li": "lim", "ln": "lin",
+	"lo": "lao", "lt": "lit", "lu": "lub", "lv": "lav", "mg": "mlg", "mh": "mah",
+	"mi": "mao", "mk": "mac", "ml": "mal", "mn": "mon", "mr": "mar", "ms": "may",
+	"mt": "mlt", "my": "bur", "na": "nau", "nb": "nob", "nd": "nde", "ne": "nep",
+	"ng": "ndo", "nl": "dut", "nn": "nno", "no": "nor", "nr": "nbl", "nv": "nav",
+	"ny": "nya", "oc": "oci", "oj": "oji", "om": "orm", "or": "ori", "os": "oss",
+	"pa": "pan", "pi": "pli", "pl": "pol", "ps": "pus", "pt": "por", "qu": "que",
+	"rm": "roh", "rn": "run", "ro": "rum", "ru": "rus", "rw": "kin", "sa": "san",
+	"sc": "srd", "sd": "snd", "se": "sme", "sg": "sag", "si": "sin", "sk": "slo",
+	"sl": "slv", "sm": "smo", "sn": "sna", "so": "som", "sq": "alb", "sr": "srp",
+	"ss": "ssw", "st": "sot", "su": "sun", "sv": "swe", "sw": "swa", "ta": "tam",
+	"te": "tel", "tg": "tgk", "th": "tha", "ti": "tir", "tk": "tuk", "tl": "tgl",
+	"tn": "tsn", "to": "ton", "tr": "tur", "ts": "tso", "tt": "tat", "tw": "twi",
+	"ty": "tah", "ug": "uig", "uk": "ukr", "ur": "urd", "uz": "uzb", "ve": "ven",
+	"vi": "vie", "vo": "vol", "wa": "wln", "wo": "wol", "xh": "xho", "yi": "yid",
+	"yo": "yor", "za": "zha", "zh": "chi", "zu": "zul",
+	// deprecated
+	"iw": "heb", "in": "ind", "ji": "yid",
+}
+
+// iso6392T maps the ISO 639-2/T codes which differ from their /B code.
+var iso6392T = map[string]string{
+	"bod": "tib", "ces": "cze", "cym": "wel", "deu": "ger", "ell": "gre",
+	"eus": "baq", "fas": "per", "fra": "fre", "hye": "arm", "isl": "ice",
+	"kat": "geo", "mkd": "mac", "mri": "mao", "msa": "may", "mya": "bur",
+	"nld": "dut", "ron": "rum", "slk": "slo", "sqi": "alb", "zho": "chi",
+}
@@ -0,0 +1,58 @@
+package tdarr
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestNormalizeLanguage(t *testing.T) {
+	for tag, want := range map[string]string{
+		// ISO 639-1
+		"en": "eng",
+		"de": "ger",
+		"fr": "fre",
+		"zh": "chi",
+		// deprecated ISO 639-1
+		"iw": "heb",
+		// ISO 639-2/T
+		"deu": "ger",
+		"fra": "fre",
+		"zho": "chi",
+		"ces": "cze",
+		// ISO 639-2/B, and codes which are the same in /B and /T
+		"ger": "ger",
+		"eng": "eng",
+		"jpn": "jpn",
+		// regions, scripts, case and space
+		"en-US":   "eng",
+		"zh_Hant": "chi",
+		" DE ":    "ger",
+		"ENG":     "eng",
+		// unknown codes are lowercased and kept
+		"Klingon": "klingon",
+		"tlh":     "tlh",
+		"xx":      "xx",
+		// no language
+		"":    LanguageUndetermined,
+		"  ":  LanguageUndetermined,
+		"und": LanguageUndetermined,
+	} {
+		if got := NormalizeLanguage(tag); got != want {
+			t.Errorf("%q: got %q, want %q", tag, got, want)
+		}
+	}
+}
+
+func TestNormalizedLanguages(t *testing.T) {
+	r := &TdarrStatsResponse{Languages: map[string]LanguageMetric{
+		"en":    {Count: 1},
+		"eng":   {Count: 2},
+		"en-GB": {Count: 3},
+		"deu":   {Count: 4},
+		"":      {Count: 5},
+	}}
+	want := map[string]int{"eng": 6, "ger": 4, "und": 5}
+	if got := r.NormalizedLanguages(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
@@ -1,23 +1,67 @@
 package tdarr
 
 import (
-	"bytes"
-	"crypto/tls"
+	"context"
 	"encoding/json"
+	"fmt"
 	"io"
 	"net/http"
 	"os"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 
-	"github.com/robertlestak/tdarr_exporter/internal/prom"
+	"github.com/robertlestak/tdarr_exporter/internal/logging"
 	log "github.com/sirupsen/logrus"
+	"golang.org/x/sync/singleflight"
 )
 
 type Server struct {
 	Host      string
 	VerifySSL bool
 	Interval  time.Duration
+	// CAFile is a PEM bundle of CAs trusted in addition to the system pool
+	CAFile string
+	// CertFile and KeyFile are a client certificate presented to tdarr, or
+	// to a reverse proxy in front of it
+	CertFile string
+	KeyFile  string
+	// ServerName overrides the name used for SNI and certificate
+	// verification
+	ServerName string
+	// ProxyURL is the proxy used to reach tdarr. If empty, the
+	// HTTP_PROXY, HTTPS_PROXY and NO_PROXY variables are used.
+	ProxyURL string
+	// Headers are added to every request, eg for proxy authentication
+	Headers map[string]string
+	// ConnectTimeout bounds establishing a connection, including the TLS
+	// handshake
+	ConnectTimeout time.Duration
+	// ResponseHeaderTimeout bounds waiting for tdarr to start responding,
+	// 0 to leave it to the request's context
+	ResponseHeaderTimeout time.Duration
+	// Timeout is the default timeout of the collectors, and bounds the
+	// requests made without a deadline
+	Timeout time.Duration
+	// MaxConcurrentRequests caps the requests in flight to the server, 0
+	// for no limit
+	MaxConcurrentRequests int
+	// RateLimit is the number of requests per second allowed to the
+	// server, with bursts of up to RateBurst. 0 for no limit.
+	RateLimit float64
+	RateBurst int
+	// BreakerFailures is the number of consecutive failed requests which
+	// open the circuit breaker, 0 to disable it. It stays open for
+	// BreakerBackoff, doubling up to BreakerMaxBackoff while tdarr keeps
+	// failing.
+	BreakerFailures   int
+	BreakerBackoff    time.Duration
+	BreakerMaxBackoff time.Duration
+
+	httpClient *http.Client
+	// flight coalesces identical cruddb requests in flight
+	flight *singleflight.Group
 }
 
 func NewServerFromEnv() Server {
@@ -34,6 +78,8 @@ func NewServerFromEnv() Server {
 		s.Host = "http://tdarr:8265"
 		l.WithField("host", s.Host).Warnf("TDARR_HOST not set, defaulting to %s", s.Host)
 	}
+	logging.SetServer(s.Host)
+	KnownLoadStatuses = knownLoadStatusesFromEnv()
 	if os.Getenv("TDARR_INTERVAL") != "" {
 		d, err := time.ParseDuration(os.Getenv("TDARR_INTERVAL"))
 		if err != nil {
@@ -45,13 +91,86 @@ func NewServerFromEnv() Server {
 		s.Interval = time.Minute
 		l.WithField("interval", s.Interval).Warnf("TDARR_INTERVAL not set, defaulting to %s", s.Interval)
 	}
+	for _, t := range []struct {
+		env string
+		d   *time.Duration
+		def time.Duration
+	}{
+		{"TDARR_CONNECT_TIMEOUT", &s.ConnectTimeout, time.Second * 5},
+		{"TDARR_RESPONSE_HEADER_TIMEOUT", &s.ResponseHeaderTimeout, 0},
+		{"TDARR_TIMEOUT", &s.Timeout, time.Second * 10},
+		{"TDARR_BREAKER_BACKOFF", &s.BreakerBackoff, time.Second * 30},
+		{"TDARR_BREAKER_MAX_BACKOFF", &s.BreakerMaxBackoff, time.Minute * 5},
+	} {
+		*t.d = t.def
+		if v := os.Getenv(t.env); v != "" {
+			d, err := time.ParseDuration(v)
+			if err != nil {
+				l.WithError(err).Errorf("error parsing %s", t.env)
+				os.Exit(1)
+			}
+			*t.d = d
+		}
+	}
+	s.MaxConcurrentRequests = 2
+	if v := os.Getenv("TDARR_MAX_CONCURRENT_REQUESTS"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			l.WithField("value", v).Error("invalid TDARR_MAX_CONCURRENT_REQUESTS")
+			os.Exit(1)
+		}
+		s.MaxConcurrentRequests = n
+	}
+	if v := os.Getenv("TDARR_RATE_LIMIT"); v != "" {
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil || f < 0 {
+			l.WithField("value", v).Error("invalid TDARR_RATE_LIMIT")
+			os.Exit(1)
+		}
+		s.RateLimit = f
+	}
+	s.RateBurst = 1
+	if v := os.Getenv("TDARR_RATE_BURST"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			l.WithField("value", v).Error("invalid TDARR_RATE_BURST")
+			os.Exit(1)
+		}
+		s.RateBurst = n
+	}
+	s.BreakerFailures = 5
+	if v := os.Getenv("TDARR_BREAKER_FAILURES"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			l.WithField("value", v).Error("invalid TDARR_BREAKER_FAILURES")
+			os.Exit(1)
+		}
+		s.BreakerFailures = n
+	}
+	s.CAFile = os.Getenv("TDARR_CA_FILE")
+	s.CertFile = os.Getenv("TDARR_CERT_FILE")
+	s.KeyFile = os.Getenv("TDARR_KEY_FILE")
+	s.ServerName = os.Getenv("TDARR_SERVER_NAME")
+	s.ProxyURL = os.Getenv("TDARR_PROXY")
+	if h := os.Getenv("TDARR_HEADERS"); h != "" {
+		headers, err := parseHeaders(h)
+		if err != nil {
+			l.WithError(err).Error("error parsing headers")
+			os.Exit(1)
+		}
+		s.Headers = headers
+	}
+	if err := s.BuildClient(); err != nil {
+		l.WithError(err).Error("error creating http client")
+		os.Exit(1)
+	}
 	return s
 }
 
 type TdarrStatsRequest struct {
 	Collection string `json:"collection"`
 	Mode       string `json:"mode"`
-	DocID      string `json:"docID"`
+	DocID      string `json:"docID,omitempty"`
 }
 
 type TdarrStatsRequestData struct {
@@ -131,8 +250,72 @@ type TdarrStatsResponse struct {
 	} `json:"streamStats"`
 	AvgNumberOfStreamsInVideo float64                   `json:"avgNumberOfStreamsInVideo"`
 	Languages                 map[string]LanguageMetric `json:"languages"`
+	// FetchedAt is the time the stats were retrieved from tdarr
+	FetchedAt time.Time `json:"-"`
+	// loadStatus is DBLoadStatus as exported, set by GetStats
+	loadStatus string
+	// Nodes are the nodes connected to the server, as returned by GetNodes.
+	// nil if they could not be retrieved.
+	Nodes map[string]Node `json:"-"`
+}
+
+type Worker struct {
+	ID         string  `json:"_id"`
+	File       string  `json:"file"`
+	Percentage float64 `json:"percentage"`
+	WorkerType string  `json:"workerType"`
+	Idle       bool    `json:"idle"`
+	FPS        float64 `json:"fps"`
+	ETA        string  `json:"ETA"`
+	Status     string  `json:"status"`
+}
+
+type Node struct {
+	ID            string            `json:"_id"`
+	NodeName      string            `json:"nodeName"`
+	RemoteAddress string            `json:"remoteAddress"`
+	NodePaused    bool              `json:"nodePaused"`
+	WorkerLimits  map[string]int    `json:"workerLimits"`
+	Workers       map[string]Worker `json:"workers"`
 }
 
+// Name returns the node name, falling back to the ID for unnamed nodes.
+func (n Node) Name() string {
+	if n.NodeName != "" {
+		return n.NodeName
+	}
+	return n.ID
+}
+
+// parsePieHeader reads the library, ID and totals at the start of a pie,
+// which tdarr sends as an untyped array.
+func parsePieHeader(pie []interface{}) (CategoryInfo, error) {
+	var (
+		c       CategoryInfo
+		ok      bool
+		numbers [4]float64
+	)
+	if c.Library, ok = pie[0].(string); !ok {
+		return c, fmt.Errorf("invalid library name %v", pie[0])
+	}
+	if c.ID, ok = pie[1].(string); !ok {
+		return c, fmt.Errorf("invalid ID %v of library %s", pie[1], c.Library)
+	}
+	for i := range numbers {
+		if numbers[i], ok = pie[i+2].(float64); !ok {
+			return c, fmt.Errorf("invalid element %d %v of library %s", i+2, pie[i+2], c.Library)
+		}
+	}
+	c.TotalFileCount = int(numbers[0])
+	c.TotalTranscodeCount = int(numbers[1])
+	c.SizeDiff = numbers[2]
+	c.TotalHealthCheckCount = int(numbers[3])
+	return c, nil
+}
+
+// ParsePies parses the per library breakdowns of the statistics document.
+// Pies which aren't arrays are skipped, and an error is returned if a pie
+// has elements of the wrong type.
 func (r *TdarrStatsResponse) ParsePies() error {
 	l := log.WithFields(log.Fields{
 		"app": "tdarr_exporter",
@@ -145,42 +328,46 @@ func (r *TdarrStatsResponse) ParsePies() error {
 	for _, pie := range r.Pies {
 		pieArray, ok := pie.([]interface{})
 		if !ok {
-			l.Warn("Invalid pie format: not an array")
+			logging.Warn(l, "Invalid pie format: not an array")
 			continue
 		}
 
 		if len(pieArray) < 7 {
-			l.Warn("Invalid pie format: not enough elements")
+			logging.Warn(l, "Invalid pie format: not enough elements")
 			continue
 		}
 
-		c := CategoryInfo{
-			Library:               pieArray[0].(string),
-			ID:                    pieArray[1].(string),
-			TotalFileCount:        int(pieArray[2].(float64)),
-			TotalTranscodeCount:   int(pieArray[3].(float64)),
-			SizeDiff:              pieArray[4].(float64),
-			TotalHealthCheckCount: int(pieArray[5].(float64)),
+		c, err := parsePieHeader(pieArray)
+		if err != nil {
+			l.WithError(err).Error("error parsing pie")
+			return err
 		}
 
 		// Parse the slices
 		for i := 6; i < len(pieArray); i++ {
 			subArray, ok := pieArray[i].([]interface{})
 			if !ok {
-				l.Warn("Invalid sub-array format")
+				logging.Warn(l, "Invalid sub-array format")
 				continue
 			}
 
 			for _, subElement := range subArray {
 				subMap, ok := subElement.(map[string]interface{})
 				if !ok {
-					l.Warn("Invalid sub-map format")
+					logging.Warn(l, "Invalid sub-map format")
 					continue
 				}
 
 				var transcodeInfo TranscodeInfo
-				transcodeInfo.Name = subMap["name"].(string)
-				transcodeInfo.Value = int(subMap["value"].(float64))
+				name, ok := subMap["name"].(string)
+				value, vok := subMap["value"].(float64)
+				if !ok || !vok {
+					err := fmt.Errorf("invalid entry %v in slice %d of library %s", subMap, i, c.Library)
+					l.WithError(err).Error("error parsing pie")
+					return err
+				}
+				transcodeInfo.Name = name
+				transcodeInfo.Value = int(value)
 
 				switch i {
 				case 6:
@@ -209,180 +396,183 @@ func (r *TdarrStatsResponse) ParsePies() error {
 	return nil
 }
 
-func (s *Server) GetStats() (TdarrStatsResponse, error) {
+// GetStats fetches and parses the statistics document. The request is
+// cancelled when ctx is done.
+func (s *Server) GetStats(ctx context.Context) (TdarrStatsResponse, error) {
 	l := log.WithFields(log.Fields{
 		"app": "tdarr_exporter",
 		"fn":  "GetStats",
 	})
 	var tdarrStatsResponse TdarrStatsResponse
 	l.Debug("getting stats from tdarr")
-	u := s.Host + "/api/v2/cruddb"
-	l.WithField("url", u).Debug("making request")
 	statReq := TdarrStatsRequest{
 		Collection: "StatisticsJSONDB",
 		Mode:       "getById",
 		DocID:      "statistics",
 	}
-	dataWrapper := TdarrStatsRequestData{
-		Data: statReq,
+	if err := s.CrudDB(ctx, statReq, &tdarrStatsResponse); err != nil {
+		return tdarrStatsResponse, err
 	}
-	reqJson, err := json.Marshal(dataWrapper)
+	tdarrStatsResponse.FetchedAt = time.Now()
+	tdarrStatsResponse.loadStatus = tdarrStatsResponse.knownLoadStatus()
+	l.Debug("parsing pies")
+	err := tdarrStatsResponse.ParsePies()
 	if err != nil {
-		l.WithError(err).Error("error marshalling request")
+		l.WithError(err).Error("error parsing pies")
 		return tdarrStatsResponse, err
 	}
-	if log.GetLevel() == log.DebugLevel {
-		// log the request body
-		l.WithField("body", string(reqJson)).Debug("request body")
-	}
-	req, err := http.NewRequest("POST", u, bytes.NewBuffer(reqJson))
+	return tdarrStatsResponse, err
+}
+
+// GetNodes returns the nodes currently connected to the server, keyed by
+// node ID. Nodes which have gone offline are not included.
+func (s *Server) GetNodes(ctx context.Context) (map[string]Node, error) {
+	l := log.WithFields(log.Fields{
+		"app": "tdarr_exporter",
+		"fn":  "GetNodes",
+	})
+	var nodes map[string]Node
+	u := s.Host + "/api/v2/get-nodes"
+	id := newRequestID()
+	l = l.WithField("request_id", id)
+	l.WithField("url", u).Debug("making request")
+	ctx, cancel := s.requestContext(ctx)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", u, nil)
 	if err != nil {
 		l.WithError(err).Error("error creating request")
-		return tdarrStatsResponse, err
-	}
-	l.Debug("setting request headers")
-	req.Header.Add("content-type", "application/json")
-	// use default http client
-	c := http.DefaultClient
-	// set 10s timeout
-	c.Timeout = time.Second * 10
-	if !s.VerifySSL {
-		l.Warn("disabling SSL verification")
-		c.Transport = &http.Transport{
-			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
-		}
+		return nil, err
 	}
-	l.Debug("making request")
-	res, err := c.Do(req)
+	req.Header.Set("X-Request-ID", id)
+	res, err := s.client().Do(req)
 	if err != nil {
 		l.WithError(err).Error("error making request")
-		return tdarrStatsResponse, err
+		return nil, err
 	}
-	l.Debug("reading response body")
 	defer res.Body.Close()
 	bd, err := io.ReadAll(res.Body)
 	if err != nil {
 		l.WithError(err).Error("error reading response body")
-		return tdarrStatsResponse, err
+		return nil, err
 	}
 	if log.GetLevel() == log.DebugLevel {
 		// log the response body
-		l.WithField("body", string(bd)).Debug("response body")
+		l.WithField("body", logging.Body(bd)).Debug("response body")
 	}
-	err = json.Unmarshal(bd, &tdarrStatsResponse)
-	if err != nil {
-		l.WithError(err).Error("error unmarshalling response body")
-		return tdarrStatsResponse, err
+	if res.StatusCode != http.StatusOK {
+		err := &StatusError{Code: res.StatusCode, Status: res.Status}
+		l.WithError(err).Error("error making request")
+		return nil, err
 	}
-	l.Debug("parsing pies")
-	err = tdarrStatsResponse.ParsePies()
-	if err != nil {
-		l.WithError(err).Error("error parsing pies")
-		return tdarrStatsResponse, err
+	if err := json.Unmarshal(bd, &nodes); err != nil {
+		l.WithError(err).Error("error unmarshalling response body")
+		return nil, err
 	}
-	return tdarrStatsResponse, err
+	return nodes, nil
 }
 
-func (s *TdarrStatsResponse) LoadStatusFloat() float64 {
-	// There is no documentation on what the load status means
-	// I only see "Stable"
-	switch s.DBLoadStatus {
-	case "Stable":
-		return 0
-	default:
-		// log it so we can see what it is and add it to the switch
-		log.WithField("status", s.DBLoadStatus).Warn("unknown DBLoadStatus")
-		return 1
-	}
+// StatusError is returned for responses with a status other than 200.
+type StatusError struct {
+	Code   int
+	Status string
+}
+
+func (e *StatusError) Error() string {
+	return "tdarr returned " + e.Status
 }
 
-func (s *TdarrStatsResponse) ExportProm() error {
+// Status is the status of the server, as returned by /api/v2/status.
+type Status struct {
+	Status       string  `json:"status"`
+	IsProduction bool    `json:"isProduction"`
+	OS           string  `json:"os"`
+	Version      string  `json:"version"`
+	Uptime       float64 `json:"uptime"`
+}
+
+// GetStatus returns the status of the server. It's cheap, so it's used to
+// check that the server can be reached.
+func (s *Server) GetStatus(ctx context.Context) (Status, error) {
 	l := log.WithFields(log.Fields{
 		"app": "tdarr_exporter",
-		"fn":  "ExportProm",
+		"fn":  "GetStatus",
 	})
-	l.Debug("exporting prometheus metrics")
-	prom.TotalFileCount.Set(float64(s.TotalFileCount))
-	prom.TotalTranscodeCount.Set(float64(s.TotalTranscodeCount))
-	prom.TotalHealthCheckCount.Set(float64(s.TotalHealthCheckCount))
-	prom.SizeDiff.Set(s.SizeDiff)
-	// parse fetch time as duration
-	d, err := time.ParseDuration(s.DBFetchTime)
-	if err != nil {
-		l.WithError(err).Error("error parsing DBFetchTime")
-		return err
-	}
-	prom.DBFetchTime.Set(d.Seconds())
-	// parse load status as float
-	prom.DBLoadStatus.Set(s.LoadStatusFloat())
-	prom.DBQueue.Set(float64(s.DBQueue))
-	// parse tdarr score as float
-	tf, err := strconv.ParseFloat(s.TdarrScore, 64)
+	var st Status
+	u := s.Host + "/api/v2/status"
+	id := newRequestID()
+	l = l.WithField("request_id", id)
+	l.WithField("url", u).Debug("making request")
+	ctx, cancel := s.requestContext(ctx)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", u, nil)
 	if err != nil {
-		l.WithError(err).Error("error parsing TdarrScore")
-		return err
+		l.WithError(err).Error("error creating request")
+		return st, err
 	}
-	prom.TdarrScore.Set(tf)
-	hf, err := strconv.ParseFloat(s.HealthCheckScore, 64)
+	req.Header.Set("X-Request-ID", id)
+	res, err := s.client().Do(req)
 	if err != nil {
-		l.WithError(err).Error("error parsing HealthCheckScore")
-		return err
-	}
-	prom.HealthCheckScore.Set(hf)
-	prom.AverageNumberOfStreamsInVideo.Set(s.AvgNumberOfStreamsInVideo)
-	// set languages
-	for k, v := range s.Languages {
-		prom.Languages.WithLabelValues(k).Set(float64(v.Count))
-	}
-	prom.StreamStatsDurationAverage.Set(float64(s.StreamStats.Duration.Average))
-	prom.StreamStatsDurationHighest.Set(float64(s.StreamStats.Duration.Highest))
-	prom.StreamStatsDurationTotal.Set(float64(s.StreamStats.Duration.Total))
-	prom.StreamStatsBitrateAverage.Set(float64(s.StreamStats.BitRate.Average))
-	prom.StreamStatsBitrateAverage.Set(float64(s.StreamStats.BitRate.Highest))
-	prom.StreamStatsBitrateAverage.Set(float64(s.StreamStats.BitRate.Total))
-	prom.StreamStatsNbFramesAverage.Set(float64(s.StreamStats.NbFrames.Average))
-	prom.StreamStatsNbFramesHighest.Set(float64(s.StreamStats.NbFrames.Highest))
-	prom.StreamStatsNbFramesTotal.Set(float64(s.StreamStats.NbFrames.Total))
-	prom.Table0Count.Set(float64(s.Table0Count))
-	prom.Table1Count.Set(float64(s.Table1Count))
-	prom.Table2Count.Set(float64(s.Table2Count))
-	prom.Table3Count.Set(float64(s.Table3Count))
-	prom.Table4Count.Set(float64(s.Table4Count))
-	prom.Table5Count.Set(float64(s.Table5Count))
-	prom.Table6Count.Set(float64(s.Table6Count))
-	prom.Table0ViewableCount.Set(float64(s.Table0ViewableCount))
-	prom.Table1ViewableCount.Set(float64(s.Table1ViewableCount))
-	prom.Table2ViewableCount.Set(float64(s.Table2ViewableCount))
-	prom.Table3ViewableCount.Set(float64(s.Table3ViewableCount))
-	prom.Table4ViewableCount.Set(float64(s.Table4ViewableCount))
-	prom.Table5ViewableCount.Set(float64(s.Table5ViewableCount))
-	prom.Table6ViewableCount.Set(float64(s.Table6ViewableCount))
-	for _, c := range s.ParsedPies {
-		prom.LibraryTotalFileCount.WithLabelValues(c.Library, c.ID).Set(float64(c.TotalFileCount))
-		prom.LibraryTotalTranscodeCount.WithLabelValues(c.Library, c.ID).Set(float64(c.TotalTranscodeCount))
-		prom.LibraryTotalHealthCheckCount.WithLabelValues(c.Library, c.ID).Set(float64(c.TotalHealthCheckCount))
-		prom.LibrarySizeDiff.WithLabelValues(c.Library, c.ID).Set(c.SizeDiff)
-		for _, t := range c.TranscodeStatus {
-			prom.LibraryTranscodeStatus.WithLabelValues(c.Library, c.ID, t.Name).Set(float64(t.Value))
-		}
-		for _, h := range c.Health {
-			prom.LibraryHealth.WithLabelValues(c.Library, c.ID, h.Name).Set(float64(h.Value))
-		}
-		for _, v := range c.VideoCodec {
-			prom.LibraryVideoCodec.WithLabelValues(c.Library, c.ID, v.Name).Set(float64(v.Value))
-		}
-		for _, v := range c.Container {
-			prom.LibraryVideoContainer.WithLabelValues(c.Library, c.ID, v.Name).Set(float64(v.Value))
-		}
-		for _, r := range c.Resolution {
-			prom.LibraryVideoResolution.WithLabelValues(c.Library, c.ID, r.Name).Set(float64(r.Value))
-		}
-		for _, a := range c.AudioCodec {
-			prom.LibraryAudioCodec.WithLabelValues(c.Library, c.ID, a.Name).Set(float64(a.Value))
+		l.WithError(err).Error("error making request")
+		return st, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		err := &StatusError{Code: res.StatusCode, Status: res.Status}
+		l.WithError(err).Error("error making request")
+		return st, err
+	}
+	if err := json.NewDecoder(res.Body).Decode(&st); err != nil {
+		l.WithError(err).Error("error unmarshalling response body")
+		return st, err
+	}
+	return st, nil
+}
+
+// LoadStatusOther is reported for DB load statuses which aren't known.
+const LoadStatusOther = "other"
+
+// KnownLoadStatuses are the DB load statuses exported as states: "Stable",
+// and those declared with TDARR_DB_LOAD_STATUSES, read by
+// NewServerFromEnv. See the README for why the list isn't complete.
+var KnownLoadStatuses = []string{"Stable"}
+
+func knownLoadStatusesFromEnv() []string {
+	known := []string{"Stable"}
+	for _, st := range strings.Split(os.Getenv("TDARR_DB_LOAD_STATUSES"), ",") {
+		if st = strings.TrimSpace(st); st != "" && st != known[0] {
+			known = append(known, st)
 		}
-		for _, v := range c.AudioContainer {
-			prom.LibraryAudioContainer.WithLabelValues(c.Library, c.ID, v.Name).Set(float64(v.Value))
+	}
+	return known
+}
+
+// unknownLoadStatuses are the unknown DB load statuses already warned about.
+var unknownLoadStatuses sync.Map
+
+// LoadStatus returns the DB load status, or LoadStatusOther if it isn't one
+// of KnownLoadStatuses. It is worked out once, when the stats are fetched.
+func (s *TdarrStatsResponse) LoadStatus() string {
+	if s.loadStatus != "" {
+		return s.loadStatus
+	}
+	return s.knownLoadStatus()
+}
+
+// knownLoadStatus maps DBLoadStatus to the known statuses. The first time
+// an unknown status is seen it is logged, so that it can be added to the
+// known statuses.
+func (s *TdarrStatsResponse) knownLoadStatus() string {
+	for _, st := range KnownLoadStatuses {
+		if s.DBLoadStatus == st {
+			return st
 		}
 	}
-	return nil
+	if _, seen := unknownLoadStatuses.LoadOrStore(s.DBLoadStatus, true); !seen {
+		log.WithFields(log.Fields{
+			"app":    "tdarr_exporter",
+			"fn":     "LoadStatus",
+			"status": s.DBLoadStatus,
+		}).Warn("unknown DBLoadStatus, reporting it as other")
+	}
+	return LoadStatusOther
 }
@@ -0,0 +1,96 @@
+package tdarr
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+)
+
+func TestLoadStatus(t *testing.T) {
+	hook := test.NewGlobal()
+	defer func(known []string) { KnownLoadStatuses = known }(KnownLoadStatuses)
+	KnownLoadStatuses = []string{"Stable", "Busy"}
+	// forget the statuses warned about by earlier runs
+	unknownLoadStatuses.Range(func(k, _ any) bool {
+		unknownLoadStatuses.Delete(k)
+		return true
+	})
+	for _, tc := range []struct {
+		status string
+		want   string
+		// warned is whether the status is logged
+		warned bool
+	}{
+		{"Stable", "Stable", false},
+		{"Busy", "Busy", false},
+		{"Rebuilding", LoadStatusOther, true},
+		// unknown statuses are only logged the first time
+		{"Rebuilding", LoadStatusOther, false},
+		{"", LoadStatusOther, true},
+	} {
+		hook.Reset()
+		s := &TdarrStatsResponse{DBLoadStatus: tc.status}
+		if got := s.LoadStatus(); got != tc.want {
+			t.Errorf("%q: got %q, want %q", tc.status, got, tc.want)
+		}
+		var warned bool
+		for _, e := range hook.AllEntries() {
+			if e.Level == log.WarnLevel && e.Data["status"] == tc.status {
+				warned = true
+			}
+		}
+		if warned != tc.warned {
+			t.Errorf("%q: warned %v, want %v", tc.status, warned, tc.warned)
+		}
+	}
+}
+
+func TestParsePies(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		pies  string
+		want  []CategoryInfo
+		error bool
+	}{
+		{
+			name: "valid",
+			pies: `[["Movies", "lib1", 10, 4, 1.5, 6,
+				[{"name": "Transcode success", "value": 4}],
+				[{"name": "Success", "value": 6}],
+				[{"name": "hevc", "value": 10}]]]`,
+			want: []CategoryInfo{{
+				Library: "Movies", ID: "lib1", TotalFileCount: 10, TotalTranscodeCount: 4,
+				SizeDiff: 1.5, TotalHealthCheckCount: 6,
+				TranscodeStatus: []TranscodeInfo{{"Transcode success", 4}},
+				Health:          []TranscodeInfo{{"Success", 6}},
+				VideoCodec:      []TranscodeInfo{{"hevc", 10}},
+			}},
+		},
+		{
+			name: "pies which aren't arrays are skipped",
+			pies: `[null, {"library": "Movies"}, ["Movies", "lib1", 1, 0, 0, 0, []]]`,
+			want: []CategoryInfo{{Library: "Movies", ID: "lib1", TotalFileCount: 1}},
+		},
+		{name: "null library name", pies: `[[null, "lib1", 1, 0, 0, 0, []]]`, error: true},
+		{name: "count as a string", pies: `[["Movies", "lib1", "1", 0, 0, 0, []]]`, error: true},
+		{name: "null count", pies: `[["Movies", "lib1", 1, 0, null, 0, []]]`, error: true},
+		{name: "reshaped entry", pies: `[["Movies", "lib1", 1, 0, 0, 0, [{"label": "hevc", "count": 1}]]]`, error: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var r TdarrStatsResponse
+			if err := json.Unmarshal([]byte(tc.pies), &r.Pies); err != nil {
+				t.Fatal(err)
+			}
+			err := r.ParsePies()
+			if (err != nil) != tc.error {
+				t.Fatalf("got error %v", err)
+			}
+			if !tc.error && !reflect.DeepEqual(r.ParsedPies, tc.want) {
+				t.Errorf("got %+v, want %+v", r.ParsedPies, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,77 @@
+package web
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"os"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Config is the web config file, following the format of the prometheus
+// exporter-toolkit with the addition of unauthenticated_paths.
+type Config struct {
+	TLSServerConfig *TLSConfig        `yaml:"tls_server_config"`
+	BasicAuthUsers  map[string]string `yaml:"basic_auth_users"`
+	// UnauthenticatedPaths are served without basic auth, so that probes
+	// don't need credentials
+	UnauthenticatedPaths []string `yaml:"unauthenticated_paths"`
+}
+
+type TLSConfig struct {
+	CertFile       string `yaml:"cert_file"`
+	KeyFile        string `yaml:"key_file"`
+	ClientAuthType string `yaml:"client_auth_type"`
+	ClientCAFile   string `yaml:"client_ca_file"`
+	MinVersion     string `yaml:"min_version"`
+}
+
+var clientAuthTypes = map[string]tls.ClientAuthType{
+	"":                           tls.NoClientCert,
+	"NoClientCert":               tls.NoClientCert,
+	"RequestClientCert":          tls.RequestClientCert,
+	"RequireAnyClientCert":       tls.RequireAnyClientCert,
+	"VerifyClientCertIfGiven":    tls.VerifyClientCertIfGiven,
+	"RequireAndVerifyClientCert": tls.RequireAndVerifyClientCert,
+}
+
+var tlsVersions = map[string]uint16{
+	"":      tls.VersionTLS12,
+	"TLS10": tls.VersionTLS10,
+	"TLS11": tls.VersionTLS11,
+	"TLS12": tls.VersionTLS12,
+	"TLS13": tls.VersionTLS13,
+}
+
+var defaultUnauthenticatedPaths = []string{"/healthz", "/livez", "/readyz"}
+
+func LoadConfig(path string) (*Config, error) {
+	bd, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	c := &Config{}
+	if err := yaml.Unmarshal(bd, c); err != nil {
+		return nil, err
+	}
+	if c.UnauthenticatedPaths == nil {
+		c.UnauthenticatedPaths = defaultUnauthenticatedPaths
+	}
+	if t := c.TLSServerConfig; t != nil {
+		if t.CertFile == "" || t.KeyFile == "" {
+			return nil, errors.New("tls_server_config requires cert_file and key_file")
+		}
+		cat, ok := clientAuthTypes[t.ClientAuthType]
+		if !ok {
+			return nil, fmt.Errorf("unknown client_auth_type %q", t.ClientAuthType)
+		}
+		if cat >= tls.VerifyClientCertIfGiven && t.ClientCAFile == "" {
+			return nil, fmt.Errorf("client_auth_type %s requires client_ca_file", t.ClientAuthType)
+		}
+		if _, ok := tlsVersions[t.MinVersion]; !ok {
+			return nil, fmt.Errorf("unknown min_version %q", t.MinVersion)
+		}
+	}
+	return c, nil
+}
@@ -0,0 +1,232 @@
+package web
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// reloader keeps the certificate and client CA pool in memory, reloading
+// them when the files change on disk so that renewed certificates are
+// picked up without a restart.
+type reloader struct {
+	cfg *TLSConfig
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	certMod time.Time
+	keyMod  time.Time
+	pool    *x509.CertPool
+	poolMod time.Time
+}
+
+func modTime(path string) (time.Time, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return fi.ModTime(), nil
+}
+
+func (r *reloader) certificate() (*tls.Certificate, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	cm, err := modTime(r.cfg.CertFile)
+	if err != nil {
+		return nil, err
+	}
+	km, err := modTime(r.cfg.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	if r.cert != nil && cm.Equal(r.certMod) && km.Equal(r.keyMod) {
+		return r.cert, nil
+	}
+	cert, err := tls.LoadX509KeyPair(r.cfg.CertFile, r.cfg.KeyFile)
+	if err != nil {
+		// keep serving the previous certificate if the new one is broken,
+		// eg while it's half written
+		if r.cert != nil {
+			log.WithFields(log.Fields{
+				"app": "tdarr_exporter",
+				"fn":  "certificate",
+			}).WithError(err).Error("error reloading certificate, keeping the previous one")
+			return r.cert, nil
+		}
+		return nil, err
+	}
+	r.cert, r.certMod, r.keyMod = &cert, cm, km
+	return r.cert, nil
+}
+
+func (r *reloader) clientCAs() (*x509.CertPool, error) {
+	if r.cfg.ClientCAFile == "" {
+		return nil, nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	m, err := modTime(r.cfg.ClientCAFile)
+	if err != nil {
+		return nil, err
+	}
+	if r.pool != nil && m.Equal(r.poolMod) {
+		return r.pool, nil
+	}
+	pem, err := os.ReadFile(r.cfg.ClientCAFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %s", r.cfg.ClientCAFile)
+	}
+	r.pool, r.poolMod = pool, m
+	return pool, nil
+}
+
+func (r *reloader) tlsConfig() *tls.Config {
+	base := &tls.Config{
+		MinVersion: tlsVersions[r.cfg.MinVersion],
+		ClientAuth: clientAuthTypes[r.cfg.ClientAuthType],
+	}
+	base.GetCertificate = func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+		return r.certificate()
+	}
+	// the config is rebuilt for every handshake so that both the
+	// certificate and the client CAs follow the files on disk
+	base.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		cert, err := r.certificate()
+		if err != nil {
+			return nil, err
+		}
+		pool, err := r.clientCAs()
+		if err != nil {
+			return nil, err
+		}
+		c := base.Clone()
+		c.GetConfigForClient = nil
+		c.GetCertificate = nil
+		c.Certificates = []tls.Certificate{*cert}
+		c.ClientCAs = pool
+		return c, nil
+	}
+	return base
+}
+
+// authenticator checks basic auth credentials against bcrypt hashes.
+// Successful checks are cached, as bcrypt is deliberately slow and
+// prometheus sends the same credentials on every scrape.
+type authenticator struct {
+	users map[string]string
+	open  map[string]bool
+
+	mu    sync.Mutex
+	cache map[[32]byte]bool
+}
+
+// dummyHash is compared against for unknown users, so that the response
+// time doesn't reveal which users exist.
+var dummyHash, _ = bcrypt.GenerateFromPassword([]byte("tdarr_exporter"), bcrypt.DefaultCost)
+
+func (a *authenticator) valid(user, pass string) bool {
+	key := sha256.Sum256([]byte(user + "\x00" + pass))
+	a.mu.Lock()
+	ok := a.cache[key]
+	a.mu.Unlock()
+	if ok {
+		return true
+	}
+	hash, known := a.users[user]
+	if !known {
+		bcrypt.CompareHashAndPassword(dummyHash, []byte(pass))
+		return false
+	}
+	if bcrypt.CompareHashAndPassword([]byte(hash), []byte(pass)) != nil {
+		return false
+	}
+	a.mu.Lock()
+	a.cache[key] = true
+	a.mu.Unlock()
+	return true
+}
+
+func (a *authenticator) wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if a.open[r.URL.Path] {
+			next.ServeHTTP(w, r)
+			return
+		}
+		user, pass, ok := r.BasicAuth()
+		if !ok || !a.valid(user, pass) {
+			w.Header().Set("WWW-Authenticate", `Basic realm="tdarr_exporter"`)
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// handler wraps next with the basic auth of the config, if any users are
+// configured.
+func (c *Config) handler(next http.Handler) http.Handler {
+	if len(c.BasicAuthUsers) == 0 {
+		return next
+	}
+	a := &authenticator{
+		users: c.BasicAuthUsers,
+		open:  make(map[string]bool),
+		cache: make(map[[32]byte]bool),
+	}
+	for _, p := range c.UnauthenticatedPaths {
+		a.open[p] = true
+	}
+	return a.wrap(next)
+}
+
+// ListenAndServe serves srv according to the web config file at path, with
+// TLS and basic auth as configured. An empty path serves plain HTTP without
+// authentication.
+func ListenAndServe(srv *http.Server, path string) error {
+	l := log.WithFields(log.Fields{
+		"app": "tdarr_exporter",
+		"fn":  "ListenAndServe",
+	})
+	if path == "" {
+		l.WithField("addr", srv.Addr).Info("listening")
+		return srv.ListenAndServe()
+	}
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		l.WithError(err).Error("error loading web config")
+		return err
+	}
+	if srv.Handler == nil {
+		srv.Handler = http.DefaultServeMux
+	}
+	srv.Handler = cfg.handler(srv.Handler)
+	if cfg.TLSServerConfig == nil {
+		l.WithField("addr", srv.Addr).Info("listening")
+		return srv.ListenAndServe()
+	}
+	r := &reloader{cfg: cfg.TLSServerConfig}
+	// fail at startup rather than on the first handshake
+	if _, err := r.certificate(); err != nil {
+		l.WithError(err).Error("error loading certificate")
+		return err
+	}
+	if _, err := r.clientCAs(); err != nil {
+		l.WithError(err).Error("error loading client CA")
+		return err
+	}
+	srv.TLSConfig = r.tlsConfig()
+	l.WithField("addr", srv.Addr).Info("listening with tls")
+	return srv.ListenAndServeTLS("", "")
+}
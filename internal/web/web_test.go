@@ -0,0 +1,287 @@
+package web
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// writeConfig writes a web config file and loads it.
+func writeConfig(t *testing.T, yaml string) *Config {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "web.yml")
+	if err := os.WriteFile(path, []byte(yaml), 0600); err != nil {
+		t.Fatal(err)
+	}
+	c, err := LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestBasicAuth(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := writeConfig(t, "basic_auth_users:\n  prometheus: "+string(hash)+"\n")
+	h := c.handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	for _, tc := range []struct {
+		name       string
+		path       string
+		user, pass string
+		want       int
+	}{
+		{"no credentials", "/metrics", "", "", http.StatusUnauthorized},
+		{"valid", "/metrics", "prometheus", "secret", http.StatusOK},
+		// the second check is answered from the cache
+		{"valid again", "/metrics", "prometheus", "secret", http.StatusOK},
+		{"wrong password", "/metrics", "prometheus", "wrong", http.StatusUnauthorized},
+		{"unknown user", "/metrics", "grafana", "secret", http.StatusUnauthorized},
+		{"probe", "/healthz", "", "", http.StatusOK},
+		{"readiness", "/readyz", "", "", http.StatusOK},
+		// unauthenticated paths are matched exactly
+		{"below a probe", "/healthz/metrics", "", "", http.StatusUnauthorized},
+	} {
+		req := httptest.NewRequest("GET", tc.path, nil)
+		if tc.user != "" {
+			req.SetBasicAuth(tc.user, tc.pass)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != tc.want {
+			t.Errorf("%s: got status %d, want %d", tc.name, rec.Code, tc.want)
+		}
+		if rec.Code == http.StatusUnauthorized && rec.Header().Get("WWW-Authenticate") == "" {
+			t.Errorf("%s: no WWW-Authenticate header", tc.name)
+		}
+	}
+}
+
+func TestUnauthenticatedPaths(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := writeConfig(t, "basic_auth_users:\n  prometheus: "+string(hash)+"\nunauthenticated_paths: [/livez]\n")
+	h := c.handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	for path, want := range map[string]int{
+		"/livez": http.StatusOK,
+		// the configured paths replace the defaults
+		"/healthz": http.StatusUnauthorized,
+		"/metrics": http.StatusUnauthorized,
+	} {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+		if rec.Code != want {
+			t.Errorf("%s: got status %d, want %d", path, rec.Code, want)
+		}
+	}
+}
+
+// ca issues certificates for the tests.
+type ca struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+func newCA(t *testing.T) *ca {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &ca{cert: cert, key: key, pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+// issue returns a PEM certificate and key with the serial, for 127.0.0.1 or
+// for client auth.
+func (c *ca) issue(t *testing.T, serial int64, client bool) (certPEM, keyPEM []byte) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "tdarr_exporter"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	if client {
+		tmpl.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, c.cert, &key.PublicKey, c.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kd, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: kd})
+}
+
+// writePair writes a certificate and key, moving their modification time
+// forward so that the change is seen on filesystems with coarse times.
+func writePair(t *testing.T, cfg *TLSConfig, certPEM, keyPEM []byte, mod time.Time) {
+	t.Helper()
+	for path, bd := range map[string][]byte{cfg.CertFile: certPEM, cfg.KeyFile: keyPEM} {
+		if err := os.WriteFile(path, bd, 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, mod, mod); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// serveTLS serves the reloader's TLS config on a local port and returns its
+// address.
+func serveTLS(t *testing.T, r *reloader) string {
+	t.Helper()
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", r.tlsConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}),
+		// the rejected handshakes are expected
+		ErrorLog: log.New(io.Discard, "", 0),
+	}
+	go srv.Serve(ln)
+	t.Cleanup(func() { srv.Close() })
+	return ln.Addr().String()
+}
+
+// client returns an HTTP client trusting the CA, which opens a new
+// connection for every request.
+func (c *ca) client(certs ...tls.Certificate) *http.Client {
+	pool := x509.NewCertPool()
+	pool.AddCert(c.cert)
+	return &http.Client{
+		Timeout: 5 * time.Second,
+		Transport: &http.Transport{
+			TLSClientConfig:   &tls.Config{RootCAs: pool, Certificates: certs},
+			DisableKeepAlives: true,
+		},
+	}
+}
+
+func TestClientCert(t *testing.T) {
+	authority := newCA(t)
+	dir := t.TempDir()
+	cfg := &TLSConfig{
+		CertFile:       filepath.Join(dir, "tls.crt"),
+		KeyFile:        filepath.Join(dir, "tls.key"),
+		ClientCAFile:   filepath.Join(dir, "ca.crt"),
+		ClientAuthType: "RequireAndVerifyClientCert",
+	}
+	certPEM, keyPEM := authority.issue(t, 2, false)
+	writePair(t, cfg, certPEM, keyPEM, time.Now())
+	if err := os.WriteFile(cfg.ClientCAFile, authority.pem, 0600); err != nil {
+		t.Fatal(err)
+	}
+	addr := serveTLS(t, &reloader{cfg: cfg})
+
+	if res, err := authority.client().Get("https://" + addr); err == nil {
+		res.Body.Close()
+		t.Errorf("got status %d without a client certificate", res.StatusCode)
+	}
+	other := newCA(t)
+	otherPEM, otherKey := other.issue(t, 3, true)
+	untrusted, err := tls.X509KeyPair(otherPEM, otherKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res, err := authority.client(untrusted).Get("https://" + addr); err == nil {
+		res.Body.Close()
+		t.Errorf("got status %d with a certificate from another CA", res.StatusCode)
+	}
+	clientPEM, clientKey := authority.issue(t, 4, true)
+	cert, err := tls.X509KeyPair(clientPEM, clientKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := authority.client(cert).Get("https://" + addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("got status %d with a client certificate", res.StatusCode)
+	}
+}
+
+func TestCertificateReload(t *testing.T) {
+	authority := newCA(t)
+	dir := t.TempDir()
+	cfg := &TLSConfig{CertFile: filepath.Join(dir, "tls.crt"), KeyFile: filepath.Join(dir, "tls.key")}
+	certPEM, keyPEM := authority.issue(t, 10, false)
+	mod := time.Now().Add(-time.Minute)
+	writePair(t, cfg, certPEM, keyPEM, mod)
+	addr := serveTLS(t, &reloader{cfg: cfg})
+
+	serial := func() int64 {
+		t.Helper()
+		res, err := authority.client().Get("https://" + addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		return res.TLS.PeerCertificates[0].SerialNumber.Int64()
+	}
+	if got := serial(); got != 10 {
+		t.Fatalf("got certificate %d, want 10", got)
+	}
+	certPEM, keyPEM = authority.issue(t, 11, false)
+	writePair(t, cfg, certPEM, keyPEM, mod.Add(time.Second))
+	if got := serial(); got != 11 {
+		t.Errorf("got certificate %d after rewriting it, want 11", got)
+	}
+	// a broken pair, eg half written, keeps the previous certificate
+	writePair(t, cfg, certPEM[:len(certPEM)/2], keyPEM, mod.Add(2*time.Second))
+	if got := serial(); got != 11 {
+		t.Errorf("got certificate %d with a broken pair, want 11", got)
+	}
+}